@@ -2,6 +2,8 @@ package repository
 
 import (
 	"fmt"
+	"time"
+	"errors"
 	"context"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -23,6 +25,8 @@ type Account struct {
 	Currency                  *Currency        `json:"currency"`
 	Channel                   *Channel         `json:"channel"`
 	Settings                  *AccountSettings `json:"settings"`
+	Version                   *int             `json:"version"`
+	Updated                   *time.Time       `json:"updated"`
 }
 
 func (a *Account) String() string {
@@ -30,14 +34,14 @@ func (a *Account) String() string {
 }
 
 type AccountSpecification interface {
-	ToSqlClauses() string
+	ToSqlClauses() *SqlClauses
 }
 
 type AccountRepository interface {
-	Add(ctx interface{}, account *Account) error
-	Delete(ctx interface{}, account *Account) (error, bool)
-	Update(ctx interface{}, account *Account) (error, bool)
-	Query(ctx interface{}, specification AccountSpecification) (error, int, []*Account)
+	Add(ctx context.Context, account *Account) error
+	Delete(ctx context.Context, account *Account) error
+	Update(ctx context.Context, account *Account) error
+	Query(ctx context.Context, specification AccountSpecification) (error, int, []*Account)
 }
 
 type AccountSpecificationWithLimitAndOffset struct {
@@ -45,22 +49,34 @@ type AccountSpecificationWithLimitAndOffset struct {
 	offset int
 }
 
-func (aswlao *AccountSpecificationWithLimitAndOffset) ToSqlClauses() string {
-	return fmt.Sprintf("limit %d offset %d", aswlao.limit, aswlao.offset)
+func (aswlao *AccountSpecificationWithLimitAndOffset) ToSqlClauses() *SqlClauses {
+	return NewSqlLimitAndOffsetClauses(aswlao.limit, aswlao.offset)
 }
 
 type AccountSpecificationByID struct {
 	id int
 }
 
-func (asbyid *AccountSpecificationByID) ToSqlClauses() string {
-	return fmt.Sprintf("where id=%d", asbyid.id)
+func (asbyid *AccountSpecificationByID) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=?", asbyid.id)
+}
+
+type AccountSpecificationByIDs struct {
+	ids []int
+}
+
+func (asbyids *AccountSpecificationByIDs) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=any(?)", asbyids.ids)
 }
 
 func NewAccountSpecificationByID(id int) AccountSpecification {
 	return &AccountSpecificationByID{id: id}
 }
 
+func NewAccountSpecificationByIDs(ids []int) AccountSpecification {
+	return &AccountSpecificationByIDs{ids: ids}
+}
+
 func NewAccountSpecificationWithLimitAndOffset(limit int, offset int) AccountSpecification {
 	return &AccountSpecificationWithLimitAndOffset{
 		limit:  limit,
@@ -68,6 +84,74 @@ func NewAccountSpecificationWithLimitAndOffset(limit int, offset int) AccountSpe
 	}
 }
 
+func NewAccountSpecificationAnd(specs ...AccountSpecification) AccountSpecification {
+	l := make([]SqlSpecification, 0, len(specs))
+	for _, spec := range specs {
+		l = append(l, spec)
+	}
+	return &SqlSpecificationAnd{specs: l}
+}
+
+func NewAccountSpecificationOr(specs ...AccountSpecification) AccountSpecification {
+	l := make([]SqlSpecification, 0, len(specs))
+	for _, spec := range specs {
+		l = append(l, spec)
+	}
+	return &SqlSpecificationOr{specs: l}
+}
+
+func NewAccountSpecificationNot(spec AccountSpecification) AccountSpecification {
+	return &SqlSpecificationNot{spec: spec}
+}
+
+var accountOrderColumns = []string{"id", "currency_id", "channel_id", "version", "updated"}
+
+func NewAccountSpecificationOrderBy(spec AccountSpecification, column string, desc bool) AccountSpecification {
+	return &SqlSpecificationOrderBy{
+		spec:   spec,
+		column: column,
+		desc:   desc,
+	}
+}
+
+func NewAccountSpecificationPaged(spec AccountSpecification, limit int, offset int) AccountSpecification {
+	return &SqlSpecificationPaged{
+		spec:   spec,
+		limit:  limit,
+		offset: offset,
+	}
+}
+
+func NewAccountSpecificationWithLoad(spec AccountSpecification, load *LoadOptions) AccountSpecification {
+	return &SqlSpecificationWithLoad{
+		spec: spec,
+		load: load,
+	}
+}
+
+func accountsByIds(ctx context.Context, store AccountRepository, ids idSet, load *LoadOptions) (error, map[int]*Account) {
+	m := make(map[int]*Account)
+	if len(ids) == 0 {
+		return nil, m
+	}
+
+	specification := NewAccountSpecificationByIDs(ids.slice())
+	if load != nil {
+		specification = NewAccountSpecificationWithLoad(specification, load)
+	}
+
+	err, _, accounts := store.Query(ctx, specification)
+	if err != nil {
+		return err, m
+	}
+
+	for _, account := range accounts {
+		m[*account.Id] = account
+	}
+
+	return nil, m
+}
+
 type PGPoolAccountStore struct {
 	pool          *pgxpool.Pool
 	currencyStore CurrencyRepository
@@ -75,7 +159,7 @@ type PGPoolAccountStore struct {
 	logger        LoggerFunc
 }
 
-func (as *PGPoolAccountStore) Add(ctx interface{}, account *Account) error {
+func (as *PGPoolAccountStore) Add(ctx context.Context, account *Account) error {
 	var currencyId *int
 	var channelId *int
 
@@ -87,8 +171,8 @@ func (as *PGPoolAccountStore) Add(ctx interface{}, account *Account) error {
 		channelId = account.Channel.Id
 	}
 
-	return as.pool.QueryRow(
-		context.Background(),
+	return mapPgError(pgQuerierFromContext(ctx, as.pool).QueryRow(
+		ctx,
 		`insert into accounts (
 			is_enabled,
 			is_test,
@@ -102,7 +186,7 @@ func (as *PGPoolAccountStore) Add(ctx interface{}, account *Account) error {
 			currency_id,
 			channel_id,
 			settings
-		) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) returning id`,
+		) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) returning id, version, updated`,
 		account.IsEnabled,
 		account.IsTest,
 		account.RebillEnabled,
@@ -115,84 +199,64 @@ func (as *PGPoolAccountStore) Add(ctx interface{}, account *Account) error {
 		currencyId,
 		channelId,
 		account.Settings,
-	).Scan(&account.Id)
+	).Scan(&account.Id, &account.Version, &account.Updated))
 }
 
-func (as *PGPoolAccountStore) refreshAccountCurrency(ctx interface{}, account *Account) error {
-	if !(account.Currency != nil && account.Currency.Id != nil) {
-		return nil
-	}
-
-	err, _, currencies := as.currencyStore.Query(ctx, NewCurrencySpecificationByID(
-		*account.Currency.Id,
-	))
+func (as *PGPoolAccountStore) refreshAccountForeigns(ctx context.Context, load *LoadOptions, accounts ...*Account) error {
+	currencyIds := make(idSet)
+	channelIds := make(idSet)
 
-	if err != nil {
-		return fmt.Errorf("Can not update account currency: %v", err)
-	}
-
-	for _, currency := range currencies {
-		account.Currency = currency
-	}
-
-	return nil
-}
-
-func (as *PGPoolAccountStore) refreshAccountChannel(ctx interface{}, account *Account) error {
-	if !(account.Channel != nil && account.Channel.Id != nil) {
-		return nil
+	for _, account := range accounts {
+		if account.Currency != nil && load.Hydrates("currency") {
+			currencyIds.add(account.Currency.Id)
+		}
+		if account.Channel != nil && load.Hydrates("channel") {
+			channelIds.add(account.Channel.Id)
+		}
 	}
 
-	err, _, channels := as.channelStore.Query(ctx, NewChannelSpecificationByID(
-		*account.Channel.Id,
-	))
-
+	err, currencies := currenciesByIds(ctx, as.currencyStore, currencyIds)
 	if err != nil {
-		return fmt.Errorf("Can not update account channel: %v", err)
-	}
-
-	for _, channel := range channels {
-		account.Channel = channel
+		return fmt.Errorf("Can not update account currency: %w", err)
 	}
 
-	return nil
-}
-
-func (as *PGPoolAccountStore) refreshAccountForeigns(ctx interface{}, account *Account) error {
-	if err := as.refreshAccountCurrency(ctx, account); err != nil {
-		return err
+	err, channels := channelsByIds(ctx, as.channelStore, channelIds)
+	if err != nil {
+		return fmt.Errorf("Can not update account channel: %w", err)
 	}
 
-	if err := as.refreshAccountChannel(ctx, account); err != nil {
-		return err
+	for _, account := range accounts {
+		if account.Currency != nil && account.Currency.Id != nil {
+			if currency, ok := currencies[*account.Currency.Id]; ok {
+				account.Currency = currency
+			}
+		}
+		if account.Channel != nil && account.Channel.Id != nil {
+			if channel, ok := channels[*account.Channel.Id]; ok {
+				account.Channel = channel
+			}
+		}
 	}
 
 	return nil
 }
 
-func (as *PGPoolAccountStore) Query(ctx interface{}, specification AccountSpecification) (error, int, []*Account) {
+func (as *PGPoolAccountStore) Query(ctx context.Context, specification AccountSpecification) (error, int, []*Account) {
 	var l []*Account
 	var c int = 0
 
-	conn, err := as.pool.Acquire(context.Background())
-
-	if err != nil {
-		return fmt.Errorf("failed to acquire connection from the pool: %v", err), c, l
+	conn := pgQuerierFromContext(ctx, as.pool)
+	sqlClauses := specification.ToSqlClauses()
+	if err := sqlClauses.checkOrderBy(accountOrderColumns...); err != nil {
+		return err, c, l
 	}
-	defer conn.Release()
 
-	err = conn.QueryRow(
-		context.Background(),
-		"select count(*) from accounts",
-	).Scan(&c)
-
-	if err != nil {
-		return fmt.Errorf("failed to get accounts cnt: %v", err), c, l
-	}
+	clauses, args := sqlClauses.Build()
 
 	rows, err := conn.Query(
-		context.Background(), fmt.Sprintf(
+		ctx, fmt.Sprintf(
 			`select
+				count(*) over(),
 				id,
 				is_enabled,
 				is_test,
@@ -205,14 +269,17 @@ func (as *PGPoolAccountStore) Query(ctx interface{}, specification AccountSpecif
 				currency_conversion_enabled,
 				settings,
 				currency_id,
-				channel_id
+				channel_id,
+				version,
+				updated
 			from accounts %s`,
-			specification.ToSqlClauses(),
+			clauses,
 		),
+		args...,
 	)
 
 	if err != nil {
-		return fmt.Errorf("failed to query accounts rows: %v", err), c, l
+		return fmt.Errorf("failed to query accounts rows: %w", mapPgError(err)), c, l
 	}
 	defer rows.Close()
 
@@ -222,6 +289,7 @@ func (as *PGPoolAccountStore) Query(ctx interface{}, specification AccountSpecif
 		var channelId *int
 
 		if err = rows.Scan(
+			&c,
 			&account.Id,
 			&account.IsEnabled,
 			&account.IsTest,
@@ -235,8 +303,10 @@ func (as *PGPoolAccountStore) Query(ctx interface{}, specification AccountSpecif
 			&account.Settings,
 			&currencyId,
 			&channelId,
+			&account.Version,
+			&account.Updated,
 		); err != nil {
-			return fmt.Errorf("failed to get account row: %v", err), c, l
+			return fmt.Errorf("failed to get account row: %w", mapPgError(err)), c, l
 		}
 		if currencyId != nil {
 			account.Currency = &Currency{
@@ -248,25 +318,40 @@ func (as *PGPoolAccountStore) Query(ctx interface{}, specification AccountSpecif
 				Id: channelId,
 			}
 		}
-		if err := as.refreshAccountForeigns(ctx, &account); err != nil {
-			return fmt.Errorf("Can not update account foreigns: %v", err), c, l
-		}
 		l = append(l, &account)
 	}
 
 	if err = rows.Err(); err != nil {
-		return fmt.Errorf("failed to iterating over rows of accounts: %v", err), c, l
+		return fmt.Errorf("failed to iterating over rows of accounts: %w", mapPgError(err)), c, l
+	}
+
+	if len(l) == 0 && sqlClauses.Offset != nil && *sqlClauses.Offset > 0 {
+		filter, filterArgs := sqlClauses.Filter().Build()
+
+		err = conn.QueryRow(
+			ctx,
+			fmt.Sprintf("select count(*) from accounts %s", filter),
+			filterArgs...,
+		).Scan(&c)
+
+		if err != nil {
+			return fmt.Errorf("failed to get accounts cnt: %w", mapPgError(err)), c, l
+		}
+	}
+
+	if err := as.refreshAccountForeigns(ctx, sqlClauses.Load, l...); err != nil {
+		return fmt.Errorf("Can not update account foreigns: %w", err), c, l
 	}
 
 	return nil, c, l
 }
 
-func (as *PGPoolAccountStore) Delete(ctx interface{}, account *Account) (error, bool) {
+func (as *PGPoolAccountStore) Delete(ctx context.Context, account *Account) error {
 	var currencyId *int
 	var channelId *int
 
-	err := as.pool.QueryRow(
-		context.Background(),
+	err := pgQuerierFromContext(ctx, as.pool).QueryRow(
+		ctx,
 		`delete from
 			accounts
 		where
@@ -300,6 +385,10 @@ func (as *PGPoolAccountStore) Delete(ctx interface{}, account *Account) (error,
 		&channelId,
 	)
 
+	if err != nil {
+		return mapPgError(err)
+	}
+
 	if currencyId != nil {
 		account.Currency = &Currency{
 			Id: currencyId,
@@ -311,14 +400,18 @@ func (as *PGPoolAccountStore) Delete(ctx interface{}, account *Account) (error,
 		}
 	}
 
-	if e := as.refreshAccountForeigns(ctx, account); e != nil {
-		return fmt.Errorf("Can not update account foreigns: %v", e), err == pgx.ErrNoRows
+	if err := as.refreshAccountForeigns(ctx, nil, account); err != nil {
+		return fmt.Errorf("Can not update account foreigns: %w", err)
 	}
 
-	return err, err == pgx.ErrNoRows
+	return nil
 }
 
-func (as *PGPoolAccountStore) Update(ctx interface{}, account *Account) (error, bool) {
+func (as *PGPoolAccountStore) Update(ctx context.Context, account *Account) error {
+	if err := requireVersion("accounts", account.Id, account.Version); err != nil {
+		return err
+	}
+
 	var currencyId *int
 	var channelId *int
 
@@ -330,8 +423,8 @@ func (as *PGPoolAccountStore) Update(ctx interface{}, account *Account) (error,
 		channelId = account.Channel.Id
 	}
 
-	err := as.pool.QueryRow(
-		context.Background(),
+	err := pgQuerierFromContext(ctx, as.pool).QueryRow(
+		ctx,
 		`update accounts set
 			is_enabled=COALESCE($2, is_enabled),
 			is_test=COALESCE($3, is_test),
@@ -344,9 +437,12 @@ func (as *PGPoolAccountStore) Update(ctx interface{}, account *Account) (error,
 			currency_conversion_enabled=COALESCE($10, currency_conversion_enabled),
 			settings=COALESCE($11, settings),
 			currency_id=COALESCE($12, currency_id),
-			channel_id=COALESCE($13, channel_id)
+			channel_id=COALESCE($13, channel_id),
+			version=version+1,
+			updated=now()
 		where
-			id=$1
+			id=$1 and
+			version=$14
 		returning
 			is_enabled,
 			is_test,
@@ -359,7 +455,9 @@ func (as *PGPoolAccountStore) Update(ctx interface{}, account *Account) (error,
 			currency_conversion_enabled,
 			settings,
 			currency_id,
-			channel_id`,
+			channel_id,
+			version,
+			updated`,
 		account.Id,
 		account.IsEnabled,
 		account.IsTest,
@@ -373,6 +471,7 @@ func (as *PGPoolAccountStore) Update(ctx interface{}, account *Account) (error,
 		account.Settings,
 		currencyId,
 		channelId,
+		account.Version,
 	).Scan(
 		&account.IsEnabled,
 		&account.IsTest,
@@ -386,8 +485,18 @@ func (as *PGPoolAccountStore) Update(ctx interface{}, account *Account) (error,
 		&account.Settings,
 		&currencyId,
 		&channelId,
+		&account.Version,
+		&account.Updated,
 	)
 
+	if errors.Is(err, pgx.ErrNoRows) {
+		return versionConflict(ctx, pgQuerierFromContext(ctx, as.pool), "accounts", account.Id, account.Version)
+	}
+
+	if err != nil {
+		return mapPgError(err)
+	}
+
 	if currencyId != nil {
 		account.Currency = &Currency{
 			Id: currencyId,
@@ -399,11 +508,11 @@ func (as *PGPoolAccountStore) Update(ctx interface{}, account *Account) (error,
 		}
 	}
 
-	if e := as.refreshAccountForeigns(ctx, account); e != nil {
-		return fmt.Errorf("Can not update account foreigns: %v", e), err == pgx.ErrNoRows
+	if err := as.refreshAccountForeigns(ctx, nil, account); err != nil {
+		return fmt.Errorf("Can not update account foreigns: %w", err)
 	}
 
-	return err, err == pgx.ErrNoRows
+	return nil
 }
 
 func NewPGPoolAccountStore(
@@ -0,0 +1,276 @@
+package repository
+
+import (
+	"fmt"
+	"context"
+)
+
+var (
+	ErrOperationNotAllowed = fmt.Errorf("operation not allowed: %w", ErrValidation)
+	ErrBalanceExceeded     = fmt.Errorf("amount exceeds remaining balance: %w", ErrValidation)
+)
+
+// TransactionBalance sums the child transactions referencing a parent by
+// type. Succeeded holds the successful children, Pending the children that
+// are neither successful nor declined yet; pending amounts are held until
+// the child is declined, so concurrent requests can not overdraw the parent.
+type TransactionBalance struct {
+	Parent    *Transaction
+	Succeeded map[string]Money
+	Pending   map[string]Money
+}
+
+func (tb *TransactionBalance) held(types ...string) (error, Money) {
+	total := NewMoney(0, tb.Parent.Currency)
+
+	for _, txType := range types {
+		for _, sums := range []map[string]Money{tb.Succeeded, tb.Pending} {
+			if sum, ok := sums[txType]; ok {
+				err, added := total.Add(sum)
+				if err != nil {
+					return err, total
+				}
+				total = added
+			}
+		}
+	}
+
+	return nil, total
+}
+
+// base returns the amount a follow-up of the given type is measured
+// against, and the types of children already taken from it.
+func (tb *TransactionBalance) base(txType string) (error, Money, []string) {
+	parentType := ""
+	if tb.Parent.Type != nil {
+		parentType = *tb.Parent.Type
+	}
+
+	switch {
+	case parentType == PREAUTH && (txType == CONFIRMAUTH || txType == REVERSAL):
+		return nil, tb.Parent.Money(), []string{CONFIRMAUTH, REVERSAL}
+	case parentType == PREAUTH && txType == REFUND:
+		confirmed := NewMoney(0, tb.Parent.Currency)
+		if sum, ok := tb.Succeeded[CONFIRMAUTH]; ok {
+			confirmed = sum
+		}
+		return nil, confirmed, []string{REFUND}
+	case (parentType == AUTH || parentType == REBILL) && (txType == REVERSAL || txType == REFUND):
+		return nil, tb.Parent.Money(), []string{REVERSAL, REFUND}
+	}
+
+	return fmt.Errorf("%s can not reference %s transaction: %w", txType, parentType, ErrOperationNotAllowed), Money{}, nil
+}
+
+// Remaining returns how much of the parent is left for a follow-up of the
+// given type.
+func (tb *TransactionBalance) Remaining(txType string) (error, Money) {
+	err, base, types := tb.base(txType)
+	if err != nil {
+		return err, base
+	}
+
+	err, held := tb.held(types...)
+	if err != nil {
+		return err, base
+	}
+
+	err, remaining := base.Sub(held)
+	if err != nil {
+		// the children already exceed the base, nothing is left
+		return nil, NewMoney(0, base.Currency)
+	}
+
+	return nil, remaining
+}
+
+func flagEnabled(flag *bool) bool {
+	return flag != nil && *flag
+}
+
+// Validate checks that the account allows a follow-up of the given type
+// and amount and that the parent balance covers it.
+func (tb *TransactionBalance) Validate(account *Account, txType string, requested Money) error {
+	if tb.Parent.Status == nil || *tb.Parent.Status != SUCCESS {
+		return fmt.Errorf("%s of a not successful transaction: %w", txType, ErrOperationNotAllowed)
+	}
+
+	if requested.IsZero() {
+		return fmt.Errorf("%s amount is zero: %w", txType, ErrValidation)
+	}
+
+	err, base, _ := tb.base(txType)
+	if err != nil {
+		return err
+	}
+
+	err, cmp := requested.Cmp(base)
+	if err != nil {
+		return err
+	}
+	partial := cmp < 0
+
+	var enabled, partialEnabled bool
+	switch txType {
+	case CONFIRMAUTH:
+		enabled, partialEnabled = true, flagEnabled(account.PartialConfirmEnabled)
+	case REVERSAL:
+		enabled, partialEnabled = flagEnabled(account.ReversalEnabled), flagEnabled(account.PartialReversalEnabled)
+	case REFUND:
+		enabled, partialEnabled = flagEnabled(account.RefundEnabled), flagEnabled(account.PartialRefundEnabled)
+	}
+
+	if !enabled {
+		return fmt.Errorf("%s is disabled for account with id=%v: %w", txType, *account.Id, ErrOperationNotAllowed)
+	}
+
+	if partial && !partialEnabled {
+		return fmt.Errorf("partial %s is disabled for account with id=%v: %w", txType, *account.Id, ErrOperationNotAllowed)
+	}
+
+	err, remaining := tb.Remaining(txType)
+	if err != nil {
+		return err
+	}
+
+	if err, cmp := requested.Cmp(remaining); err != nil {
+		return err
+	} else if cmp > 0 {
+		return fmt.Errorf("%s of %s, remaining %s: %w", txType, requested, remaining, ErrBalanceExceeded)
+	}
+
+	return nil
+}
+
+// balance sums the children of the parent transaction, locking the parent
+// row when lock is set so concurrent follow-ups are serialized.
+func (ts *PGPoolTransactionStore) balance(ctx context.Context, parentId int, lock bool) (error, *TransactionBalance) {
+	conn := pgQuerierFromContext(ctx, ts.pool)
+	parent := &Transaction{Id: &parentId}
+	var accountId *int
+	var currencyId *int
+
+	query := "select type, status, amount, currency_id, account_id from transactions where id=$1"
+	if lock {
+		query += " for update"
+	}
+
+	err := conn.QueryRow(ctx, query, parentId).Scan(
+		&parent.Type,
+		&parent.Status,
+		&parent.Amount,
+		&currencyId,
+		&accountId,
+	)
+
+	if err != nil {
+		return fmt.Errorf("Can not get parent transaction with id=%v: %w", parentId, mapPgError(err)), nil
+	}
+
+	if accountId != nil {
+		parent.Account = &Account{
+			Id: accountId,
+		}
+	}
+
+	if currencyId != nil {
+		currencyIds := make(idSet)
+		currencyIds.add(currencyId)
+
+		err, currencies := currenciesByIds(ctx, ts.currencyStore, currencyIds)
+		if err != nil {
+			return fmt.Errorf("Can not update parent transaction currency: %w", err), nil
+		}
+
+		parent.Currency = currencies[*currencyId]
+	}
+
+	balance := &TransactionBalance{
+		Parent:    parent,
+		Succeeded: make(map[string]Money),
+		Pending:   make(map[string]Money),
+	}
+
+	rows, err := conn.Query(
+		ctx,
+		`select
+			type,
+			COALESCE(sum(amount) filter (where status=$2), 0),
+			COALESCE(sum(amount) filter (where status<>all($3)), 0)
+		from transactions
+		where
+			reference_id=$1
+		group by type`,
+		parentId,
+		SUCCESS,
+		finalStatuses,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to query balance rows: %w", mapPgError(err)), nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var txType string
+		var succeeded uint
+		var pending uint
+
+		if err := rows.Scan(&txType, &succeeded, &pending); err != nil {
+			return fmt.Errorf("failed to get balance row: %w", mapPgError(err)), nil
+		}
+
+		balance.Succeeded[txType] = NewMoney(succeeded, parent.Currency)
+		balance.Pending[txType] = NewMoney(pending, parent.Currency)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterating over rows of balance: %w", mapPgError(err)), nil
+	}
+
+	return nil, balance
+}
+
+func (ts *PGPoolTransactionStore) Balance(ctx context.Context, parent *Transaction) (error, *TransactionBalance) {
+	return ts.balance(ctx, *parent.Id, false)
+}
+
+// AddReferenced adds a confirm, reversal or refund of transaction.Reference
+// after validating it against the parent balance and account flags. The
+// parent row stays locked until the child is stored, so the check and the
+// insert are atomic.
+func (ts *PGPoolTransactionStore) AddReferenced(ctx context.Context, transaction *Transaction) error {
+	if transaction.Reference == nil || transaction.Reference.Id == nil {
+		return fmt.Errorf("%s transaction without reference: %w", *transaction.Type, ErrValidation)
+	}
+
+	uow := NewPGPoolUnitOfWork(ts.pool, ts.logger)
+
+	return uow.Do(ctx, func(ctx context.Context) error {
+		err, balance := ts.balance(ctx, *transaction.Reference.Id, true)
+		if err != nil {
+			return err
+		}
+
+		account := balance.Parent.Account
+		if account == nil {
+			return fmt.Errorf("parent transaction with id=%v has no account: %w", *transaction.Reference.Id, ErrOperationNotAllowed)
+		}
+
+		err, accounts := accountsByIds(ctx, ts.accountStore, idSet{*account.Id: {}}, NewLoadOptions(LoadIDsOnly))
+		if err != nil {
+			return fmt.Errorf("Can not get parent transaction account: %w", err)
+		}
+
+		account, ok := accounts[*account.Id]
+		if !ok {
+			return fmt.Errorf("account with id=%v: %w", *balance.Parent.Account.Id, ErrNotFound)
+		}
+
+		if err := balance.Validate(account, *transaction.Type, transaction.Money()); err != nil {
+			return err
+		}
+
+		return ts.Add(ctx, transaction)
+	})
+}
@@ -0,0 +1,365 @@
+package repository
+
+import (
+	"io"
+	"fmt"
+	"sync"
+	"errors"
+	"context"
+	"strings"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/wk8/go-ordered-map"
+)
+
+const (
+	CARD_TYPE_DEBIT   = "debit"
+	CARD_TYPE_CREDIT  = "credit"
+	CARD_TYPE_PREPAID = "prepaid"
+)
+
+// BinRange describes the cards whose PAN starts with a prefix in
+// [From, To]. Both bounds have the same number of digits, usually 6 or 8.
+type BinRange struct {
+	Id       *int    `json:"id"`
+	From     *string `json:"from"`
+	To       *string `json:"to"`
+	Brand    *string `json:"brand"`
+	Issuer   *string `json:"issuer"`
+	Country  *string `json:"country"`
+	CardType *string `json:"card_type"`
+	Level    *string `json:"level"`
+}
+
+// Contains tells whether the PAN starts with a prefix of the range. Digit
+// strings of the same length compare as numbers.
+func (br *BinRange) Contains(pan PAN) bool {
+	if br.From == nil || br.To == nil || len(pan) < len(*br.From) {
+		return false
+	}
+	prefix := string(pan[:len(*br.From)])
+	return prefix >= *br.From && prefix <= *br.To
+}
+
+// narrower tells whether the range is more specific than other: it has a
+// longer prefix or, for the same length, fewer prefixes.
+func (br *BinRange) narrower(other *BinRange) bool {
+	if len(*br.From) != len(*other.From) {
+		return len(*br.From) > len(*other.From)
+	}
+	return *br.To < *other.To || (*br.To == *other.To && *br.From > *other.From)
+}
+
+func validateBinRange(br *BinRange) error {
+	if br.From == nil || br.To == nil {
+		return fmt.Errorf("bin range without bounds: %w", ErrValidation)
+	}
+
+	if len(*br.From) != len(*br.To) || len(*br.From) < 4 || len(*br.From) > maxPANLength {
+		return fmt.Errorf("bin range %s-%s bounds must have the same 4 to %d digits: %w", *br.From, *br.To, maxPANLength, ErrValidation)
+	}
+
+	for _, r := range *br.From + *br.To {
+		if r < '0' || r > '9' {
+			return fmt.Errorf("bin range %s-%s must contain digits only: %w", *br.From, *br.To, ErrValidation)
+		}
+	}
+
+	if *br.From > *br.To {
+		return fmt.Errorf("bin range %s-%s is empty: %w", *br.From, *br.To, ErrValidation)
+	}
+
+	if br.CardType != nil {
+		switch *br.CardType {
+		case CARD_TYPE_DEBIT, CARD_TYPE_CREDIT, CARD_TYPE_PREPAID:
+		default:
+			return fmt.Errorf("unknown card type %s: %w", *br.CardType, ErrValidation)
+		}
+	}
+
+	return nil
+}
+
+// BinRangeSpecification matches ranges in memory, ToSqlClauses carries the
+// paging the store applies to the matched ranges.
+type BinRangeSpecification interface {
+	Specified(binRange *BinRange, i int) bool
+	ToSqlClauses() *SqlClauses
+}
+
+type BinRangeRepository interface {
+	Add(ctx context.Context, binRange *BinRange) error
+	Delete(ctx context.Context, binRange *BinRange) error
+	Query(ctx context.Context, specification BinRangeSpecification) (error, int, []*BinRange)
+}
+
+type BinRangeSpecificationWithLimitAndOffset struct {
+	limit  int
+	offset int
+}
+
+func (brswlao *BinRangeSpecificationWithLimitAndOffset) Specified(binRange *BinRange, i int) bool {
+	// paging is applied by the store once the ranges are matched
+	return true
+}
+
+func (brswlao *BinRangeSpecificationWithLimitAndOffset) ToSqlClauses() *SqlClauses {
+	return NewSqlLimitAndOffsetClauses(brswlao.limit, brswlao.offset)
+}
+
+type BinRangeSpecificationByPAN struct {
+	pan PAN
+}
+
+func (brsbypan *BinRangeSpecificationByPAN) Specified(binRange *BinRange, i int) bool {
+	return binRange.Contains(brsbypan.pan)
+}
+
+func (brsbypan *BinRangeSpecificationByPAN) ToSqlClauses() *SqlClauses {
+	return &SqlClauses{}
+}
+
+func NewBinRangeSpecificationWithLimitAndOffset(limit int, offset int) BinRangeSpecification {
+	return &BinRangeSpecificationWithLimitAndOffset{
+		limit:  limit,
+		offset: offset,
+	}
+}
+
+func NewBinRangeSpecificationByPAN(pan PAN) BinRangeSpecification {
+	return &BinRangeSpecificationByPAN{
+		pan: pan,
+	}
+}
+
+type OrderedMapBinRangeStore struct {
+	sync.Mutex
+
+	ranges *orderedmap.OrderedMap
+	nextId int
+	logger LoggerFunc
+}
+
+func (bs *OrderedMapBinRangeStore) Add(ctx context.Context, binRange *BinRange) error {
+	if err := validateBinRange(binRange); err != nil {
+		return err
+	}
+
+	bs.Lock()
+	defer bs.Unlock()
+
+	id := bs.nextId
+	binRange.Id = &id
+	bs.ranges.Set(*binRange.Id, *binRange)
+	bs.nextId++
+
+	return nil
+}
+
+func (bs *OrderedMapBinRangeStore) Delete(ctx context.Context, binRange *BinRange) error {
+	bs.Lock()
+	defer bs.Unlock()
+
+	value, present := bs.ranges.Delete(*binRange.Id)
+	if !present {
+		return fmt.Errorf("bin range with id=%v: %w", *binRange.Id, ErrNotFound)
+	}
+
+	*binRange = value.(BinRange)
+
+	return nil
+}
+
+func (bs *OrderedMapBinRangeStore) Query(ctx context.Context, specification BinRangeSpecification) (error, int, []*BinRange) {
+	bs.Lock()
+	defer bs.Unlock()
+
+	var l []*BinRange
+	var c int = 0
+
+	for el := bs.ranges.Oldest(); el != nil; el = el.Next() {
+		binRange := el.Value.(BinRange)
+		if specification.Specified(&binRange, c) {
+			l = append(l, &binRange)
+		}
+		c++
+	}
+
+	start, end := pageBounds(specification.ToSqlClauses(), len(l))
+
+	return nil, len(l), l[start:end]
+}
+
+func NewOrderedMapBinRangeStore(
+	ranges *orderedmap.OrderedMap,
+	logger LoggerFunc,
+) BinRangeRepository {
+	return &OrderedMapBinRangeStore{
+		ranges: ranges,
+		nextId: 1,
+		logger: logger,
+	}
+}
+
+// LookupBin returns the most specific range containing the PAN.
+func LookupBin(ctx context.Context, bins BinRangeRepository, pan PAN) (error, *BinRange) {
+	err, _, ranges := bins.Query(ctx, NewBinRangeSpecificationByPAN(pan))
+	if err != nil {
+		return err, nil
+	}
+
+	var found *BinRange
+	for _, binRange := range ranges {
+		if found == nil || binRange.narrower(found) {
+			found = binRange
+		}
+	}
+
+	if found == nil {
+		return fmt.Errorf("bin of %s: %w", pan, ErrNotFound), nil
+	}
+
+	return nil, found
+}
+
+var binCsvHeader = []string{"from", "to", "brand", "issuer", "country", "card_type", "level"}
+
+func optionalField(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// LoadBinRangesCSV adds the ranges read from r, a CSV file with the header
+// from,to,brand,issuer,country,card_type,level, and returns how many were
+// added. Empty fields other than the bounds are left unset.
+func LoadBinRangesCSV(ctx context.Context, bins BinRangeRepository, r io.Reader) (error, int) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("can not read bin ranges header: %w", NewRepositoryError(ErrValidation, err)), 0
+	}
+
+	if strings.Join(header, ",") != strings.Join(binCsvHeader, ",") {
+		return fmt.Errorf("unexpected bin ranges header %v: %w", header, ErrValidation), 0
+	}
+
+	c := 0
+
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("can not read bin ranges line %d: %w", line, NewRepositoryError(ErrValidation, err)), c
+		}
+
+		binRange := &BinRange{
+			From:     &row[0],
+			To:       &row[1],
+			Brand:    optionalField(row[2]),
+			Issuer:   optionalField(row[3]),
+			Country:  optionalField(row[4]),
+			CardType: optionalField(strings.ToLower(row[5])),
+			Level:    optionalField(row[6]),
+		}
+
+		if err := bins.Add(ctx, binRange); err != nil {
+			return fmt.Errorf("can not load bin ranges line %d: %w", line, err), c
+		}
+		c++
+	}
+
+	return nil, c
+}
+
+// CardFilter restricts a route to cards by their bin. An empty list allows
+// any value, otherwise the card value must be in the list. Cards of an
+// unknown bin only pass a filter with all lists empty.
+type CardFilter struct {
+	Brands    []string `json:"brands"`
+	Issuers   []string `json:"issuers"`
+	Countries []string `json:"countries"`
+	CardTypes []string `json:"card_types"`
+	Levels    []string `json:"levels"`
+}
+
+func filterAllows(allowed []string, value *string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	if value == nil {
+		return false
+	}
+
+	for _, a := range allowed {
+		if strings.EqualFold(a, *value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cf *CardFilter) Matches(binRange *BinRange) bool {
+	if binRange == nil {
+		binRange = &BinRange{}
+	}
+
+	return filterAllows(cf.Brands, binRange.Brand) &&
+		filterAllows(cf.Issuers, binRange.Issuer) &&
+		filterAllows(cf.Countries, binRange.Country) &&
+		filterAllows(cf.CardTypes, binRange.CardType) &&
+		filterAllows(cf.Levels, binRange.Level)
+}
+
+// CardFilter reads the "card_filter" key of the settings, nil when the
+// route has none.
+func (rs RouterSettings) CardFilter() (error, *CardFilter) {
+	value, ok := rs["card_filter"]
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	body, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("can not marshal card filter: %v", err), nil
+	}
+
+	var filter CardFilter
+	if err := json.Unmarshal(body, &filter); err != nil {
+		return fmt.Errorf("can not unmarshal card filter: %w", NewRepositoryError(ErrValidation, err)), nil
+	}
+
+	return nil, &filter
+}
+
+// RoutesForCard keeps the routes whose card filter allows the card bin,
+// routes without a filter allow any card.
+func RoutesForCard(routes []*Route, card *Card) (error, []*Route) {
+	var l []*Route
+
+	for _, route := range routes {
+		if route.Settings == nil {
+			l = append(l, route)
+			continue
+		}
+
+		err, filter := route.Settings.CardFilter()
+		if err != nil {
+			return fmt.Errorf("route with id=%v: %w", *route.Id, err), nil
+		}
+
+		if filter == nil || filter.Matches(card.Bin) {
+			l = append(l, route)
+		}
+	}
+
+	return nil, l
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"github.com/wk8/go-ordered-map"
+)
+
+const testBinRanges = `from,to,brand,issuer,country,card_type,level
+400000,499999,Visa,,,,
+411111,411111,Visa,Test Bank,US,Credit,classic
+510000,559999,MasterCard,,,,
+55555555,55555555,MasterCard,Other Bank,GB,debit,
+222100,272099,MasterCard,,,,
+`
+
+func newTestBinRangeStore(t *testing.T) BinRangeRepository {
+	bins := NewOrderedMapBinRangeStore(orderedmap.New(), testLogger)
+
+	err, c := LoadBinRangesCSV(context.Background(), bins, strings.NewReader(testBinRanges))
+	if err != nil || c != 5 {
+		t.Fatalf("load = %d, %v, want 5", c, err)
+	}
+
+	return bins
+}
+
+func TestBinRangeQueryPaging(t *testing.T) {
+	ctx := context.Background()
+	bins := newTestBinRangeStore(t)
+
+	cases := []struct {
+		name  string
+		spec  BinRangeSpecification
+		total int
+		froms []string
+	}{
+		{"first page", NewBinRangeSpecificationWithLimitAndOffset(2, 0), 5, []string{"400000", "411111"}},
+		{"last page", NewBinRangeSpecificationWithLimitAndOffset(2, 4), 5, []string{"222100"}},
+		{"past end", NewBinRangeSpecificationWithLimitAndOffset(2, 9), 5, nil},
+		{"negative limit", NewBinRangeSpecificationWithLimitAndOffset(-1, 0), 5, nil},
+		{"by pan", NewBinRangeSpecificationByPAN("5555555555554444"), 2, []string{"510000", "55555555"}},
+	}
+
+	for _, c := range cases {
+		err, total, l := bins.Query(ctx, c.spec)
+		if err != nil {
+			t.Fatalf("%s: query failed: %v", c.name, err)
+		}
+
+		var froms []string
+		for _, binRange := range l {
+			froms = append(froms, *binRange.From)
+		}
+
+		if total != c.total || strings.Join(froms, ",") != strings.Join(c.froms, ",") {
+			t.Errorf("%s: got %d %v, want %d %v", c.name, total, froms, c.total, c.froms)
+		}
+	}
+}
+
+func TestLookupBinPicksNarrowestRange(t *testing.T) {
+	ctx := context.Background()
+	bins := newTestBinRangeStore(t)
+
+	err, binRange := LookupBin(ctx, bins, "4111111111111111")
+	if err != nil || *binRange.From != "411111" || *binRange.CardType != CARD_TYPE_CREDIT {
+		t.Errorf("lookup = %+v, %v, want 411111 credit", binRange, err)
+	}
+
+	err, binRange = LookupBin(ctx, bins, "5555555555554444")
+	if err != nil || *binRange.From != "55555555" {
+		t.Errorf("lookup = %+v, %v, want 55555555", binRange, err)
+	}
+}
@@ -2,6 +2,7 @@ package repository
 
 import (
 	"fmt"
+	"context"
 	"sync"
 	"time"
 	"regexp"
@@ -9,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"bytes"
+	"net/url"
 	"net/http"
 	"io/ioutil"
 	"crypto/sha256"
@@ -43,11 +45,12 @@ func (s PAN) String() string {
 }
 
 type Card struct {
-	Id      *int     `json:"id"`
-	Token   *string  `json:"token"`
-	PAN     *PAN     `json:"pan"`
-	ExpDate *ExpDate `json:"exp_date"`
-	Holder  *string  `json:"holder"`
+	Id      *int      `json:"id"`
+	Token   *string   `json:"token"`
+	PAN     *PAN      `json:"pan"`
+	ExpDate *ExpDate  `json:"exp_date"`
+	Holder  *string   `json:"holder"`
+	Bin     *BinRange `json:"bin,omitempty"`
 }
 
 func (c Card) String() string {
@@ -55,12 +58,18 @@ func (c Card) String() string {
 	return fmt.Sprintf("%s (%s) <%s> [%s]", *c.PAN, expire.Format(EXPIRE_DATE_FORMAT), *c.Token, c.Type())
 }
 
+// Type is the brand of the bin the card was enriched with, otherwise the
+// brand matched by the card number prefix.
 func (c Card) Type() string {
+	if c.Bin != nil && c.Bin.Brand != nil {
+		return *c.Bin.Brand
+	}
+
 	expire := *c.ExpDate
 	card := creditcard.Card{
 		Number: string(*c.PAN),
-		Month: expire.Month().String(),
-		Year: string(expire.Year()),
+		Month: fmt.Sprintf("%02d", int(expire.Month())),
+		Year: strconv.Itoa(expire.Year()),
 	}
 	err := card.Method()
 	if err != nil {
@@ -69,16 +78,38 @@ func (c Card) Type() string {
 	return card.Company.Short
 }
 
+// Enrich sets Bin to the most specific bin range of the card, leaving it
+// empty when the bin is unknown.
+func (c *Card) Enrich(ctx context.Context, bins BinRangeRepository) error {
+	err, binRange := LookupBin(ctx, bins, *c.PAN)
+	if errors.Is(err, ErrNotFound) {
+		c.Bin = nil
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Can not get bin of card: %w", err)
+	}
+
+	c.Bin = binRange
+
+	return nil
+}
+
+// CardSpecification is matched in memory, sent as query string to the
+// remote store or translated to SQL by the vault, which passes the keyed
+// hash PANs are stored under.
 type CardSpecification interface {
 	Specified(card *Card, i int) bool
 	ToQwrStr() string
+	ToSqlClauses(hashPAN func(pan PAN) string) *SqlClauses
 }
 
 type CardRepository interface {
-	Add(ctx interface{}, card *Card) error
-	Delete(ctx interface{}, card *Card) (error, bool)
-	//Update(ctx interface{}, card *Card) (error, bool)
-	Query(ctx interface{}, specification CardSpecification) (error, int, []*Card)
+	Add(ctx context.Context, card *Card) error
+	Delete(ctx context.Context, card *Card) error
+	Update(ctx context.Context, card *Card) error
+	Query(ctx context.Context, specification CardSpecification) (error, int, []*Card)
 }
 
 type CardSpecificationWithLimitAndOffset struct {
@@ -94,6 +125,10 @@ func (cswlao *CardSpecificationWithLimitAndOffset) ToQwrStr() string {
 	return fmt.Sprintf("?limit=%d&offset=%d", cswlao.limit, cswlao.offset)
 }
 
+func (cswlao *CardSpecificationWithLimitAndOffset) ToSqlClauses(hashPAN func(pan PAN) string) *SqlClauses {
+	return NewSqlLimitAndOffsetClauses(cswlao.limit, cswlao.offset)
+}
+
 type CardSpecificationByPAN struct {
 	pan PAN
 }
@@ -103,7 +138,27 @@ func (csbypan *CardSpecificationByPAN) Specified(card *Card, i int) bool {
 }
 
 func (csbypan *CardSpecificationByPAN) ToQwrStr() string {
-	return fmt.Sprintf("?pan=%s&limit=1", string(csbypan.pan))
+	return fmt.Sprintf("?pan=%s&limit=1", url.QueryEscape(string(csbypan.pan)))
+}
+
+func (csbypan *CardSpecificationByPAN) ToSqlClauses(hashPAN func(pan PAN) string) *SqlClauses {
+	return NewSqlWhereClauses("pan_hash=?", hashPAN(csbypan.pan))
+}
+
+type CardSpecificationByToken struct {
+	token string
+}
+
+func (csbytoken *CardSpecificationByToken) Specified(card *Card, i int) bool {
+	return card.Token != nil && csbytoken.token == *card.Token
+}
+
+func (csbytoken *CardSpecificationByToken) ToQwrStr() string {
+	return fmt.Sprintf("?token=%s&limit=1", url.QueryEscape(csbytoken.token))
+}
+
+func (csbytoken *CardSpecificationByToken) ToSqlClauses(hashPAN func(pan PAN) string) *SqlClauses {
+	return NewSqlWhereClauses("token=?", csbytoken.token)
 }
 
 type OrderedMapCardStore struct {
@@ -127,7 +182,11 @@ func generateToken(size int) (error, *string) {
 	return nil, &token
 }
 
-func (cs *OrderedMapCardStore) Add(ctx interface{}, card *Card) error {
+func (cs *OrderedMapCardStore) Add(ctx context.Context, card *Card) error {
+	if err := ValidateCard(card, time.Now()); err != nil {
+		return err
+	}
+
 	cs.Lock()
 	defer cs.Unlock()
 
@@ -145,13 +204,13 @@ func (cs *OrderedMapCardStore) Add(ctx interface{}, card *Card) error {
 	return nil
 }
 
-func (cs *OrderedMapCardStore) Delete(ctx interface{}, card *Card) (error, bool) {
+func (cs *OrderedMapCardStore) Delete(ctx context.Context, card *Card) error {
 	cs.Lock()
 	defer cs.Unlock()
 
 	value, present := cs.cards.Delete(*card.Id)
 	if !present {
-		return fmt.Errorf("card with id=%v not found", *card.Id), true
+		return fmt.Errorf("card with id=%v: %w", *card.Id, ErrNotFound)
 	}
 
 	deleted := value.(Card)
@@ -160,31 +219,33 @@ func (cs *OrderedMapCardStore) Delete(ctx interface{}, card *Card) (error, bool)
 	card.ExpDate = deleted.ExpDate
 	card.Holder = deleted.Holder
 
-	return nil, false
+	return nil
 }
-/*
-func (cs *OrderedMapCardStore) Update(ctx interface{}, card *Card) (error, bool) {
+
+// Update changes the expiry date and the holder of a reissued card. The
+// token stays the same, so references to the card remain valid, and the
+// PAN can not be changed.
+func (cs *OrderedMapCardStore) Update(ctx context.Context, card *Card) error {
+	if err := ValidateCardUpdate(card, time.Now()); err != nil {
+		return err
+	}
+
 	cs.Lock()
 	defer cs.Unlock()
 
 	value, present := cs.cards.Get(*card.Id)
 	if !present {
-		return fmt.Errorf("card with id=%v not found", *card.Id), true
+		return fmt.Errorf("card with id=%v: %w", *card.Id, ErrNotFound)
 	}
 
 	old := value.(Card)
 
-	if card.Token != nil {
-		old.Token = card.Token
-	} else {
-		card.Token = old.Token
+	if card.PAN != nil && *card.PAN != *old.PAN {
+		return fmt.Errorf("pan of card with id=%v can not be changed: %w", *card.Id, ErrValidation)
 	}
 
-	if card.PAN != nil {
-		old.PAN = card.PAN
-	} else {
-		card.PAN = old.PAN
-	}
+	card.Token = old.Token
+	card.PAN = old.PAN
 
 	if card.ExpDate != nil {
 		old.ExpDate = card.ExpDate
@@ -200,10 +261,10 @@ func (cs *OrderedMapCardStore) Update(ctx interface{}, card *Card) (error, bool)
 
 	cs.cards.Set(*old.Id, old)
 
-	return nil, false
+	return nil
 }
-*/
-func (cs *OrderedMapCardStore) Query(ctx interface{}, specification CardSpecification) (error, int, []*Card) {
+
+func (cs *OrderedMapCardStore) Query(ctx context.Context, specification CardSpecification) (error, int, []*Card) {
 	cs.Lock()
 	defer cs.Unlock()
 
@@ -238,6 +299,12 @@ func NewCardSpecificationByPAN(pan PAN) CardSpecification {
 	}
 }
 
+func NewCardSpecificationByToken(token string) CardSpecification {
+	return &CardSpecificationByToken{
+		token: token,
+	}
+}
+
 func NewCardSpecificationWithLimitAndOffset(limit int, offset int) CardSpecification {
 	return &CardSpecificationWithLimitAndOffset{
 		limit:  limit,
@@ -260,7 +327,7 @@ func (cs *HttpClientCardStore) maskParams(data string) string {
 }
 
 func (cs *HttpClientCardStore) makeRequest(
-	ctx interface{},
+	ctx context.Context,
 	method string,
 	uri string,
 	contentType string,
@@ -269,7 +336,7 @@ func (cs *HttpClientCardStore) makeRequest(
 	url := fmt.Sprintf("%s/%s", cs.url, uri)
 	cs.logger(ctx).Printf("Requesting: %s", cs.maskParams(url))
 	cs.logger(ctx).Printf("Params: %s", cs.maskParams(data))
-	r, err := http.NewRequest(method, url, strings.NewReader(data))
+	r, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(data))
 	if err != nil {
 		return fmt.Errorf("can not make new request: %v", err), nil, nil
 	}
@@ -279,7 +346,7 @@ func (cs *HttpClientCardStore) makeRequest(
 
 	res, err := cs.client.Do(r)
 	if err != nil {
-		return fmt.Errorf("can not do request: %v", err), nil, nil
+		return fmt.Errorf("can not do request: %w", NewRepositoryError(ErrUnavailable, err)), nil, nil
 	}
 	defer res.Body.Close()
 
@@ -290,6 +357,10 @@ func (cs *HttpClientCardStore) makeRequest(
 
 	cs.logger(ctx).Printf("response body: %s", cs.maskParams(string(body)))
 
+	if err := httpStatusError(res.StatusCode); err != nil {
+		return fmt.Errorf("request failed: %w", err), nil, &res.StatusCode
+	}
+
 	var jsonResp map[string]interface{}
 	if err := json.Unmarshal(body, &jsonResp); err != nil {
 		return fmt.Errorf("can not unmarshal body: %v", err), nil, nil
@@ -298,13 +369,20 @@ func (cs *HttpClientCardStore) makeRequest(
 	return nil, &jsonResp, &res.StatusCode
 }
 
-func (cs *HttpClientCardStore) Add(ctx interface{}, card *Card) error {
+func (cs *HttpClientCardStore) Add(ctx context.Context, card *Card) error {
+	if err := ValidateCard(card, time.Now()); err != nil {
+		return err
+	}
+
 	pan := *card.PAN
 	expire := *card.ExpDate
 	var qwr = map[string]string{
 		"pan": string(pan),
 		"exp_date": expire.Format(EXPIRE_DATE_FORMAT),
-		"holder": *card.Holder,
+	}
+
+	if card.Holder != nil {
+		qwr["holder"] = *card.Holder
 	}
 
 	jsonbody, err := json.Marshal(qwr)
@@ -314,7 +392,7 @@ func (cs *HttpClientCardStore) Add(ctx interface{}, card *Card) error {
 
 	err, jsonResp, _ := cs.makeRequest(ctx, "POST", "v1/cards", "application/json; charset=utf-8", string(jsonbody))
 	if err != nil {
-		return fmt.Errorf("can not make add card request: %v", err)
+		return fmt.Errorf("can not make add card request: %w", err)
 	}
 
 	jsonbody, err = json.Marshal(jsonResp)
@@ -330,31 +408,93 @@ func (cs *HttpClientCardStore) Add(ctx interface{}, card *Card) error {
 	return nil
 }
 
-func (cs *HttpClientCardStore) Delete(ctx interface{}, card *Card) (error, bool) {
-	err, jsonResp, status := cs.makeRequest(ctx,
+func (cs *HttpClientCardStore) Delete(ctx context.Context, card *Card) error {
+	err, jsonResp, _ := cs.makeRequest(ctx,
 		"DELETE",
 		fmt.Sprintf("v1/cards/%d", *card.Id),
 		"application/x-www-form-urlencoded", "")
 
 	if err != nil {
-		return fmt.Errorf("cat not make delete card request: %v", err), true
+		return fmt.Errorf("can not make delete card request: %w", err)
 	}
 
-	if *status != 200 {
-		return fmt.Errorf("failed to make delete card request. Http status: %d", *status), true
+	jsonbody, err := json.Marshal(jsonResp)
+	if err != nil {
+		return fmt.Errorf("can not marshal delete card json response: %v", err)
 	}
 
-	jsonbody, err := json.Marshal(jsonResp)
+	d := json.NewDecoder(bytes.NewReader(jsonbody))
+	if err := d.Decode(card); err != nil {
+		return fmt.Errorf("can not decode delete card json body response: %v", err)
+	}
+
+	return nil
+}
+
+// Update sends only the expiry date and the holder, the remote store keeps
+// the token and the PAN. A PAN set on the card is checked against the
+// stored one first, so a changed PAN is rejected as by the other stores.
+func (cs *HttpClientCardStore) Update(ctx context.Context, card *Card) error {
+	if err := ValidateCardUpdate(card, time.Now()); err != nil {
+		return err
+	}
+
+	if card.PAN != nil {
+		err, jsonResp, _ := cs.makeRequest(ctx,
+			"GET",
+			fmt.Sprintf("v1/cards/%d", *card.Id),
+			"application/x-www-form-urlencoded", "")
+
+		if err != nil {
+			return fmt.Errorf("can not make get card request: %w", err)
+		}
+
+		var l []*Card
+		if err := cs.appendToList(&l, jsonResp); err != nil {
+			return fmt.Errorf("can not append to list: %v", err)
+		}
+
+		if l[0].PAN == nil || *l[0].PAN != *card.PAN {
+			return fmt.Errorf("pan of card with id=%v can not be changed: %w", *card.Id, ErrValidation)
+		}
+	}
+
+	var qwr = map[string]string{}
+
+	if card.ExpDate != nil {
+		expire := *card.ExpDate
+		qwr["exp_date"] = expire.Format(EXPIRE_DATE_FORMAT)
+	}
+
+	if card.Holder != nil {
+		qwr["holder"] = *card.Holder
+	}
+
+	jsonbody, err := json.Marshal(qwr)
+	if err != nil {
+		return fmt.Errorf("can not marshal update card request body: %v", err)
+	}
+
+	err, jsonResp, _ := cs.makeRequest(ctx,
+		"PATCH",
+		fmt.Sprintf("v1/cards/%d", *card.Id),
+		"application/json; charset=utf-8", string(jsonbody))
+
 	if err != nil {
-		return fmt.Errorf("can not marshal delete card json response: %v", err), true
+		return fmt.Errorf("can not make update card request: %w", err)
+	}
+
+	jsonbody, err = json.Marshal(jsonResp)
+	if err != nil {
+		return fmt.Errorf("can not marshal update card json response: %v", err)
 	}
 
 	d := json.NewDecoder(bytes.NewReader(jsonbody))
 	if err := d.Decode(card); err != nil {
-		return fmt.Errorf("can not decode delete card json body response: %v", err), true
+		return fmt.Errorf("can not decode update card json body response: %v", err)
 	}
 
-	return nil, false
+	return nil
 }
 
 func (cs *HttpClientCardStore) appendToList (l *[]*Card, data *map[string]interface{}) error {
@@ -373,7 +513,7 @@ func (cs *HttpClientCardStore) appendToList (l *[]*Card, data *map[string]interf
 	return nil
 }
 
-func (cs *HttpClientCardStore) Query(ctx interface{}, specification CardSpecification) (error, int, []*Card) {
+func (cs *HttpClientCardStore) Query(ctx context.Context, specification CardSpecification) (error, int, []*Card) {
 	var l []*Card
 	var c int = 0
 
@@ -381,12 +521,20 @@ func (cs *HttpClientCardStore) Query(ctx interface{}, specification CardSpecific
 		"v1/cards%s",
 		specification.ToQwrStr()),
 	"application/x-www-form-urlencoded", "")
+	if errors.Is(err, ErrNotFound) {
+		return nil, c, l
+	}
+
 	if err != nil {
-		return fmt.Errorf("can not make query card request: %v", err), c, l
+		return fmt.Errorf("can not make query card request: %w", err), c, l
 	}
 
 	if data, ok := (*jsonResp)["data"]; ok {
 		if rows, ok := data.([]interface{}); ok {
+			c = len(rows)
+			if total, ok := (*jsonResp)["total"].(float64); ok {
+				c = int(total)
+			}
 			for _, row := range rows {
 				if r, ok := row.(map[string]interface{}); ok {
 					if err := cs.appendToList(&l, &r); err != nil {
@@ -403,6 +551,7 @@ func (cs *HttpClientCardStore) Query(ctx interface{}, specification CardSpecific
 		if err := cs.appendToList(&l, jsonResp); err != nil {
 			return fmt.Errorf("can not append to list: %v", err), c, l
 		}
+		c = 1
 	}
 
 	return nil, c, l
@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"time"
+	"errors"
+	"context"
+	"net/url"
+	"testing"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+	"net/http/httptest"
+)
+
+func TestCardQueryStringIsEscaped(t *testing.T) {
+	for _, tc := range []struct {
+		spec  CardSpecification
+		key   string
+		value string
+	}{
+		{NewCardSpecificationByToken("a&limit=1000&offset=0"), "token", "a&limit=1000&offset=0"},
+		{NewCardSpecificationByToken("a b+c#d%e"), "token", "a b+c#d%e"},
+		{NewCardSpecificationByPAN("4111&pan=5555"), "pan", "4111&pan=5555"},
+	} {
+		qwr := tc.spec.ToQwrStr()
+
+		values, err := url.ParseQuery(qwr[1:])
+		if err != nil {
+			t.Fatalf("can not parse %q: %v", qwr, err)
+		}
+
+		if len(values[tc.key]) != 1 || values.Get(tc.key) != tc.value {
+			t.Errorf("%q has %s=%v, want %q", qwr, tc.key, values[tc.key], tc.value)
+		}
+
+		if len(values["limit"]) != 1 || values.Get("limit") != "1" {
+			t.Errorf("%q has limit=%v, want 1", qwr, values["limit"])
+		}
+	}
+}
+
+type cardRequest struct {
+	method string
+	path   string
+	body   map[string]string
+}
+
+// cardServer answers every request with the card and records what it got.
+func cardServer(t *testing.T, card string) (*httptest.Server, *[]cardRequest) {
+	t.Helper()
+
+	var requests []cardRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := cardRequest{method: r.Method, path: r.URL.Path}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &request.body); err != nil {
+				t.Errorf("can not unmarshal request body %q: %v", body, err)
+			}
+		}
+
+		requests = append(requests, request)
+		w.Write([]byte(card))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func TestHttpClientAddCardWithoutHolder(t *testing.T) {
+	server, requests := cardServer(t, `{"id":1,"token":"token","pan":"4111111111111111","exp_date":"30/12"}`)
+	store := NewHttpClientCardStore(server.URL, server.Client(), testLogger)
+
+	pan := PAN("4111111111111111")
+	card := &Card{
+		PAN:     &pan,
+		ExpDate: &ExpDate{time.Now().AddDate(2, 0, 0)},
+	}
+
+	if err := store.Add(context.Background(), card); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+
+	if len(*requests) != 1 {
+		t.Fatalf("made %d requests, want 1", len(*requests))
+	}
+
+	if holder, ok := (*requests)[0].body["holder"]; ok {
+		t.Errorf("request has holder %q, want none", holder)
+	}
+
+	if card.Id == nil || *card.Id != 1 {
+		t.Errorf("card id = %v, want 1", card.Id)
+	}
+}
+
+func TestHttpClientUpdateCardRejectsPANChange(t *testing.T) {
+	server, requests := cardServer(t, `{"id":1,"token":"token","pan":"4111111111111111","exp_date":"30/12"}`)
+	store := NewHttpClientCardStore(server.URL, server.Client(), testLogger)
+
+	id := 1
+	pan := PAN("5555555555554444")
+	card := &Card{Id: &id, PAN: &pan}
+
+	if err := store.Update(context.Background(), card); !errors.Is(err, ErrValidation) {
+		t.Fatalf("update with another pan = %v, want validation error", err)
+	}
+
+	for _, request := range *requests {
+		if request.method != "GET" {
+			t.Errorf("rejected update made a %s request", request.method)
+		}
+	}
+
+	pan = PAN("4111111111111111")
+	holder := "john doe"
+	card = &Card{Id: &id, PAN: &pan, Holder: &holder}
+
+	if err := store.Update(context.Background(), card); err != nil {
+		t.Fatalf("update with the same pan failed: %v", err)
+	}
+
+	last := (*requests)[len(*requests)-1]
+	if last.method != "PATCH" || last.path != "/v1/cards/1" || last.body["holder"] != "JOHN DOE" {
+		t.Errorf("last request = %+v, want a patch of the holder", last)
+	}
+
+	if _, ok := last.body["pan"]; ok {
+		t.Errorf("patch sends the pan")
+	}
+}
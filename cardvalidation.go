@@ -0,0 +1,227 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+	"strings"
+)
+
+// CardFieldError tells what is wrong with one field of a card.
+type CardFieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// CardValidationError lists the invalid fields of a card. It matches
+// ErrValidation with errors.Is.
+type CardValidationError struct {
+	Fields []*CardFieldError `json:"fields"`
+}
+
+func (e *CardValidationError) Error() string {
+	var l []string
+	for _, field := range e.Fields {
+		l = append(l, fmt.Sprintf("%s: %s", field.Field, field.Message))
+	}
+	return fmt.Sprintf("invalid card: %s", strings.Join(l, "; "))
+}
+
+func (e *CardValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+func (e *CardValidationError) add(field string, format string, args ...interface{}) {
+	e.Fields = append(e.Fields, &CardFieldError{
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+type cardBrandRule struct {
+	brand   string
+	ranges  [][2]int
+	lengths []int
+}
+
+// cardBrandRules are checked in order, prefixes of the ranges have the
+// digits count of the range bounds.
+var cardBrandRules = []cardBrandRule{
+	{"American Express", [][2]int{{34, 34}, {37, 37}}, []int{15}},
+	{"Diners Club", [][2]int{{300, 305}, {36, 36}, {38, 39}}, []int{14, 15, 16, 17, 18, 19}},
+	{"JCB", [][2]int{{3528, 3589}}, []int{16, 17, 18, 19}},
+	{"Mir", [][2]int{{2200, 2204}}, []int{16, 17, 18, 19}},
+	{"MasterCard", [][2]int{{51, 55}, {2221, 2720}}, []int{16}},
+	{"Visa", [][2]int{{4, 4}}, []int{13, 16, 19}},
+	{"Discover", [][2]int{{6011, 6011}, {644, 649}, {65, 65}, {622126, 622925}}, []int{16, 17, 18, 19}},
+	{"UnionPay", [][2]int{{62, 62}}, []int{16, 17, 18, 19}},
+	{"Maestro", [][2]int{{50, 50}, {56, 69}}, []int{12, 13, 14, 15, 16, 17, 18, 19}},
+}
+
+const (
+	minPANLength       = 12
+	maxPANLength       = 19
+	maxHolderLength    = 26
+	maxExpirationYears = 20
+)
+
+func panPrefix(pan string, digits int) int {
+	prefix := 0
+	for i := 0; i < digits && i < len(pan); i++ {
+		prefix = prefix*10 + int(pan[i]-'0')
+	}
+	return prefix
+}
+
+func cardBrand(pan string) *cardBrandRule {
+	for i, rule := range cardBrandRules {
+		for _, r := range rule.ranges {
+			digits := len(fmt.Sprint(r[0]))
+			if len(pan) < digits {
+				continue
+			}
+			if prefix := panPrefix(pan, digits); prefix >= r[0] && prefix <= r[1] {
+				return &cardBrandRules[i]
+			}
+		}
+	}
+	return nil
+}
+
+func luhnValid(pan string) bool {
+	sum := 0
+	double := false
+	for i := len(pan) - 1; i >= 0; i-- {
+		d := int(pan[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+func validatePAN(e *CardValidationError, pan PAN) {
+	s := string(pan)
+
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			e.add("pan", "must contain digits only")
+			return
+		}
+	}
+
+	if len(s) < minPANLength || len(s) > maxPANLength {
+		e.add("pan", "must have %d to %d digits", minPANLength, maxPANLength)
+		return
+	}
+
+	if rule := cardBrand(s); rule != nil {
+		valid := false
+		for _, length := range rule.lengths {
+			valid = valid || length == len(s)
+		}
+		if !valid {
+			e.add("pan", "%s card can not have %d digits", rule.brand, len(s))
+			return
+		}
+	}
+
+	if !luhnValid(s) {
+		e.add("pan", "checksum is wrong")
+	}
+}
+
+// validateExpDate checks that the card is not expired at now. An "06/01"
+// expiry date is the first day of the month, the card is valid through the
+// last day of that month.
+func validateExpDate(e *CardValidationError, expDate *ExpDate, now time.Time) {
+	year, month, _ := expDate.Date()
+	expires := time.Date(year, month+1, 1, 0, 0, 0, 0, time.UTC)
+
+	if !now.Before(expires) {
+		e.add("exp_date", "card expired")
+		return
+	}
+
+	if expires.After(now.AddDate(maxExpirationYears, 0, 0)) {
+		e.add("exp_date", "is more than %d years ahead", maxExpirationYears)
+	}
+}
+
+// normalizeHolder upper cases the holder name and collapses the spaces. The
+// name has to fit the card track, so only latin letters, spaces, dots,
+// hyphens and apostrophes are allowed.
+func normalizeHolder(e *CardValidationError, holder string) string {
+	normalized := strings.ToUpper(strings.Join(strings.Fields(holder), " "))
+
+	if normalized == "" {
+		e.add("holder", "is empty")
+		return normalized
+	}
+
+	for _, r := range normalized {
+		if !(r >= 'A' && r <= 'Z') && r != ' ' && !strings.ContainsRune(".-'", r) {
+			e.add("holder", "contains %q, only latin letters, spaces, dots, hyphens and apostrophes are allowed", r)
+			return normalized
+		}
+	}
+
+	if len(normalized) > maxHolderLength {
+		e.add("holder", "must not be longer than %d characters", maxHolderLength)
+	}
+
+	return normalized
+}
+
+func (e *CardValidationError) err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// ValidateCard checks a card before it is stored and normalizes its holder.
+// PAN and expiry date are required, the holder is optional.
+func ValidateCard(card *Card, now time.Time) error {
+	e := &CardValidationError{}
+
+	if card.PAN == nil {
+		e.add("pan", "is required")
+	} else {
+		validatePAN(e, *card.PAN)
+	}
+
+	if card.ExpDate == nil {
+		e.add("exp_date", "is required")
+	} else {
+		validateExpDate(e, card.ExpDate, now)
+	}
+
+	if card.Holder != nil {
+		holder := normalizeHolder(e, *card.Holder)
+		card.Holder = &holder
+	}
+
+	return e.err()
+}
+
+// ValidateCardUpdate checks the fields an update may change, the ones left
+// empty are kept and not checked.
+func ValidateCardUpdate(card *Card, now time.Time) error {
+	e := &CardValidationError{}
+
+	if card.ExpDate != nil {
+		validateExpDate(e, card.ExpDate, now)
+	}
+
+	if card.Holder != nil {
+		holder := normalizeHolder(e, *card.Holder)
+		card.Holder = &holder
+	}
+
+	return e.err()
+}
@@ -0,0 +1,227 @@
+package repository
+
+import (
+	"time"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// luhnPAN pads prefix with zeros to length digits and sets the check digit.
+func luhnPAN(prefix string, length int) PAN {
+	pan := prefix + strings.Repeat("0", length-len(prefix)-1)
+	for d := '0'; d <= '9'; d++ {
+		if luhnValid(pan + string(d)) {
+			return PAN(pan + string(d))
+		}
+	}
+	return ""
+}
+
+func panErrors(pan PAN) []string {
+	e := &CardValidationError{}
+	validatePAN(e, pan)
+
+	var l []string
+	for _, field := range e.Fields {
+		l = append(l, field.Message)
+	}
+	return l
+}
+
+func TestLuhn(t *testing.T) {
+	cases := map[string]bool{
+		"4111111111111111": true,
+		"4111111111111112": false,
+		"5555555555554444": true,
+		"79927398713":      true,
+		"79927398710":      false,
+		"0":                true,
+	}
+
+	for pan, want := range cases {
+		if got := luhnValid(pan); got != want {
+			t.Errorf("luhnValid(%s) = %v, want %v", pan, got, want)
+		}
+	}
+
+	if l := panErrors("4111111111111112"); len(l) != 1 || l[0] != "checksum is wrong" {
+		t.Errorf("bad checksum: got %v", l)
+	}
+}
+
+func TestCardBrandLengths(t *testing.T) {
+	cases := []struct {
+		prefix string
+		length int
+		brand  string
+		valid  bool
+	}{
+		{"4", 13, "Visa", true},
+		{"4", 16, "Visa", true},
+		{"4", 19, "Visa", true},
+		{"4", 15, "Visa", false},
+		{"34", 15, "American Express", true},
+		{"37", 16, "American Express", false},
+		{"300", 14, "Diners Club", true},
+		{"36", 13, "Diners Club", false},
+		{"3528", 16, "JCB", true},
+		{"3589", 15, "JCB", false},
+		{"2200", 16, "Mir", true},
+		{"2204", 15, "Mir", false},
+		{"51", 16, "MasterCard", true},
+		{"2221", 16, "MasterCard", true},
+		{"2720", 16, "MasterCard", true},
+		{"55", 19, "MasterCard", false},
+		{"2721", 16, "", true},
+		// Discover ranges inside the UnionPay and Maestro ones win
+		{"6011", 16, "Discover", true},
+		{"6011", 12, "Discover", false},
+		{"644", 19, "Discover", true},
+		{"65", 16, "Discover", true},
+		{"65", 13, "Discover", false},
+		{"622126", 16, "Discover", true},
+		{"622925", 16, "Discover", true},
+		{"622125", 16, "UnionPay", true},
+		{"622926", 16, "UnionPay", true},
+		{"62", 12, "UnionPay", false},
+		{"643", 12, "Maestro", true},
+		{"6010", 13, "Maestro", true},
+		{"50", 12, "Maestro", true},
+		{"56", 19, "Maestro", true},
+	}
+
+	for _, c := range cases {
+		pan := luhnPAN(c.prefix, c.length)
+
+		brand := ""
+		if rule := cardBrand(string(pan)); rule != nil {
+			brand = rule.brand
+		}
+
+		if brand != c.brand {
+			t.Errorf("%s: brand %q, want %q", pan, brand, c.brand)
+		}
+
+		if l := panErrors(pan); (len(l) == 0) != c.valid {
+			t.Errorf("%s: errors %v, want valid=%v", pan, l, c.valid)
+		}
+	}
+}
+
+func TestPANFormat(t *testing.T) {
+	cases := map[PAN]string{
+		"4111 1111 1111 1111":  "must contain digits only",
+		"4111-1111-1111-1111":  "must contain digits only",
+		"41111111111":          "must have 12 to 19 digits",
+		"41111111111111111111": "must have 12 to 19 digits",
+	}
+
+	for pan, want := range cases {
+		if l := panErrors(pan); len(l) != 1 || l[0] != want {
+			t.Errorf("%q: got %v, want %q", pan, l, want)
+		}
+	}
+}
+
+func TestExpDateEndOfMonth(t *testing.T) {
+	june := &ExpDate{time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)}
+
+	cases := []struct {
+		name string
+		now  time.Time
+		err  string
+	}{
+		{"first day", time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC), ""},
+		{"last instant", time.Date(2024, time.June, 30, 23, 59, 59, 999999999, time.UTC), ""},
+		{"next month", time.Date(2024, time.July, 1, 0, 0, 0, 0, time.UTC), "card expired"},
+		{"year before", time.Date(2023, time.June, 15, 0, 0, 0, 0, time.UTC), ""},
+		{"too far ahead", time.Date(2004, time.June, 30, 0, 0, 0, 0, time.UTC), "is more than 20 years ahead"},
+		{"just within", time.Date(2004, time.July, 1, 0, 0, 0, 0, time.UTC), ""},
+	}
+
+	for _, c := range cases {
+		e := &CardValidationError{}
+		validateExpDate(e, june, c.now)
+
+		got := ""
+		if len(e.Fields) > 0 {
+			got = e.Fields[0].Message
+		}
+
+		if got != c.err {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.err)
+		}
+	}
+
+	// December rolls over into January of the next year
+	december := &ExpDate{time.Date(2024, time.December, 1, 0, 0, 0, 0, time.UTC)}
+	e := &CardValidationError{}
+	validateExpDate(e, december, time.Date(2024, time.December, 31, 12, 0, 0, 0, time.UTC))
+	if len(e.Fields) != 0 {
+		t.Errorf("december: got %v", e.Fields)
+	}
+}
+
+func TestNormalizeHolder(t *testing.T) {
+	cases := []struct {
+		holder string
+		want   string
+		err    string
+	}{
+		{"john doe", "JOHN DOE", ""},
+		{"  John   O'Neil-Smith  Jr. ", "JOHN O'NEIL-SMITH JR.", ""},
+		{"\tjane\ndoe", "JANE DOE", ""},
+		{"", "", "is empty"},
+		{"   ", "", "is empty"},
+		{"Jöhn Doe", "JÖHN DOE", `contains 'Ö', only latin letters, spaces, dots, hyphens and apostrophes are allowed`},
+		{"John Doe 2", "JOHN DOE 2", `contains '2', only latin letters, spaces, dots, hyphens and apostrophes are allowed`},
+		{strings.Repeat("A", 26), strings.Repeat("A", 26), ""},
+		{strings.Repeat("A", 27), strings.Repeat("A", 27), "must not be longer than 26 characters"},
+	}
+
+	for _, c := range cases {
+		e := &CardValidationError{}
+		got := normalizeHolder(e, c.holder)
+
+		msg := ""
+		if len(e.Fields) > 0 {
+			msg = e.Fields[0].Message
+		}
+
+		if got != c.want || msg != c.err {
+			t.Errorf("%q: got %q %q, want %q %q", c.holder, got, msg, c.want, c.err)
+		}
+	}
+}
+
+func TestValidateCard(t *testing.T) {
+	now := time.Date(2024, time.June, 15, 0, 0, 0, 0, time.UTC)
+
+	err := ValidateCard(&Card{}, now)
+	if !errors.Is(err, ErrValidation) {
+		t.Fatalf("empty card: got %v, want validation error", err)
+	}
+
+	var e *CardValidationError
+	if !errors.As(err, &e) || len(e.Fields) != 2 || e.Fields[0].Field != "pan" || e.Fields[1].Field != "exp_date" {
+		t.Errorf("empty card: got %v", err)
+	}
+
+	pan := PAN("4111111111111111")
+	holder := " jane  doe "
+	card := &Card{PAN: &pan, ExpDate: &ExpDate{now}, Holder: &holder}
+
+	if err := ValidateCard(card, now); err != nil || *card.Holder != "JANE DOE" {
+		t.Errorf("valid card: holder %q, %v", *card.Holder, err)
+	}
+
+	card.Holder = nil
+	if err := ValidateCard(card, now); err != nil {
+		t.Errorf("card without holder: %v", err)
+	}
+
+	if err := ValidateCardUpdate(&Card{}, now); err != nil {
+		t.Errorf("empty update: %v", err)
+	}
+}
@@ -3,7 +3,6 @@ package repository
 import (
 	"fmt"
 	"context"
-	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
@@ -18,20 +17,20 @@ func (c *Channel) String() string {
 }
 
 type ChannelSpecification interface {
-	ToSqlClauses() string
+	ToSqlClauses() *SqlClauses
 }
 
 type ChannelRepository interface {
-	Add(ctx interface{}, channel *Channel) error
-	Delete(ctx interface{}, channel *Channel) (error, bool)
-	Update(ctx interface{}, channel *Channel) (error, bool)
-	Query(ctx interface{}, specification ChannelSpecification) (error, int, []*Channel)
+	Add(ctx context.Context, channel *Channel) error
+	Delete(ctx context.Context, channel *Channel) error
+	Update(ctx context.Context, channel *Channel) error
+	Query(ctx context.Context, specification ChannelSpecification) (error, int, []*Channel)
 }
 
 type ChannelWithoutSpecification struct {}
 
-func (cws *ChannelWithoutSpecification) ToSqlClauses() string {
-	return ""
+func (cws *ChannelWithoutSpecification) ToSqlClauses() *SqlClauses {
+	return &SqlClauses{}
 }
 
 type ChannelSpecificationWithLimitAndOffset struct {
@@ -39,38 +38,50 @@ type ChannelSpecificationWithLimitAndOffset struct {
 	offset int
 }
 
-func (cswlao *ChannelSpecificationWithLimitAndOffset) ToSqlClauses() string {
-	return fmt.Sprintf("limit %d offset %d", cswlao.limit, cswlao.offset)
+func (cswlao *ChannelSpecificationWithLimitAndOffset) ToSqlClauses() *SqlClauses {
+	return NewSqlLimitAndOffsetClauses(cswlao.limit, cswlao.offset)
 }
 
 type ChannelSpecificationByID struct {
 	id int
 }
 
-func (csbyid *ChannelSpecificationByID) ToSqlClauses() string {
-	return fmt.Sprintf("where id=%d", csbyid.id)
+func (csbyid *ChannelSpecificationByID) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=?", csbyid.id)
+}
+
+type ChannelSpecificationByIDs struct {
+	ids []int
+}
+
+func (csbyids *ChannelSpecificationByIDs) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=any(?)", csbyids.ids)
 }
 
 type ChannelSpecificationByTypeID struct {
 	typeId int
 }
 
-func (csbyti *ChannelSpecificationByTypeID) ToSqlClauses() string {
-	return fmt.Sprintf("where type_id=%d", csbyti.typeId)
+func (csbyti *ChannelSpecificationByTypeID) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("type_id=?", csbyti.typeId)
 }
 
 type ChannelSpecificationByKey struct {
 	key string
 }
 
-func (csbyk *ChannelSpecificationByKey) ToSqlClauses() string {
-	return fmt.Sprintf("where key='%s'", csbyk.key)
+func (csbyk *ChannelSpecificationByKey) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("key=?", csbyk.key)
 }
 
 func NewChannelSpecificationByID(id int) ChannelSpecification {
 	return &ChannelSpecificationByID{id: id}
 }
 
+func NewChannelSpecificationByIDs(ids []int) ChannelSpecification {
+	return &ChannelSpecificationByIDs{ids: ids}
+}
+
 func NewChannelSpecificationByTypeID(typeId int) ChannelSpecification {
 	return &ChannelSpecificationByTypeID{
 		typeId: typeId,
@@ -94,26 +105,82 @@ func NewChannelWithoutSpecification() ChannelSpecification {
 	return &ChannelWithoutSpecification{}
 }
 
+func NewChannelSpecificationAnd(specs ...ChannelSpecification) ChannelSpecification {
+	l := make([]SqlSpecification, 0, len(specs))
+	for _, spec := range specs {
+		l = append(l, spec)
+	}
+	return &SqlSpecificationAnd{specs: l}
+}
+
+func NewChannelSpecificationOr(specs ...ChannelSpecification) ChannelSpecification {
+	l := make([]SqlSpecification, 0, len(specs))
+	for _, spec := range specs {
+		l = append(l, spec)
+	}
+	return &SqlSpecificationOr{specs: l}
+}
+
+func NewChannelSpecificationNot(spec ChannelSpecification) ChannelSpecification {
+	return &SqlSpecificationNot{spec: spec}
+}
+
+var channelOrderColumns = []string{"id", "type_id", "key"}
+
+func NewChannelSpecificationOrderBy(spec ChannelSpecification, column string, desc bool) ChannelSpecification {
+	return &SqlSpecificationOrderBy{
+		spec:   spec,
+		column: column,
+		desc:   desc,
+	}
+}
+
+func NewChannelSpecificationPaged(spec ChannelSpecification, limit int, offset int) ChannelSpecification {
+	return &SqlSpecificationPaged{
+		spec:   spec,
+		limit:  limit,
+		offset: offset,
+	}
+}
+
+func channelsByIds(ctx context.Context, store ChannelRepository, ids idSet) (error, map[int]*Channel) {
+	m := make(map[int]*Channel)
+	if len(ids) == 0 {
+		return nil, m
+	}
+
+	err, _, channels := store.Query(ctx, NewChannelSpecificationByIDs(ids.slice()))
+	if err != nil {
+		return err, m
+	}
+
+	for _, channel := range channels {
+		m[*channel.Id] = channel
+	}
+
+	return nil, m
+}
+
 type PGPoolChannelStore struct {
 	pool   *pgxpool.Pool
 	logger LoggerFunc
 }
 
-func (cs *PGPoolChannelStore) Add(ctx interface{}, channel *Channel) error {
-	_, err := cs.pool.Exec(
-		context.Background(),
+func (cs *PGPoolChannelStore) Add(ctx context.Context, channel *Channel) error {
+	_, err := pgQuerierFromContext(ctx, cs.pool).Exec(
+		ctx,
 		"insert into channels (id, type_id, key) values ($1, $2, $3)",
 		channel.Id,
 		channel.TypeId,
 		channel.Key,
 	)
 
-	return err
+	return mapPgError(err)
 }
 
-func (cs *PGPoolChannelStore) Delete(ctx interface{}, channel *Channel) (error, bool) {
-	err := cs.pool.QueryRow(
-		context.Background(),
+func (cs *PGPoolChannelStore) Delete(ctx context.Context, channel *Channel) error {
+	err := pgQuerierFromContext(ctx, cs.pool).QueryRow(
+		ctx,
 		"delete from channels where id=$1 returning type_id, key",
 		channel.Id,
 	).Scan(
@@ -121,38 +188,31 @@ func (cs *PGPoolChannelStore) Delete(ctx interface{}, channel *Channel) (error,
 		&channel.Key,
 	)
 
-	return err, err == pgx.ErrNoRows
+	return mapPgError(err)
 }
 
-func (cs *PGPoolChannelStore) Query(ctx interface{}, specification ChannelSpecification) (error, int, []*Channel) {
+func (cs *PGPoolChannelStore) Query(ctx context.Context, specification ChannelSpecification) (error, int, []*Channel) {
 	var l []*Channel
 	var c int = 0
 
-	conn, err := cs.pool.Acquire(context.Background())
-
-	if err != nil {
-		return fmt.Errorf("failed to acquire connection from the pool: %v", err), c, l
+	conn := pgQuerierFromContext(ctx, cs.pool)
+	sqlClauses := specification.ToSqlClauses()
+	if err := sqlClauses.checkOrderBy(channelOrderColumns...); err != nil {
+		return err, c, l
 	}
-	defer conn.Release()
-
-	err = conn.QueryRow(
-		context.Background(),
-		"select count(*) from channels",
-	).Scan(&c)
 
-	if err != nil {
-		return fmt.Errorf("failed to get channels cnt: %v", err), c, l
-	}
+	clauses, args := sqlClauses.Build()
 
 	rows, err := conn.Query(
-		context.Background(), fmt.Sprintf(
-			"select id, type_id, key from channels %s",
-			specification.ToSqlClauses(),
+		ctx, fmt.Sprintf(
+			"select count(*) over(), id, type_id, key from channels %s",
+			clauses,
 		),
+		args...,
 	)
 
 	if err != nil {
-		return fmt.Errorf("failed to query channels rows: %v", err), c, l
+		return fmt.Errorf("failed to query channels rows: %w", mapPgError(err)), c, l
 	}
 	defer rows.Close()
 
@@ -160,25 +220,40 @@ func (cs *PGPoolChannelStore) Query(ctx interface{}, specification ChannelSpecif
 		var channel Channel
 
 		if err = rows.Scan(
+			&c,
 			&channel.Id,
 			&channel.TypeId,
 			&channel.Key,
 		); err != nil {
-			return fmt.Errorf("failed to get channel row: %v", err), c, l
+			return fmt.Errorf("failed to get channel row: %w", mapPgError(err)), c, l
 		}
 		l = append(l, &channel)
 	}
 
 	if err = rows.Err(); err != nil {
-		return fmt.Errorf("failed to iterating over rows of channels: %v", err), c, l
+		return fmt.Errorf("failed to iterating over rows of channels: %w", mapPgError(err)), c, l
+	}
+
+	if len(l) == 0 && sqlClauses.Offset != nil && *sqlClauses.Offset > 0 {
+		filter, filterArgs := sqlClauses.Filter().Build()
+
+		err = conn.QueryRow(
+			ctx,
+			fmt.Sprintf("select count(*) from channels %s", filter),
+			filterArgs...,
+		).Scan(&c)
+
+		if err != nil {
+			return fmt.Errorf("failed to get channels cnt: %w", mapPgError(err)), c, l
+		}
 	}
 
 	return nil, c, l
 }
 
-func (cs *PGPoolChannelStore) Update(ctx interface{}, channel *Channel) (error, bool) {
-	err := cs.pool.QueryRow(
-		context.Background(),
+func (cs *PGPoolChannelStore) Update(ctx context.Context, channel *Channel) error {
+	err := pgQuerierFromContext(ctx, cs.pool).QueryRow(
+		ctx,
 		`update channels set
 			type_id=COALESCE($2, type_id),
 			key=COALESCE($3, key)
@@ -191,7 +266,7 @@ func (cs *PGPoolChannelStore) Update(ctx interface{}, channel *Channel) (error,
 		&channel.Key,
 	)
 
-	return err, err == pgx.ErrNoRows
+	return mapPgError(err)
 }
 
 func NewPGPoolChannelStore(pool *pgxpool.Pool, logger LoggerFunc) ChannelRepository {
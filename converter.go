@@ -0,0 +1,180 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"math/big"
+)
+
+type RoundingMode int
+
+const (
+	RoundHalfUp RoundingMode = iota
+	RoundHalfEven
+	RoundDown
+	RoundUp
+)
+
+type CurrencyConverter struct {
+	rates    RateRepository
+	base     *Currency
+	rounding RoundingMode
+	maxAge   time.Duration
+	logger   LoggerFunc
+}
+
+func sameCurrency(a *Currency, b *Currency) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Id != nil && b.Id != nil {
+		return *a.Id == *b.Id
+	}
+	return a == b
+}
+
+func pow10(exp int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil)
+}
+
+func roundRat(r *big.Rat, mode RoundingMode) *big.Int {
+	q, m := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if m.Sign() == 0 {
+		return q
+	}
+
+	half := new(big.Int).Mul(m, big.NewInt(2)).Cmp(r.Denom())
+
+	switch mode {
+	case RoundUp:
+		return q.Add(q, big.NewInt(1))
+	case RoundHalfUp:
+		if half >= 0 {
+			return q.Add(q, big.NewInt(1))
+		}
+	case RoundHalfEven:
+		if half > 0 || (half == 0 && q.Bit(0) == 1) {
+			return q.Add(q, big.NewInt(1))
+		}
+	}
+
+	return q
+}
+
+// ConvertMoney converts m into the to currency using the decimal rate
+// value. Both currencies must carry their Exponent.
+func ConvertMoney(m Money, to *Currency, value string, mode RoundingMode) (error, Money) {
+	if m.Currency == nil || m.Currency.Exponent == nil || to == nil || to.Exponent == nil {
+		return fmt.Errorf("currency exponent is unknown: %w", ErrValidation), m
+	}
+
+	rate, ok := new(big.Rat).SetString(value)
+	if !ok || rate.Sign() <= 0 {
+		return fmt.Errorf("invalid rate value %q: %w", value, ErrValidation), m
+	}
+
+	r := new(big.Rat).SetInt(new(big.Int).SetUint64(uint64(m.Amount)))
+	r.Mul(r, rate)
+	r.Mul(r, new(big.Rat).SetInt(pow10(*to.Exponent)))
+	r.Quo(r, new(big.Rat).SetInt(pow10(*m.Currency.Exponent)))
+
+	converted := roundRat(r, mode)
+	if !converted.IsUint64() || converted.Uint64() > uint64(^uint(0)) {
+		return fmt.Errorf("%s converted to %s: %w", m, converted, ErrAmountOverflow), m
+	}
+
+	return nil, NewMoney(uint(converted.Uint64()), to)
+}
+
+// Rate returns the rate from one currency to another in effect at the given
+// time, crossing through the converter base currency if needed. Rates older
+// than the converter max age are treated as missing.
+func (cc *CurrencyConverter) Rate(ctx context.Context, from *Currency, to *Currency, at time.Time) (error, *Rate) {
+	err, rate := RateAsOf(ctx, cc.rates, from, to, cc.base, at)
+	if err != nil {
+		return err, nil
+	}
+
+	if cc.maxAge > 0 && rate.ValidFrom != nil && at.Sub(*rate.ValidFrom) > cc.maxAge {
+		return fmt.Errorf("rate from currency %d to %d is stale at %s: %w", *from.Id, *to.Id, at, ErrNotFound), nil
+	}
+
+	return nil, rate
+}
+
+func (cc *CurrencyConverter) Convert(ctx context.Context, m Money, to *Currency, at time.Time) (error, Money, *Rate) {
+	if sameCurrency(m.Currency, to) {
+		return nil, m, nil
+	}
+
+	err, rate := cc.Rate(ctx, m.Currency, to, at)
+	if err != nil {
+		return err, m, nil
+	}
+
+	err, converted := ConvertMoney(m, to, *rate.Value, cc.rounding)
+	if err != nil {
+		return err, m, nil
+	}
+
+	return nil, converted, rate
+}
+
+// ConvertTransaction fills AmountConverted and CurrencyConverted from the
+// transaction amount and account currency, recording the rate it used.
+// The rate is taken as of the transaction creation time, or now for a
+// transaction not stored yet.
+func (cc *CurrencyConverter) ConvertTransaction(ctx context.Context, transaction *Transaction) error {
+	if transaction.Amount == nil {
+		return fmt.Errorf("transaction amount is empty: %w", ErrValidation)
+	}
+
+	var to *Currency
+	if transaction.Account != nil {
+		to = transaction.Account.Currency
+	}
+
+	transaction.CurrencyConverted = to
+	transaction.ConversionRateId = nil
+	transaction.ConversionRate = nil
+
+	if !transaction.needsConversion() {
+		transaction.AmountConverted = transaction.Amount
+		return nil
+	}
+
+	at := time.Now()
+	if transaction.Created != nil {
+		at = *transaction.Created
+	}
+
+	err, converted, rate := cc.Convert(ctx, transaction.Money(), to, at)
+	if err != nil {
+		return err
+	}
+
+	transaction.SetMoneyConverted(converted)
+	if rate != nil {
+		transaction.ConversionRateId = rate.Id
+		transaction.ConversionRate = rate.Value
+	}
+
+	return nil
+}
+
+func NewCurrencyConverter(
+	rates    RateRepository,
+	base     *Currency,
+	rounding RoundingMode,
+	maxAge   time.Duration,
+	logger   LoggerFunc,
+) *CurrencyConverter {
+	return &CurrencyConverter{
+		rates:    rates,
+		base:     base,
+		rounding: rounding,
+		maxAge:   maxAge,
+		logger:   logger,
+	}
+}
@@ -0,0 +1,140 @@
+package repository
+
+import (
+	"time"
+	"errors"
+	"context"
+	"testing"
+)
+
+func TestConvertMoneyRounding(t *testing.T) {
+	exponent := func(code string, exp int) *Currency {
+		return &Currency{CharCode: &code, Exponent: &exp}
+	}
+	usd, jpy, kwd := exponent("USD", 2), exponent("JPY", 0), exponent("KWD", 3)
+
+	cases := []struct {
+		name   string
+		money  Money
+		to     *Currency
+		value  string
+		amount map[RoundingMode]uint
+	}{
+		{"exact", NewMoney(150, usd), jpy, "2", map[RoundingMode]uint{
+			RoundHalfUp: 3, RoundHalfEven: 3, RoundDown: 3, RoundUp: 3,
+		}},
+		{"half to even down", NewMoney(250, usd), jpy, "1", map[RoundingMode]uint{
+			RoundHalfUp: 3, RoundHalfEven: 2, RoundDown: 2, RoundUp: 3,
+		}},
+		{"half to even up", NewMoney(350, usd), jpy, "1", map[RoundingMode]uint{
+			RoundHalfUp: 4, RoundHalfEven: 4, RoundDown: 3, RoundUp: 4,
+		}},
+		{"below half", NewMoney(100, usd), usd, "0.3333", map[RoundingMode]uint{
+			RoundHalfUp: 33, RoundHalfEven: 33, RoundDown: 33, RoundUp: 34,
+		}},
+		{"above half", NewMoney(100, usd), usd, "0.6667", map[RoundingMode]uint{
+			RoundHalfUp: 67, RoundHalfEven: 67, RoundDown: 66, RoundUp: 67,
+		}},
+		{"to more minor digits", NewMoney(1, jpy), kwd, "0.0021234", map[RoundingMode]uint{
+			RoundHalfUp: 2, RoundHalfEven: 2, RoundDown: 2, RoundUp: 3,
+		}},
+		{"to fewer minor digits", NewMoney(1005, kwd), usd, "1", map[RoundingMode]uint{
+			RoundHalfUp: 101, RoundHalfEven: 100, RoundDown: 100, RoundUp: 101,
+		}},
+	}
+
+	for _, c := range cases {
+		for mode, want := range c.amount {
+			err, converted := ConvertMoney(c.money, c.to, c.value, mode)
+			if err != nil {
+				t.Errorf("%s, mode %d: %v", c.name, mode, err)
+				continue
+			}
+
+			if converted.Amount != want || converted.Currency != c.to {
+				t.Errorf("%s, mode %d: got %s, want %d", c.name, mode, converted, want)
+			}
+		}
+	}
+}
+
+func TestConvertMoneyErrors(t *testing.T) {
+	exp := 2
+	usd := &Currency{Exponent: &exp}
+
+	if err, _ := ConvertMoney(NewMoney(^uint(0), usd), usd, "2", RoundDown); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("overflow: got %v", err)
+	}
+
+	for _, value := range []string{"0", "-1", "abc"} {
+		if err, _ := ConvertMoney(NewMoney(100, usd), usd, value, RoundDown); !errors.Is(err, ErrValidation) {
+			t.Errorf("rate %q: got %v, want validation error", value, err)
+		}
+	}
+
+	if err, _ := ConvertMoney(NewMoney(100, &Currency{}), usd, "1", RoundDown); !errors.Is(err, ErrValidation) {
+		t.Errorf("unknown exponent: got %v, want validation error", err)
+	}
+}
+
+func TestConverterMaxAge(t *testing.T) {
+	ctx := context.Background()
+	tr := newTestRates(t)
+	converter := NewCurrencyConverter(tr.rates, tr.rub, RoundHalfUp, 36*time.Hour, testLogger)
+
+	// EUR to RUB is valid from the epoch on and never expires
+	if err, _ := converter.Rate(ctx, tr.eur, tr.rub, rateEpoch.Add(35*time.Hour)); err != nil {
+		t.Errorf("fresh rate: %v", err)
+	}
+
+	if err, _ := converter.Rate(ctx, tr.eur, tr.rub, rateEpoch.Add(37*time.Hour)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("stale rate: got %v, want not found", err)
+	}
+
+	// the cross rate is as old as the newer rate it is made of
+	if err, _ := converter.Rate(ctx, tr.eur, tr.usd, rateEpoch.Add(37*time.Hour)); err != nil {
+		t.Errorf("fresh cross rate: %v", err)
+	}
+}
+
+func TestConvertTransaction(t *testing.T) {
+	ctx := context.Background()
+	tr := newTestRates(t)
+	converter := NewCurrencyConverter(tr.rates, tr.rub, RoundHalfUp, 0, testLogger)
+
+	enabled := true
+	amount := uint(1050)
+	created := rateEpoch.Add(48 * time.Hour)
+
+	transaction := &Transaction{
+		Amount:   &amount,
+		Currency: tr.usd,
+		Created:  &created,
+		Account:  &Account{
+			CurrencyConversionEnabled: &enabled,
+			Currency:                  tr.rub,
+		},
+	}
+
+	if err := converter.ConvertTransaction(ctx, transaction); err != nil {
+		t.Fatalf("convert failed: %v", err)
+	}
+
+	if *transaction.AmountConverted != 99750 || transaction.CurrencyConverted != tr.rub {
+		t.Errorf("converted to %s, want 997.50 RUB", transaction.MoneyConverted())
+	}
+
+	if transaction.ConversionRateId == nil || *transaction.ConversionRate != "95" {
+		t.Errorf("conversion rate = %v %v, want the stored 95", transaction.ConversionRateId, transaction.ConversionRate)
+	}
+
+	transaction.Account.Currency = tr.usd
+
+	if err := converter.ConvertTransaction(ctx, transaction); err != nil {
+		t.Fatalf("convert failed: %v", err)
+	}
+
+	if *transaction.AmountConverted != amount || transaction.ConversionRateId != nil || transaction.ConversionRate != nil {
+		t.Errorf("same currency converted to %s with rate %v", transaction.MoneyConverted(), transaction.ConversionRate)
+	}
+}
@@ -2,10 +2,10 @@ package repository
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"context"
 	"github.com/wk8/go-ordered-map"
-	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
@@ -19,14 +19,14 @@ type Currency struct {
 
 type CurrencySpecification interface {
 	Specified(currency *Currency, i int) bool
-	ToSqlClauses() string
+	ToSqlClauses() *SqlClauses
 }
 
 type CurrencyRepository interface {
-	Add(ctx interface{}, currency *Currency) error
-	Delete(ctx interface{}, currency *Currency) (error, bool)
-	Update(ctx interface{}, currency *Currency) (error, bool)
-	Query(ctx interface{}, specification CurrencySpecification) (error, int, []*Currency)
+	Add(ctx context.Context, currency *Currency) error
+	Delete(ctx context.Context, currency *Currency) error
+	Update(ctx context.Context, currency *Currency) error
+	Query(ctx context.Context, specification CurrencySpecification) (error, int, []*Currency)
 }
 
 type CurrencySpecificationWithLimitAndOffset struct {
@@ -35,11 +35,12 @@ type CurrencySpecificationWithLimitAndOffset struct {
 }
 
 func (cswlao *CurrencySpecificationWithLimitAndOffset) Specified(currency *Currency, i int) bool {
-	return i >= cswlao.offset && i < cswlao.offset + cswlao.limit
+	// paging is applied by the store once the matched currencies are ordered
+	return true
 }
 
-func (cswlao *CurrencySpecificationWithLimitAndOffset) ToSqlClauses() string {
-	return fmt.Sprintf("limit %d offset %d", cswlao.limit, cswlao.offset)
+func (cswlao *CurrencySpecificationWithLimitAndOffset) ToSqlClauses() *SqlClauses {
+	return NewSqlLimitAndOffsetClauses(cswlao.limit, cswlao.offset)
 }
 
 type CurrencySpecificationByID struct {
@@ -50,8 +51,25 @@ func (csbyid *CurrencySpecificationByID) Specified(currency *Currency, i int) bo
 	return csbyid.id == *currency.Id
 }
 
-func (csbyid *CurrencySpecificationByID) ToSqlClauses() string {
-	return fmt.Sprintf("where id=%d", csbyid.id)
+func (csbyid *CurrencySpecificationByID) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=?", csbyid.id)
+}
+
+type CurrencySpecificationByIDs struct {
+	ids []int
+}
+
+func (csbyids *CurrencySpecificationByIDs) Specified(currency *Currency, i int) bool {
+	for _, id := range csbyids.ids {
+		if id == *currency.Id {
+			return true
+		}
+	}
+	return false
+}
+
+func (csbyids *CurrencySpecificationByIDs) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=any(?)", csbyids.ids)
 }
 
 type CurrencySpecificationByNumericCode struct {
@@ -62,8 +80,134 @@ func (csbync *CurrencySpecificationByNumericCode) Specified(currency *Currency,
 	return csbync.numericcode == *currency.NumericCode
 }
 
-func (csbync *CurrencySpecificationByNumericCode) ToSqlClauses() string {
-	return fmt.Sprintf("where numeric_code=%d", csbync.numericcode)
+func (csbync *CurrencySpecificationByNumericCode) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("numeric_code=?", csbync.numericcode)
+}
+
+type CurrencySpecificationByCharCode struct {
+	charcode string
+}
+
+func (csbycc *CurrencySpecificationByCharCode) Specified(currency *Currency, i int) bool {
+	return currency.CharCode != nil && csbycc.charcode == *currency.CharCode
+}
+
+func (csbycc *CurrencySpecificationByCharCode) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("char_code=?", csbycc.charcode)
+}
+
+type CurrencySpecificationAnd struct {
+	specs []CurrencySpecification
+}
+
+func (csand *CurrencySpecificationAnd) Specified(currency *Currency, i int) bool {
+	for _, spec := range csand.specs {
+		if !spec.Specified(currency, i) {
+			return false
+		}
+	}
+	return true
+}
+
+func (csand *CurrencySpecificationAnd) ToSqlClauses() *SqlClauses {
+	var clauses []*SqlClauses
+	for _, spec := range csand.specs {
+		clauses = append(clauses, spec.ToSqlClauses())
+	}
+	return andSqlClauses(clauses...)
+}
+
+type CurrencySpecificationOr struct {
+	specs []CurrencySpecification
+}
+
+func (csor *CurrencySpecificationOr) Specified(currency *Currency, i int) bool {
+	for _, spec := range csor.specs {
+		if spec.Specified(currency, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (csor *CurrencySpecificationOr) ToSqlClauses() *SqlClauses {
+	var clauses []*SqlClauses
+	for _, spec := range csor.specs {
+		clauses = append(clauses, spec.ToSqlClauses())
+	}
+	return orSqlClauses(clauses...)
+}
+
+type CurrencySpecificationNot struct {
+	spec CurrencySpecification
+}
+
+func (csnot *CurrencySpecificationNot) Specified(currency *Currency, i int) bool {
+	return !csnot.spec.Specified(currency, i)
+}
+
+func (csnot *CurrencySpecificationNot) ToSqlClauses() *SqlClauses {
+	return notSqlClauses(csnot.spec.ToSqlClauses())
+}
+
+type CurrencySpecificationOrderBy struct {
+	spec   CurrencySpecification
+	column string
+	desc   bool
+}
+
+func (csob *CurrencySpecificationOrderBy) Specified(currency *Currency, i int) bool {
+	return csob.spec.Specified(currency, i)
+}
+
+func (csob *CurrencySpecificationOrderBy) ToSqlClauses() *SqlClauses {
+	return orderBySqlClauses(csob.spec.ToSqlClauses(), csob.column, csob.desc)
+}
+
+type CurrencySpecificationPaged struct {
+	spec   CurrencySpecification
+	limit  int
+	offset int
+}
+
+func (csp *CurrencySpecificationPaged) Specified(currency *Currency, i int) bool {
+	return csp.spec.Specified(currency, i)
+}
+
+func (csp *CurrencySpecificationPaged) ToSqlClauses() *SqlClauses {
+	return pagedSqlClauses(csp.spec.ToSqlClauses(), csp.limit, csp.offset)
+}
+
+// currencyOrderColumns are the ones compareCurrencies knows, the PG store
+// accepts the same so both stores reject an unknown column alike.
+var currencyOrderColumns = []string{"id", "numeric_code", "name", "char_code", "exponent"}
+
+func compareCurrencies(a *Currency, b *Currency, column string) int {
+	switch column {
+	case "id":
+		return compareIntPtr(a.Id, b.Id)
+	case "numeric_code":
+		return compareIntPtr(a.NumericCode, b.NumericCode)
+	case "name":
+		return compareStringPtr(a.Name, b.Name)
+	case "char_code":
+		return compareStringPtr(a.CharCode, b.CharCode)
+	case "exponent":
+		return compareIntPtr(a.Exponent, b.Exponent)
+	}
+	return 0
+}
+
+func sortCurrencies(currencies []*Currency, orderBy []SqlOrder) {
+	sort.SliceStable(currencies, func(i, j int) bool {
+		for _, order := range orderBy {
+			c := compareCurrencies(currencies[i], currencies[j], order.Column)
+			if c != 0 {
+				return (c < 0) != order.Desc
+			}
+		}
+		return false
+	})
 }
 
 type OrderedMapCurrencyStore struct {
@@ -74,7 +218,7 @@ type OrderedMapCurrencyStore struct {
 	logger     LoggerFunc
 }
 
-func (cs *OrderedMapCurrencyStore) Add(ctx interface{}, currency *Currency) error {
+func (cs *OrderedMapCurrencyStore) Add(ctx context.Context, currency *Currency) error {
 	cs.Lock()
 	defer cs.Unlock()
 
@@ -86,13 +230,13 @@ func (cs *OrderedMapCurrencyStore) Add(ctx interface{}, currency *Currency) erro
 	return nil
 }
 
-func (cs *OrderedMapCurrencyStore) Delete(ctx interface{}, currency *Currency) (error, bool) {
+func (cs *OrderedMapCurrencyStore) Delete(ctx context.Context, currency *Currency) error {
 	cs.Lock()
 	defer cs.Unlock()
 
 	value, present := cs.currencies.Delete(*currency.Id)
 	if !present {
-		return fmt.Errorf("currency with id=%v not found", *currency.Id), true
+		return fmt.Errorf("currency with id=%v: %w", *currency.Id, ErrNotFound)
 	}
 
 	deleted := value.(Currency)
@@ -101,16 +245,16 @@ func (cs *OrderedMapCurrencyStore) Delete(ctx interface{}, currency *Currency) (
 	currency.CharCode = deleted.CharCode
 	currency.Exponent = deleted.Exponent
 
-	return nil, false
+	return nil
 }
 
-func (cs *OrderedMapCurrencyStore) Update(ctx interface{}, currency *Currency) (error, bool) {
+func (cs *OrderedMapCurrencyStore) Update(ctx context.Context, currency *Currency) error {
 	cs.Lock()
 	defer cs.Unlock()
 
 	value, present := cs.currencies.Get(*currency.Id)
 	if !present {
-		return fmt.Errorf("currency with id=%v not found", *currency.Id), true
+		return fmt.Errorf("currency with id=%v: %w", *currency.Id, ErrNotFound)
 	}
 
 	old := value.(Currency)
@@ -141,10 +285,10 @@ func (cs *OrderedMapCurrencyStore) Update(ctx interface{}, currency *Currency) (
 
 	cs.currencies.Set(*old.Id, old)
 
-	return nil, false
+	return nil
 }
 
-func (cs *OrderedMapCurrencyStore) Query(ctx interface{}, specification CurrencySpecification) (error, int, []*Currency) {
+func (cs *OrderedMapCurrencyStore) Query(ctx context.Context, specification CurrencySpecification) (error, int, []*Currency) {
 	cs.Lock()
 	defer cs.Unlock()
 
@@ -159,7 +303,15 @@ func (cs *OrderedMapCurrencyStore) Query(ctx interface{}, specification Currency
 		c++
 	}
 
-	return nil, cs.currencies.Len(), l
+	clauses := specification.ToSqlClauses()
+	if err := clauses.checkOrderBy(currencyOrderColumns...); err != nil {
+		return err, 0, nil
+	}
+
+	sortCurrencies(l, clauses.OrderBy)
+	start, end := pageBounds(clauses, len(l))
+
+	return nil, len(l), l[start:end]
 }
 
 func NewOrderedMapCurrencyStore(currencies *orderedmap.OrderedMap, logger LoggerFunc) CurrencyRepository {
@@ -174,12 +326,24 @@ func NewCurrencySpecificationByID(id int) CurrencySpecification {
 	return &CurrencySpecificationByID{id: id}
 }
 
+func NewCurrencySpecificationByIDs(ids []int) CurrencySpecification {
+	return &CurrencySpecificationByIDs{
+		ids: ids,
+	}
+}
+
 func NewCurrencySpecificationByNumericCode(numericcode int) CurrencySpecification {
 	return &CurrencySpecificationByNumericCode{
 		numericcode: numericcode,
 	}
 }
 
+func NewCurrencySpecificationByCharCode(charcode string) CurrencySpecification {
+	return &CurrencySpecificationByCharCode{
+		charcode: charcode,
+	}
+}
+
 func NewCurrencySpecificationWithLimitAndOffset(limit int, offset int) CurrencySpecification {
 	return &CurrencySpecificationWithLimitAndOffset{
 		limit:  limit,
@@ -187,25 +351,71 @@ func NewCurrencySpecificationWithLimitAndOffset(limit int, offset int) CurrencyS
 	}
 }
 
+func NewCurrencySpecificationAnd(specs ...CurrencySpecification) CurrencySpecification {
+	return &CurrencySpecificationAnd{specs: specs}
+}
+
+func NewCurrencySpecificationOr(specs ...CurrencySpecification) CurrencySpecification {
+	return &CurrencySpecificationOr{specs: specs}
+}
+
+func NewCurrencySpecificationNot(spec CurrencySpecification) CurrencySpecification {
+	return &CurrencySpecificationNot{spec: spec}
+}
+
+func NewCurrencySpecificationOrderBy(spec CurrencySpecification, column string, desc bool) CurrencySpecification {
+	return &CurrencySpecificationOrderBy{
+		spec:   spec,
+		column: column,
+		desc:   desc,
+	}
+}
+
+func NewCurrencySpecificationPaged(spec CurrencySpecification, limit int, offset int) CurrencySpecification {
+	return &CurrencySpecificationPaged{
+		spec:   spec,
+		limit:  limit,
+		offset: offset,
+	}
+}
+
+func currenciesByIds(ctx context.Context, store CurrencyRepository, ids idSet) (error, map[int]*Currency) {
+	m := make(map[int]*Currency)
+	if len(ids) == 0 {
+		return nil, m
+	}
+
+	err, _, currencies := store.Query(ctx, NewCurrencySpecificationByIDs(ids.slice()))
+	if err != nil {
+		return err, m
+	}
+
+	for _, currency := range currencies {
+		m[*currency.Id] = currency
+	}
+
+	return nil, m
+}
+
 type PGPoolCurrencyStore struct {
 	pool   *pgxpool.Pool
 	logger LoggerFunc
 }
 
-func (cs *PGPoolCurrencyStore) Add(ctx interface{}, currency *Currency) error {
-	return cs.pool.QueryRow(
-		context.Background(),
+func (cs *PGPoolCurrencyStore) Add(ctx context.Context, currency *Currency) error {
+	return mapPgError(pgQuerierFromContext(ctx, cs.pool).QueryRow(
+		ctx,
 		"insert into currencies (numeric_code, name, char_code, exponent) values ($1, $2, $3, $4) returning id",
 		currency.NumericCode,
 		currency.Name,
 		currency.CharCode,
 		currency.Exponent,
-	).Scan(&currency.Id)
+	).Scan(&currency.Id))
 }
 
-func (cs *PGPoolCurrencyStore) Delete(ctx interface{}, currency *Currency) (error, bool) {
-	err := cs.pool.QueryRow(
-		context.Background(),
+func (cs *PGPoolCurrencyStore) Delete(ctx context.Context, currency *Currency) error {
+	err := pgQuerierFromContext(ctx, cs.pool).QueryRow(
+		ctx,
 		"delete from currencies where id=$1 returning numeric_code, name, char_code, exponent",
 		currency.Id,
 	).Scan(
@@ -215,38 +425,31 @@ func (cs *PGPoolCurrencyStore) Delete(ctx interface{}, currency *Currency) (erro
 		&currency.Exponent,
 	)
 
-	return err, err == pgx.ErrNoRows
+	return mapPgError(err)
 }
 
-func (cs *PGPoolCurrencyStore) Query(ctx interface{}, specification CurrencySpecification) (error, int, []*Currency) {
+func (cs *PGPoolCurrencyStore) Query(ctx context.Context, specification CurrencySpecification) (error, int, []*Currency) {
 	var l []*Currency
 	var c int = 0
 
-	conn, err := cs.pool.Acquire(context.Background())
-
-	if err != nil {
-		return fmt.Errorf("failed to acquire connection from the pool: %v", err), c, l
+	conn := pgQuerierFromContext(ctx, cs.pool)
+	sqlClauses := specification.ToSqlClauses()
+	if err := sqlClauses.checkOrderBy(currencyOrderColumns...); err != nil {
+		return err, c, l
 	}
-	defer conn.Release()
-
-	err = conn.QueryRow(
-		context.Background(),
-		"select count(*) from currencies",
-	).Scan(&c)
 
-	if err != nil {
-		return fmt.Errorf("failed to get currencies cnt: %v", err), c, l
-	}
+	clauses, args := sqlClauses.Build()
 
 	rows, err := conn.Query(
-		context.Background(), fmt.Sprintf(
-			"select id, numeric_code, name, char_code, exponent from currencies %s",
-			specification.ToSqlClauses(),
+		ctx, fmt.Sprintf(
+			"select count(*) over(), id, numeric_code, name, char_code, exponent from currencies %s",
+			clauses,
 		),
+		args...,
 	)
 
 	if err != nil {
-		return fmt.Errorf("failed to query currencies rows: %v", err), c, l
+		return fmt.Errorf("failed to query currencies rows: %w", mapPgError(err)), c, l
 	}
 	defer rows.Close()
 
@@ -254,27 +457,42 @@ func (cs *PGPoolCurrencyStore) Query(ctx interface{}, specification CurrencySpec
 		var currency Currency
 
 		if err = rows.Scan(
+			&c,
 			&currency.Id,
 			&currency.NumericCode,
 			&currency.Name,
 			&currency.CharCode,
 			&currency.Exponent,
 		); err != nil {
-			return fmt.Errorf("failed to get currency row: %v", err), c, l
+			return fmt.Errorf("failed to get currency row: %w", mapPgError(err)), c, l
 		}
 		l = append(l, &currency)
 	}
 
 	if err = rows.Err(); err != nil {
-		return fmt.Errorf("failed to iterating over rows of currencies: %v", err), c, l
+		return fmt.Errorf("failed to iterating over rows of currencies: %w", mapPgError(err)), c, l
+	}
+
+	if len(l) == 0 && sqlClauses.Offset != nil && *sqlClauses.Offset > 0 {
+		filter, filterArgs := sqlClauses.Filter().Build()
+
+		err = conn.QueryRow(
+			ctx,
+			fmt.Sprintf("select count(*) from currencies %s", filter),
+			filterArgs...,
+		).Scan(&c)
+
+		if err != nil {
+			return fmt.Errorf("failed to get currencies cnt: %w", mapPgError(err)), c, l
+		}
 	}
 
 	return nil, c, l
 }
 
-func (cs *PGPoolCurrencyStore) Update(ctx interface{}, currency *Currency) (error, bool) {
-	err := cs.pool.QueryRow(
-		context.Background(),
+func (cs *PGPoolCurrencyStore) Update(ctx context.Context, currency *Currency) error {
+	err := pgQuerierFromContext(ctx, cs.pool).QueryRow(
+		ctx,
 		`update currencies set
 			numeric_code=COALESCE($2, numeric_code),
 			name=COALESCE($3, name),
@@ -293,7 +511,7 @@ func (cs *PGPoolCurrencyStore) Update(ctx interface{}, currency *Currency) (erro
 		&currency.Exponent,
 	)
 
-	return err, err == pgx.ErrNoRows
+	return mapPgError(err)
 }
 
 func NewPGPoolCurrencyStore(pool *pgxpool.Pool, logger LoggerFunc) CurrencyRepository {
@@ -0,0 +1,158 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	DETOKENIZE_GRANTED   = "granted"
+	DETOKENIZE_NOT_FOUND = "not_found"
+	DETOKENIZE_FAILED    = "failed"
+)
+
+// DetokenizationRecord is one attempt to recover card data by token. The
+// token itself is not kept, only its hash, so the audit trail can not be
+// used to detokenize.
+type DetokenizationRecord struct {
+	Created   time.Time
+	TokenHash string
+	CardId    *int
+	Actor     string
+	Purpose   string
+	Outcome   string
+	Error     *string
+}
+
+type DetokenizationAuditor interface {
+	Record(ctx context.Context, record *DetokenizationRecord) error
+}
+
+// CardDetokenizer recovers cards by token and audits every attempt. The
+// audit record is written before the card is returned and a failure to
+// write it denies the access.
+type CardDetokenizer struct {
+	cards   CardRepository
+	auditor DetokenizationAuditor
+	logger  LoggerFunc
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Detokenize returns the card with the given token on behalf of actor.
+// Purpose tells why the card data is needed, e.g. "rebill".
+func (cd *CardDetokenizer) Detokenize(ctx context.Context, token string, actor string, purpose string) (error, *Card) {
+	record := &DetokenizationRecord{
+		Created:   time.Now(),
+		TokenHash: hashToken(token),
+		Actor:     actor,
+		Purpose:   purpose,
+	}
+
+	var card *Card
+
+	err, _, cards := cd.cards.Query(ctx, NewCardSpecificationByToken(token))
+	switch {
+	case err != nil && !errors.Is(err, ErrNotFound):
+		msg := err.Error()
+		record.Outcome = DETOKENIZE_FAILED
+		record.Error = &msg
+		err = fmt.Errorf("Can not get card by token: %w", err)
+	case len(cards) == 0:
+		record.Outcome = DETOKENIZE_NOT_FOUND
+		err = fmt.Errorf("card by token: %w", ErrNotFound)
+	default:
+		card = cards[0]
+		record.Outcome = DETOKENIZE_GRANTED
+		record.CardId = card.Id
+	}
+
+	if auditErr := cd.auditor.Record(ctx, record); auditErr != nil {
+		return fmt.Errorf("Can not audit detokenization: %w", auditErr), nil
+	}
+
+	if err != nil {
+		return err, nil
+	}
+
+	return nil, card
+}
+
+func NewCardDetokenizer(
+	cards   CardRepository,
+	auditor DetokenizationAuditor,
+	logger  LoggerFunc,
+) *CardDetokenizer {
+	return &CardDetokenizer{
+		cards:   cards,
+		auditor: auditor,
+		logger:  logger,
+	}
+}
+
+type LoggerDetokenizationAuditor struct {
+	logger LoggerFunc
+}
+
+func (a *LoggerDetokenizationAuditor) Record(ctx context.Context, record *DetokenizationRecord) error {
+	a.logger(ctx).Printf(
+		"Detokenization by %s for %s of token %s: %s (card id=%v)",
+		record.Actor,
+		record.Purpose,
+		record.TokenHash,
+		record.Outcome,
+		record.CardId,
+	)
+
+	return nil
+}
+
+func NewLoggerDetokenizationAuditor(logger LoggerFunc) DetokenizationAuditor {
+	return &LoggerDetokenizationAuditor{
+		logger: logger,
+	}
+}
+
+type PGPoolDetokenizationAuditor struct {
+	pool   *pgxpool.Pool
+	logger LoggerFunc
+}
+
+func (a *PGPoolDetokenizationAuditor) Record(ctx context.Context, record *DetokenizationRecord) error {
+	_, err := pgQuerierFromContext(ctx, a.pool).Exec(
+		ctx,
+		`insert into card_detokenizations (
+			created,
+			token_hash,
+			card_id,
+			actor,
+			purpose,
+			outcome,
+			error_message
+		) values ($1, $2, $3, $4, $5, $6, $7)`,
+		record.Created,
+		record.TokenHash,
+		record.CardId,
+		record.Actor,
+		record.Purpose,
+		record.Outcome,
+		record.Error,
+	)
+
+	return mapPgError(err)
+}
+
+func NewPGPoolDetokenizationAuditor(pool *pgxpool.Pool, logger LoggerFunc) DetokenizationAuditor {
+	return &PGPoolDetokenizationAuditor{
+		pool:   pool,
+		logger: logger,
+	}
+}
@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"fmt"
+	"errors"
+	"net"
+	"net/http"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgconn"
+)
+
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrConflict    = errors.New("conflict")
+	ErrUnavailable = errors.New("unavailable")
+	ErrValidation  = errors.New("validation failed")
+)
+
+// RepositoryError tags an underlying error with one of the Err* kinds, so
+// callers can use errors.Is against the kind and still unwrap the cause.
+type RepositoryError struct {
+	Kind error
+	Err  error
+}
+
+func (e *RepositoryError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+func (e *RepositoryError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *RepositoryError) Unwrap() error {
+	return e.Err
+}
+
+func NewRepositoryError(kind error, err error) error {
+	return &RepositoryError{
+		Kind: kind,
+		Err:  err,
+	}
+}
+
+func mapPgError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return NewRepositoryError(ErrNotFound, err)
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "23505", "23503", "40001":
+			// unique_violation, foreign_key_violation, serialization_failure
+			return NewRepositoryError(ErrConflict, err)
+		}
+
+		switch pgErr.Code[:2] {
+		case "22", "23":
+			// data_exception, integrity_constraint_violation
+			return NewRepositoryError(ErrValidation, err)
+		case "08", "53", "57":
+			// connection_exception, insufficient_resources, operator_intervention
+			return NewRepositoryError(ErrUnavailable, err)
+		}
+
+		return err
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || pgconn.Timeout(err) || pgconn.SafeToRetry(err) {
+		return NewRepositoryError(ErrUnavailable, err)
+	}
+
+	return err
+}
+
+func httpStatusError(status int) error {
+	if status >= 200 && status < 300 {
+		return nil
+	}
+
+	err := fmt.Errorf("http status: %d", status)
+
+	switch {
+	case status == http.StatusNotFound:
+		return NewRepositoryError(ErrNotFound, err)
+	case status == http.StatusConflict:
+		return NewRepositoryError(ErrConflict, err)
+	case status == http.StatusBadRequest,
+		status == http.StatusUnprocessableEntity:
+		return NewRepositoryError(ErrValidation, err)
+	case status >= 500:
+		return NewRepositoryError(ErrUnavailable, err)
+	}
+
+	return err
+}
@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"fmt"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+var ErrIdempotencyKeyReused = fmt.Errorf("idempotency key reused with a different request: %w", ErrConflict)
+
+// RequestHash fingerprints a request payload for idempotency checks. The
+// payload is hashed in its JSON form, so equal requests hash equally.
+func RequestHash(request interface{}) (error, string) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("can not marshal request: %w", NewRepositoryError(ErrValidation, err)), ""
+	}
+
+	sum := sha256.Sum256(body)
+
+	return nil, hex.EncodeToString(sum[:])
+}
+
+// AddIdempotent adds the transaction unless its profile already has one
+// with the same IdempotencyKey. On such a replay the original transaction
+// is copied into transaction and true is returned, provided RequestHash
+// matches; a different hash is reported as ErrIdempotencyKeyReused.
+func (ts *PGPoolTransactionStore) AddIdempotent(ctx context.Context, transaction *Transaction) (error, bool) {
+	if transaction.IdempotencyKey == nil || transaction.RequestHash == nil {
+		return fmt.Errorf("idempotency key and request hash are required: %w", ErrValidation), false
+	}
+
+	if transaction.Profile == nil || transaction.Profile.Id == nil {
+		return fmt.Errorf("idempotency key %s without profile: %w", *transaction.IdempotencyKey, ErrValidation), false
+	}
+
+	err, inserted := ts.insert(ctx, transaction)
+	if err != nil || inserted {
+		return err, false
+	}
+
+	var id int
+	var requestHash *string
+
+	err = pgQuerierFromContext(ctx, ts.pool).QueryRow(
+		ctx,
+		"select id, request_hash from transactions where profile_id=$1 and idempotency_key=$2",
+		transaction.Profile.Id,
+		transaction.IdempotencyKey,
+	).Scan(&id, &requestHash)
+
+	if err != nil {
+		return fmt.Errorf("Can not get transaction by idempotency key %s: %w", *transaction.IdempotencyKey, mapPgError(err)), false
+	}
+
+	if requestHash == nil || *requestHash != *transaction.RequestHash {
+		return fmt.Errorf("idempotency key %s: %w", *transaction.IdempotencyKey, ErrIdempotencyKeyReused), false
+	}
+
+	err, _, transactions := ts.Query(ctx, NewTransactionSpecificationByID(id))
+	if err != nil {
+		return fmt.Errorf("Can not get transaction with id=%v: %w", id, err), false
+	}
+
+	if len(transactions) == 0 {
+		return fmt.Errorf("transaction with id=%v: %w", id, ErrNotFound), false
+	}
+
+	*transaction = *transactions[0]
+
+	return nil, true
+}
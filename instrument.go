@@ -3,7 +3,6 @@ package repository
 import (
 	"fmt"
 	"context"
-	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
@@ -13,20 +12,20 @@ type Instrument struct {
 }
 
 type InstrumentSpecification interface {
-	ToSqlClauses() string
+	ToSqlClauses() *SqlClauses
 }
 
 type InstrumentRepository interface {
-	Add(ctx interface{}, instrument *Instrument) error
-	Delete(ctx interface{}, instrument *Instrument) (error, bool)
-	Update(ctx interface{}, instrument *Instrument) (error, bool)
-	Query(ctx interface{}, specification InstrumentSpecification) (error, int, []*Instrument)
+	Add(ctx context.Context, instrument *Instrument) error
+	Delete(ctx context.Context, instrument *Instrument) error
+	Update(ctx context.Context, instrument *Instrument) error
+	Query(ctx context.Context, specification InstrumentSpecification) (error, int, []*Instrument)
 }
 
 type InstrumentWithoutSpecification struct {}
 
-func (iws *InstrumentWithoutSpecification) ToSqlClauses() string {
-	return ""
+func (iws *InstrumentWithoutSpecification) ToSqlClauses() *SqlClauses {
+	return &SqlClauses{}
 }
 
 type InstrumentSpecificationWithLimitAndOffset struct {
@@ -34,30 +33,42 @@ type InstrumentSpecificationWithLimitAndOffset struct {
 	offset int
 }
 
-func (iswlao *InstrumentSpecificationWithLimitAndOffset) ToSqlClauses() string {
-	return fmt.Sprintf("limit %d offset %d", iswlao.limit, iswlao.offset)
+func (iswlao *InstrumentSpecificationWithLimitAndOffset) ToSqlClauses() *SqlClauses {
+	return NewSqlLimitAndOffsetClauses(iswlao.limit, iswlao.offset)
 }
 
 type InstrumentSpecificationByID struct {
 	id int
 }
 
-func (isbyid *InstrumentSpecificationByID) ToSqlClauses() string {
-	return fmt.Sprintf("where id=%d", isbyid.id)
+func (isbyid *InstrumentSpecificationByID) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=?", isbyid.id)
+}
+
+type InstrumentSpecificationByIDs struct {
+	ids []int
+}
+
+func (isbyids *InstrumentSpecificationByIDs) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=any(?)", isbyids.ids)
 }
 
 type InstrumentSpecificationByKey struct {
 	key string
 }
 
-func (isbyk *InstrumentSpecificationByKey) ToSqlClauses() string {
-	return fmt.Sprintf("where key='%s'", isbyk.key)
+func (isbyk *InstrumentSpecificationByKey) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("key=?", isbyk.key)
 }
 
 func NewInstrumentSpecificationByID(id int) InstrumentSpecification {
 	return &InstrumentSpecificationByID{id: id}
 }
 
+func NewInstrumentSpecificationByIDs(ids []int) InstrumentSpecification {
+	return &InstrumentSpecificationByIDs{ids: ids}
+}
+
 func NewInstrumentSpecificationByKey(key string) InstrumentSpecification {
 	return &InstrumentSpecificationByKey{
 		key: key,
@@ -75,63 +86,112 @@ func NewInstrumentWithoutSpecification() InstrumentSpecification {
 	return &InstrumentWithoutSpecification{}
 }
 
+func NewInstrumentSpecificationAnd(specs ...InstrumentSpecification) InstrumentSpecification {
+	l := make([]SqlSpecification, 0, len(specs))
+	for _, spec := range specs {
+		l = append(l, spec)
+	}
+	return &SqlSpecificationAnd{specs: l}
+}
+
+func NewInstrumentSpecificationOr(specs ...InstrumentSpecification) InstrumentSpecification {
+	l := make([]SqlSpecification, 0, len(specs))
+	for _, spec := range specs {
+		l = append(l, spec)
+	}
+	return &SqlSpecificationOr{specs: l}
+}
+
+func NewInstrumentSpecificationNot(spec InstrumentSpecification) InstrumentSpecification {
+	return &SqlSpecificationNot{spec: spec}
+}
+
+var instrumentOrderColumns = []string{"id", "key"}
+
+func NewInstrumentSpecificationOrderBy(spec InstrumentSpecification, column string, desc bool) InstrumentSpecification {
+	return &SqlSpecificationOrderBy{
+		spec:   spec,
+		column: column,
+		desc:   desc,
+	}
+}
+
+func NewInstrumentSpecificationPaged(spec InstrumentSpecification, limit int, offset int) InstrumentSpecification {
+	return &SqlSpecificationPaged{
+		spec:   spec,
+		limit:  limit,
+		offset: offset,
+	}
+}
+
+func instrumentsByIds(ctx context.Context, store InstrumentRepository, ids idSet) (error, map[int]*Instrument) {
+	m := make(map[int]*Instrument)
+	if len(ids) == 0 {
+		return nil, m
+	}
+
+	err, _, instruments := store.Query(ctx, NewInstrumentSpecificationByIDs(ids.slice()))
+	if err != nil {
+		return err, m
+	}
+
+	for _, instrument := range instruments {
+		m[*instrument.Id] = instrument
+	}
+
+	return nil, m
+}
+
 type PGPoolInstrumentStore struct {
 	pool   *pgxpool.Pool
 	logger LoggerFunc
 }
 
-func (is *PGPoolInstrumentStore) Add(ctx interface{}, instrument *Instrument) error {
-	_, err := is.pool.Exec(
-		context.Background(),
+func (is *PGPoolInstrumentStore) Add(ctx context.Context, instrument *Instrument) error {
+	_, err := pgQuerierFromContext(ctx, is.pool).Exec(
+		ctx,
 		"insert into instruments (id, key) values ($1, $2)",
 		instrument.Id,
 		instrument.Key,
 	)
 
-	return err
+	return mapPgError(err)
 }
 
-func (is *PGPoolInstrumentStore) Delete(ctx interface{}, instrument *Instrument) (error, bool) {
-	err := is.pool.QueryRow(
-		context.Background(),
+func (is *PGPoolInstrumentStore) Delete(ctx context.Context, instrument *Instrument) error {
+	err := pgQuerierFromContext(ctx, is.pool).QueryRow(
+		ctx,
 		"delete from instruments where id=$1 returning key",
 		instrument.Id,
 	).Scan(
 		&instrument.Key,
 	)
 
-	return err, err == pgx.ErrNoRows
+	return mapPgError(err)
 }
 
-func (is *PGPoolInstrumentStore) Query(ctx interface{}, specification InstrumentSpecification) (error, int, []*Instrument) {
+func (is *PGPoolInstrumentStore) Query(ctx context.Context, specification InstrumentSpecification) (error, int, []*Instrument) {
 	var l []*Instrument
 	var c int = 0
 
-	conn, err := is.pool.Acquire(context.Background())
-
-	if err != nil {
-		return fmt.Errorf("failed to acquire connection from the pool: %v", err), c, l
+	conn := pgQuerierFromContext(ctx, is.pool)
+	sqlClauses := specification.ToSqlClauses()
+	if err := sqlClauses.checkOrderBy(instrumentOrderColumns...); err != nil {
+		return err, c, l
 	}
-	defer conn.Release()
-
-	err = conn.QueryRow(
-		context.Background(),
-		"select count(*) from instruments",
-	).Scan(&c)
 
-	if err != nil {
-		return fmt.Errorf("failed to get instruments cnt: %v", err), c, l
-	}
+	clauses, args := sqlClauses.Build()
 
 	rows, err := conn.Query(
-		context.Background(), fmt.Sprintf(
-			"select id, key from instruments %s",
-			specification.ToSqlClauses(),
+		ctx, fmt.Sprintf(
+			"select count(*) over(), id, key from instruments %s",
+			clauses,
 		),
+		args...,
 	)
 
 	if err != nil {
-		return fmt.Errorf("failed to query instruments rows: %v", err), c, l
+		return fmt.Errorf("failed to query instruments rows: %w", mapPgError(err)), c, l
 	}
 	defer rows.Close()
 
@@ -139,24 +199,39 @@ func (is *PGPoolInstrumentStore) Query(ctx interface{}, specification Instrument
 		var instrument Instrument
 
 		if err = rows.Scan(
+			&c,
 			&instrument.Id,
 			&instrument.Key,
 		); err != nil {
-			return fmt.Errorf("failed to get instrument row: %v", err), c, l
+			return fmt.Errorf("failed to get instrument row: %w", mapPgError(err)), c, l
 		}
 		l = append(l, &instrument)
 	}
 
 	if err = rows.Err(); err != nil {
-		return fmt.Errorf("failed to iterating over rows of instruments: %v", err), c, l
+		return fmt.Errorf("failed to iterating over rows of instruments: %w", mapPgError(err)), c, l
+	}
+
+	if len(l) == 0 && sqlClauses.Offset != nil && *sqlClauses.Offset > 0 {
+		filter, filterArgs := sqlClauses.Filter().Build()
+
+		err = conn.QueryRow(
+			ctx,
+			fmt.Sprintf("select count(*) from instruments %s", filter),
+			filterArgs...,
+		).Scan(&c)
+
+		if err != nil {
+			return fmt.Errorf("failed to get instruments cnt: %w", mapPgError(err)), c, l
+		}
 	}
 
 	return nil, c, l
 }
 
-func (is *PGPoolInstrumentStore) Update(ctx interface{}, instrument *Instrument) (error, bool) {
-	err := is.pool.QueryRow(
-		context.Background(),
+func (is *PGPoolInstrumentStore) Update(ctx context.Context, instrument *Instrument) error {
+	err := pgQuerierFromContext(ctx, is.pool).QueryRow(
+		ctx,
 		`update instruments set
 			key=COALESCE($2, key)
 		where id=$1 returning key`,
@@ -166,7 +241,7 @@ func (is *PGPoolInstrumentStore) Update(ctx interface{}, instrument *Instrument)
 		&instrument.Key,
 	)
 
-	return err, err == pgx.ErrNoRows
+	return mapPgError(err)
 }
 
 func NewPGPoolInstrumentStore(pool *pgxpool.Pool, logger LoggerFunc) InstrumentRepository {
@@ -0,0 +1,220 @@
+package repository
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"errors"
+	"context"
+	"io/ioutil"
+	"crypto/rand"
+	"path/filepath"
+	"encoding/json"
+	"encoding/base64"
+)
+
+const vaultKeySize = 32
+
+// KeyProvider holds the master keys card data keys are wrapped with and
+// the key PAN lookup hashes are computed with. Keys are identified by id so
+// data wrapped with a retired key can still be read until it is rotated.
+type KeyProvider interface {
+	// CurrentKey returns the key new data keys are wrapped with.
+	CurrentKey(ctx context.Context) (error, string, []byte)
+	Key(ctx context.Context, id string) (error, []byte)
+	// HashKey never changes, PAN hashes would not match otherwise.
+	HashKey(ctx context.Context) (error, []byte)
+}
+
+type localKeyFile struct {
+	Current string            `json:"current"`
+	HashKey string            `json:"hash_key"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// LocalFileKeyProvider keeps the master keys in a JSON file as base64.
+// It is meant for tests and development, production keys belong in a KMS.
+type LocalFileKeyProvider struct {
+	sync.RWMutex
+
+	path    string
+	current string
+	hashKey []byte
+	keys    map[string][]byte
+}
+
+func decodeVaultKey(name string, encoded string) (error, []byte) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("can not decode key %s: %w", name, NewRepositoryError(ErrValidation, err)), nil
+	}
+
+	if len(key) != vaultKeySize {
+		return fmt.Errorf("key %s has %d bytes, not %d: %w", name, len(key), vaultKeySize, ErrValidation), nil
+	}
+
+	return nil, key
+}
+
+func readLocalKeyFile(path string) (error, *localKeyFile) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("can not read key file %s: %v", path, err), nil
+	}
+
+	var file localKeyFile
+	if err := json.Unmarshal(body, &file); err != nil {
+		return fmt.Errorf("can not unmarshal key file %s: %w", path, NewRepositoryError(ErrValidation, err)), nil
+	}
+
+	return nil, &file
+}
+
+// Reload reads the key file again, so a key added by rotation is picked up
+// without a restart.
+func (kp *LocalFileKeyProvider) Reload() error {
+	err, file := readLocalKeyFile(kp.path)
+	if err != nil {
+		return err
+	}
+
+	err, hashKey := decodeVaultKey("hash_key", file.HashKey)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string][]byte)
+	for id, encoded := range file.Keys {
+		err, key := decodeVaultKey(id, encoded)
+		if err != nil {
+			return err
+		}
+		keys[id] = key
+	}
+
+	if _, ok := keys[file.Current]; !ok {
+		return fmt.Errorf("current key %s is missing in %s: %w", file.Current, kp.path, ErrValidation)
+	}
+
+	kp.Lock()
+	defer kp.Unlock()
+
+	kp.current = file.Current
+	kp.hashKey = hashKey
+	kp.keys = keys
+
+	return nil
+}
+
+func (kp *LocalFileKeyProvider) CurrentKey(ctx context.Context) (error, string, []byte) {
+	kp.RLock()
+	defer kp.RUnlock()
+
+	return nil, kp.current, kp.keys[kp.current]
+}
+
+func (kp *LocalFileKeyProvider) Key(ctx context.Context, id string) (error, []byte) {
+	kp.RLock()
+	defer kp.RUnlock()
+
+	key, ok := kp.keys[id]
+	if !ok {
+		return fmt.Errorf("key %s: %w", id, ErrNotFound), nil
+	}
+
+	return nil, key
+}
+
+func (kp *LocalFileKeyProvider) HashKey(ctx context.Context) (error, []byte) {
+	kp.RLock()
+	defer kp.RUnlock()
+
+	return nil, kp.hashKey
+}
+
+func NewLocalFileKeyProvider(path string) (error, *LocalFileKeyProvider) {
+	kp := &LocalFileKeyProvider{
+		path: path,
+	}
+
+	if err := kp.Reload(); err != nil {
+		return err, nil
+	}
+
+	return nil, kp
+}
+
+func randomVaultKey() (error, string) {
+	key := make([]byte, vaultKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("can not generate rand bytes: %v", err), ""
+	}
+
+	return nil, base64.StdEncoding.EncodeToString(key)
+}
+
+// GenerateLocalKey adds a random key with the given id to the key file and
+// makes it current, creating the file with a new hash key if it does not
+// exist. Older keys are kept for reading until the cards are rotated.
+func GenerateLocalKey(path string, id string) error {
+	file := &localKeyFile{
+		Keys: make(map[string]string),
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if err, file = readLocalKeyFile(path); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("can not stat key file %s: %v", path, err)
+	}
+
+	if _, ok := file.Keys[id]; ok {
+		return fmt.Errorf("key %s already exists in %s: %w", id, path, ErrConflict)
+	}
+
+	if file.HashKey == "" {
+		err, hashKey := randomVaultKey()
+		if err != nil {
+			return err
+		}
+		file.HashKey = hashKey
+	}
+
+	err, key := randomVaultKey()
+	if err != nil {
+		return err
+	}
+
+	if file.Keys == nil {
+		file.Keys = make(map[string]string)
+	}
+	file.Keys[id] = key
+	file.Current = id
+
+	body, err := json.MarshalIndent(file, "", "\t")
+	if err != nil {
+		return fmt.Errorf("can not marshal key file: %v", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".keys")
+	if err != nil {
+		return fmt.Errorf("can not create key file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("can not write key file: %v", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("can not write key file: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("can not replace key file %s: %v", path, err)
+	}
+
+	return nil
+}
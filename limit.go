@@ -0,0 +1,647 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	LIMIT_SCOPE_PROFILE  = "profile"
+	LIMIT_SCOPE_ACCOUNT  = "account"
+	LIMIT_SCOPE_CUSTOMER = "customer"
+	LIMIT_SCOPE_CARD     = "card"
+)
+
+var ErrLimitExceeded = fmt.Errorf("limit exceeded: %w", ErrValidation)
+
+// LimitRule caps the number and/or the amount of transactions within a
+// sliding window of Window seconds. Scope tells what the transactions are
+// counted per: the profile, the account, the customer or the card of the
+// new transaction. Profile and Account, when set, restrict the rule to
+// transactions of that profile or account. MaxAmount is in minor units of
+// Currency and only applies to transactions in that currency.
+type LimitRule struct {
+	Id        *int      `json:"id"`
+	IsEnabled *bool     `json:"is_enabled"`
+	Scope     *string   `json:"scope"`
+	Profile   *Profile  `json:"profile"`
+	Account   *Account  `json:"account"`
+	Window    *int      `json:"window"`
+	MaxCount  *uint     `json:"max_count"`
+	MaxAmount *uint     `json:"max_amount"`
+	Currency  *Currency `json:"currency"`
+}
+
+type LimitRuleSpecification interface {
+	ToSqlClauses() *SqlClauses
+}
+
+type LimitRuleRepository interface {
+	Add(ctx context.Context, rule *LimitRule) error
+	Delete(ctx context.Context, rule *LimitRule) error
+	Update(ctx context.Context, rule *LimitRule) error
+	Query(ctx context.Context, specification LimitRuleSpecification) (error, int, []*LimitRule)
+}
+
+type LimitRuleSpecificationWithLimitAndOffset struct {
+	limit  int
+	offset int
+}
+
+func (lrswlao *LimitRuleSpecificationWithLimitAndOffset) ToSqlClauses() *SqlClauses {
+	return NewSqlLimitAndOffsetClauses(lrswlao.limit, lrswlao.offset)
+}
+
+type LimitRuleSpecificationByID struct {
+	id int
+}
+
+func (lrsbyid *LimitRuleSpecificationByID) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=?", lrsbyid.id)
+}
+
+// LimitRuleSpecificationApplicableTo matches the enabled rules that apply
+// to transactions of the given profile and account.
+type LimitRuleSpecificationApplicableTo struct {
+	profileId *int
+	accountId *int
+}
+
+func (lrsat *LimitRuleSpecificationApplicableTo) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses(
+		"is_enabled and (profile_id is null or profile_id=?) and (account_id is null or account_id=?)",
+		lrsat.profileId,
+		lrsat.accountId,
+	)
+}
+
+func NewLimitRuleSpecificationByID(id int) LimitRuleSpecification {
+	return &LimitRuleSpecificationByID{id: id}
+}
+
+func NewLimitRuleSpecificationApplicableTo(profileId *int, accountId *int) LimitRuleSpecification {
+	return &LimitRuleSpecificationApplicableTo{
+		profileId: profileId,
+		accountId: accountId,
+	}
+}
+
+func NewLimitRuleSpecificationWithLimitAndOffset(limit int, offset int) LimitRuleSpecification {
+	return &LimitRuleSpecificationWithLimitAndOffset{
+		limit:  limit,
+		offset: offset,
+	}
+}
+
+func NewLimitRuleSpecificationAnd(specs ...LimitRuleSpecification) LimitRuleSpecification {
+	l := make([]SqlSpecification, 0, len(specs))
+	for _, spec := range specs {
+		l = append(l, spec)
+	}
+	return &SqlSpecificationAnd{specs: l}
+}
+
+func NewLimitRuleSpecificationOr(specs ...LimitRuleSpecification) LimitRuleSpecification {
+	l := make([]SqlSpecification, 0, len(specs))
+	for _, spec := range specs {
+		l = append(l, spec)
+	}
+	return &SqlSpecificationOr{specs: l}
+}
+
+func NewLimitRuleSpecificationNot(spec LimitRuleSpecification) LimitRuleSpecification {
+	return &SqlSpecificationNot{spec: spec}
+}
+
+var limitRuleOrderColumns = []string{"id", "scope", "profile_id", "account_id", "window_seconds", "currency_id"}
+
+func NewLimitRuleSpecificationOrderBy(spec LimitRuleSpecification, column string, desc bool) LimitRuleSpecification {
+	return &SqlSpecificationOrderBy{
+		spec:   spec,
+		column: column,
+		desc:   desc,
+	}
+}
+
+func NewLimitRuleSpecificationPaged(spec LimitRuleSpecification, limit int, offset int) LimitRuleSpecification {
+	return &SqlSpecificationPaged{
+		spec:   spec,
+		limit:  limit,
+		offset: offset,
+	}
+}
+
+func NewLimitRuleSpecificationWithLoad(spec LimitRuleSpecification, load *LoadOptions) LimitRuleSpecification {
+	return &SqlSpecificationWithLoad{
+		spec: spec,
+		load: load,
+	}
+}
+
+type PGPoolLimitRuleStore struct {
+	pool          *pgxpool.Pool
+	profileStore  ProfileRepository
+	accountStore  AccountRepository
+	currencyStore CurrencyRepository
+	logger        LoggerFunc
+}
+
+func (lrs *PGPoolLimitRuleStore) Add(ctx context.Context, rule *LimitRule) error {
+	var profileId  *int
+	var accountId  *int
+	var currencyId *int
+
+	if rule.Profile != nil {
+		profileId = rule.Profile.Id
+	}
+
+	if rule.Account != nil {
+		accountId = rule.Account.Id
+	}
+
+	if rule.Currency != nil {
+		currencyId = rule.Currency.Id
+	}
+
+	return mapPgError(pgQuerierFromContext(ctx, lrs.pool).QueryRow(
+		ctx,
+		`insert into limit_rules (
+			is_enabled,
+			scope,
+			profile_id,
+			account_id,
+			window_seconds,
+			max_count,
+			max_amount,
+			currency_id
+		) values (COALESCE($1, true), $2, $3, $4, $5, $6, $7, $8) returning id, is_enabled`,
+		rule.IsEnabled,
+		rule.Scope,
+		profileId,
+		accountId,
+		rule.Window,
+		rule.MaxCount,
+		rule.MaxAmount,
+		currencyId,
+	).Scan(&rule.Id, &rule.IsEnabled))
+}
+
+func (lrs *PGPoolLimitRuleStore) refreshLimitRuleForeigns(ctx context.Context, load *LoadOptions, rules ...*LimitRule) error {
+	profileIds := make(idSet)
+	accountIds := make(idSet)
+	currencyIds := make(idSet)
+
+	for _, rule := range rules {
+		if rule.Profile != nil && load.Hydrates("profile") {
+			profileIds.add(rule.Profile.Id)
+		}
+		if rule.Account != nil && load.Hydrates("account") {
+			accountIds.add(rule.Account.Id)
+		}
+		if rule.Currency != nil && load.Hydrates("currency") {
+			currencyIds.add(rule.Currency.Id)
+		}
+	}
+
+	err, profiles := profilesByIds(ctx, lrs.profileStore, profileIds, load.Nested())
+	if err != nil {
+		return fmt.Errorf("Can not update limit rule profile: %w", err)
+	}
+
+	err, accounts := accountsByIds(ctx, lrs.accountStore, accountIds, load.Nested())
+	if err != nil {
+		return fmt.Errorf("Can not update limit rule account: %w", err)
+	}
+
+	err, currencies := currenciesByIds(ctx, lrs.currencyStore, currencyIds)
+	if err != nil {
+		return fmt.Errorf("Can not update limit rule currency: %w", err)
+	}
+
+	for _, rule := range rules {
+		if rule.Profile != nil && rule.Profile.Id != nil {
+			if profile, ok := profiles[*rule.Profile.Id]; ok {
+				rule.Profile = profile
+			}
+		}
+		if rule.Account != nil && rule.Account.Id != nil {
+			if account, ok := accounts[*rule.Account.Id]; ok {
+				rule.Account = account
+			}
+		}
+		if rule.Currency != nil && rule.Currency.Id != nil {
+			if currency, ok := currencies[*rule.Currency.Id]; ok {
+				rule.Currency = currency
+			}
+		}
+	}
+
+	return nil
+}
+
+func (rule *LimitRule) setForeignIds(profileId *int, accountId *int, currencyId *int) {
+	rule.Profile = nil
+	rule.Account = nil
+	rule.Currency = nil
+
+	if profileId != nil {
+		rule.Profile = &Profile{
+			Id: profileId,
+		}
+	}
+	if accountId != nil {
+		rule.Account = &Account{
+			Id: accountId,
+		}
+	}
+	if currencyId != nil {
+		rule.Currency = &Currency{
+			Id: currencyId,
+		}
+	}
+}
+
+func (lrs *PGPoolLimitRuleStore) Query(ctx context.Context, specification LimitRuleSpecification) (error, int, []*LimitRule) {
+	var l []*LimitRule
+	var c int = 0
+
+	conn := pgQuerierFromContext(ctx, lrs.pool)
+	sqlClauses := specification.ToSqlClauses()
+	if err := sqlClauses.checkOrderBy(limitRuleOrderColumns...); err != nil {
+		return err, c, l
+	}
+
+	clauses, args := sqlClauses.Build()
+
+	rows, err := conn.Query(
+		ctx, fmt.Sprintf(
+			`select
+				count(*) over(),
+				id,
+				is_enabled,
+				scope,
+				profile_id,
+				account_id,
+				window_seconds,
+				max_count,
+				max_amount,
+				currency_id
+			from limit_rules %s`,
+			clauses,
+		),
+		args...,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to query limit rules rows: %w", mapPgError(err)), c, l
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rule LimitRule
+		var profileId *int
+		var accountId *int
+		var currencyId *int
+
+		if err = rows.Scan(
+			&c,
+			&rule.Id,
+			&rule.IsEnabled,
+			&rule.Scope,
+			&profileId,
+			&accountId,
+			&rule.Window,
+			&rule.MaxCount,
+			&rule.MaxAmount,
+			&currencyId,
+		); err != nil {
+			return fmt.Errorf("failed to get limit rule row: %w", mapPgError(err)), c, l
+		}
+		rule.setForeignIds(profileId, accountId, currencyId)
+		l = append(l, &rule)
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterating over rows of limit rules: %w", mapPgError(err)), c, l
+	}
+
+	if len(l) == 0 && sqlClauses.Offset != nil && *sqlClauses.Offset > 0 {
+		filter, filterArgs := sqlClauses.Filter().Build()
+
+		err = conn.QueryRow(
+			ctx,
+			fmt.Sprintf("select count(*) from limit_rules %s", filter),
+			filterArgs...,
+		).Scan(&c)
+
+		if err != nil {
+			return fmt.Errorf("failed to get limit rules cnt: %w", mapPgError(err)), c, l
+		}
+	}
+
+	if err := lrs.refreshLimitRuleForeigns(ctx, sqlClauses.Load, l...); err != nil {
+		return fmt.Errorf("Can not update limit rule foreigns: %w", err), c, l
+	}
+
+	return nil, c, l
+}
+
+func (lrs *PGPoolLimitRuleStore) Delete(ctx context.Context, rule *LimitRule) error {
+	var profileId *int
+	var accountId *int
+	var currencyId *int
+
+	err := pgQuerierFromContext(ctx, lrs.pool).QueryRow(
+		ctx,
+		`delete from
+			limit_rules
+		where
+			id=$1
+		returning
+			is_enabled,
+			scope,
+			profile_id,
+			account_id,
+			window_seconds,
+			max_count,
+			max_amount,
+			currency_id`,
+		rule.Id,
+	).Scan(
+		&rule.IsEnabled,
+		&rule.Scope,
+		&profileId,
+		&accountId,
+		&rule.Window,
+		&rule.MaxCount,
+		&rule.MaxAmount,
+		&currencyId,
+	)
+
+	if err != nil {
+		return mapPgError(err)
+	}
+
+	rule.setForeignIds(profileId, accountId, currencyId)
+
+	if err := lrs.refreshLimitRuleForeigns(ctx, nil, rule); err != nil {
+		return fmt.Errorf("Can not update limit rule foreigns: %w", err)
+	}
+
+	return nil
+}
+
+func (lrs *PGPoolLimitRuleStore) Update(ctx context.Context, rule *LimitRule) error {
+	var profileId  *int
+	var accountId  *int
+	var currencyId *int
+
+	if rule.Profile != nil {
+		profileId = rule.Profile.Id
+	}
+
+	if rule.Account != nil {
+		accountId = rule.Account.Id
+	}
+
+	if rule.Currency != nil {
+		currencyId = rule.Currency.Id
+	}
+
+	err := pgQuerierFromContext(ctx, lrs.pool).QueryRow(
+		ctx,
+		`update limit_rules set
+			is_enabled=COALESCE($2, is_enabled),
+			scope=COALESCE($3, scope),
+			profile_id=COALESCE($4, profile_id),
+			account_id=COALESCE($5, account_id),
+			window_seconds=COALESCE($6, window_seconds),
+			max_count=COALESCE($7, max_count),
+			max_amount=COALESCE($8, max_amount),
+			currency_id=COALESCE($9, currency_id)
+		where
+			id=$1
+		returning
+			is_enabled,
+			scope,
+			profile_id,
+			account_id,
+			window_seconds,
+			max_count,
+			max_amount,
+			currency_id`,
+		rule.Id,
+		rule.IsEnabled,
+		rule.Scope,
+		profileId,
+		accountId,
+		rule.Window,
+		rule.MaxCount,
+		rule.MaxAmount,
+		currencyId,
+	).Scan(
+		&rule.IsEnabled,
+		&rule.Scope,
+		&profileId,
+		&accountId,
+		&rule.Window,
+		&rule.MaxCount,
+		&rule.MaxAmount,
+		&currencyId,
+	)
+
+	if err != nil {
+		return mapPgError(err)
+	}
+
+	rule.setForeignIds(profileId, accountId, currencyId)
+
+	if err := lrs.refreshLimitRuleForeigns(ctx, nil, rule); err != nil {
+		return fmt.Errorf("Can not update limit rule foreigns: %w", err)
+	}
+
+	return nil
+}
+
+func NewPGPoolLimitRuleStore(
+	pool          *pgxpool.Pool,
+	profileStore  ProfileRepository,
+	accountStore  AccountRepository,
+	currencyStore CurrencyRepository,
+	logger        LoggerFunc,
+) LimitRuleRepository {
+	return &PGPoolLimitRuleStore{
+		pool:          pool,
+		profileStore:  profileStore,
+		accountStore:  accountStore,
+		currencyStore: currencyStore,
+		logger:        logger,
+	}
+}
+
+// limitedTypes are the transaction types that move money from the
+// cardholder and so count against limits.
+var limitedTypes = []string{AUTH, PREAUTH, REBILL}
+
+type LimitChecker struct {
+	rules        LimitRuleRepository
+	transactions TransactionRepository
+	logger       LoggerFunc
+}
+
+// scopeSpecification selects the transactions sharing the rule scope with
+// the new transaction, ok is false when the transaction has no value for
+// the scope and the rule does not apply. A card is identified by the
+// instrument and the card reference stored with the transaction, which
+// maps one to one to the card token.
+func scopeSpecification(scope string, transaction *Transaction) (TransactionSpecification, bool) {
+	switch scope {
+	case LIMIT_SCOPE_PROFILE:
+		if transaction.Profile != nil && transaction.Profile.Id != nil {
+			return NewTransactionSpecificationByProfileId(*transaction.Profile.Id), true
+		}
+	case LIMIT_SCOPE_ACCOUNT:
+		if transaction.Account != nil && transaction.Account.Id != nil {
+			return NewTransactionSpecificationByAccountId(*transaction.Account.Id), true
+		}
+	case LIMIT_SCOPE_CUSTOMER:
+		if transaction.Customer != nil {
+			return NewTransactionSpecificationByCustomer(*transaction.Customer), true
+		}
+	case LIMIT_SCOPE_CARD:
+		if transaction.Instrument != nil && transaction.Instrument.Id != nil && transaction.InstrumentId != nil {
+			return NewTransactionSpecificationByCard(*transaction.Instrument.Id, *transaction.InstrumentId), true
+		}
+	}
+	return nil, false
+}
+
+func (lc *LimitChecker) checkRule(ctx context.Context, rule *LimitRule, transaction *Transaction, now time.Time) error {
+	if rule.Scope == nil || rule.Window == nil {
+		return nil
+	}
+
+	scopeSpec, ok := scopeSpecification(*rule.Scope, transaction)
+	if !ok {
+		return nil
+	}
+
+	since := now.Add(-time.Duration(*rule.Window) * time.Second)
+	specs := []TransactionSpecification{
+		scopeSpec,
+		NewTransactionSpecificationByTypes(limitedTypes...),
+		NewTransactionSpecificationNot(NewTransactionSpecificationByStatuses(DECLINED)),
+		NewTransactionSpecificationCreatedBetween(&since, nil),
+	}
+
+	if rule.Profile != nil && rule.Profile.Id != nil {
+		specs = append(specs, NewTransactionSpecificationByProfileId(*rule.Profile.Id))
+	}
+
+	if rule.Account != nil && rule.Account.Id != nil {
+		specs = append(specs, NewTransactionSpecificationByAccountId(*rule.Account.Id))
+	}
+
+	err, rows := lc.transactions.TurnOver(ctx, NewTransactionSpecificationAnd(specs...))
+	if err != nil {
+		return fmt.Errorf("Can not get turn over for limit rule with id=%v: %w", *rule.Id, err)
+	}
+
+	var cnt uint = 1
+	amount := NewMoney(0, rule.Currency)
+	requested := transaction.Money()
+	countsAmount := rule.MaxAmount != nil && rule.Currency != nil && sameCurrency(requested.Currency, rule.Currency)
+
+	if countsAmount {
+		amount = requested
+	}
+
+	for _, row := range rows {
+		cnt += row.Cnt
+		if countsAmount && sameCurrency(row.Sum.Currency, rule.Currency) {
+			if err, amount = amount.Add(row.Sum); err != nil {
+				return fmt.Errorf("limit rule with id=%v: %w", *rule.Id, ErrLimitExceeded)
+			}
+		}
+	}
+
+	if rule.MaxCount != nil && cnt > *rule.MaxCount {
+		return fmt.Errorf(
+			"limit rule with id=%v allows %d transactions per %s of %s: %w",
+			*rule.Id,
+			*rule.MaxCount,
+			time.Duration(*rule.Window)*time.Second,
+			*rule.Scope,
+			ErrLimitExceeded,
+		)
+	}
+
+	if countsAmount && amount.Amount > *rule.MaxAmount {
+		return fmt.Errorf(
+			"limit rule with id=%v allows %s per %s of %s: %w",
+			*rule.Id,
+			NewMoney(*rule.MaxAmount, rule.Currency),
+			time.Duration(*rule.Window)*time.Second,
+			*rule.Scope,
+			ErrLimitExceeded,
+		)
+	}
+
+	return nil
+}
+
+// Check evaluates the rules applicable to the new transaction against the
+// turnover already stored, counting the new transaction in. Declined
+// transactions do not count. Transactions added concurrently may each pass
+// the check, so limits are enforced up to that race.
+func (lc *LimitChecker) Check(ctx context.Context, transaction *Transaction) error {
+	var profileId, accountId *int
+
+	if transaction.Profile != nil {
+		profileId = transaction.Profile.Id
+	}
+
+	if transaction.Account != nil {
+		accountId = transaction.Account.Id
+	}
+
+	err, _, rules := lc.rules.Query(
+		ctx,
+		NewLimitRuleSpecificationWithLoad(
+			NewLimitRuleSpecificationApplicableTo(profileId, accountId),
+			NewLoadOptions(LoadIDsOnly),
+		),
+	)
+
+	if err != nil {
+		return fmt.Errorf("Can not get limit rules: %w", err)
+	}
+
+	if len(rules) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	for _, rule := range rules {
+		if err := lc.checkRule(ctx, rule, transaction, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewLimitChecker(
+	rules        LimitRuleRepository,
+	transactions TransactionRepository,
+	logger       LoggerFunc,
+) *LimitChecker {
+	return &LimitChecker{
+		rules:        rules,
+		transactions: transactions,
+		logger:       logger,
+	}
+}
@@ -0,0 +1,199 @@
+package repository
+
+import (
+	"fmt"
+	"sort"
+	"embed"
+	"regexp"
+	"context"
+	"strconv"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// arbitrary key of the advisory lock serializing concurrent migration runners
+const migrationsLockKey = 7263548190
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+func Migrations() (error, []*Migration) {
+	var l []*Migration
+	byVersion := make(map[int]*Migration)
+
+	entries, err := migrationsFS.ReadDir("migrations")
+	if err != nil {
+		return fmt.Errorf("can not read migrations: %v", err), l
+	}
+
+	for _, entry := range entries {
+		m := migrationFileRegexp.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return fmt.Errorf("unexpected migration file name: %s", entry.Name()), l
+		}
+
+		version, err := strconv.Atoi(m[1])
+		if err != nil {
+			return fmt.Errorf("can not parse migration version %s: %v", m[1], err), l
+		}
+
+		body, err := migrationsFS.ReadFile(fmt.Sprintf("migrations/%s", entry.Name()))
+		if err != nil {
+			return fmt.Errorf("can not read migration %s: %v", entry.Name(), err), l
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{
+				Version: version,
+				Name:    m[2],
+			}
+			byVersion[version] = migration
+			l = append(l, migration)
+		}
+
+		if m[3] == "up" {
+			migration.Up = string(body)
+		} else {
+			migration.Down = string(body)
+		}
+	}
+
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Version < l[j].Version
+	})
+
+	return nil, l
+}
+
+func ensureMigrationsTable(ctx context.Context, pool *pgxpool.Pool) error {
+	_, err := pool.Exec(
+		ctx,
+		`create table if not exists schema_migrations (
+			version integer primary key,
+			name    text not null,
+			applied timestamptz not null default now()
+		)`,
+	)
+
+	return mapPgError(err)
+}
+
+func applyMigration(ctx context.Context, pool *pgxpool.Pool, migration *Migration, up bool) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("can not begin migration transaction: %w", mapPgError(err))
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "select pg_advisory_xact_lock($1)", migrationsLockKey); err != nil {
+		return fmt.Errorf("can not lock migrations: %w", mapPgError(err))
+	}
+
+	var applied bool
+	err = tx.QueryRow(
+		ctx,
+		"select exists(select 1 from schema_migrations where version=$1)",
+		migration.Version,
+	).Scan(&applied)
+
+	if err != nil {
+		return fmt.Errorf("can not check migration %d: %w", migration.Version, mapPgError(err))
+	}
+
+	if applied == up {
+		return nil
+	}
+
+	if up {
+		if _, err := tx.Exec(ctx, migration.Up); err != nil {
+			return fmt.Errorf("can not apply migration %d_%s: %w", migration.Version, migration.Name, mapPgError(err))
+		}
+		_, err = tx.Exec(
+			ctx,
+			"insert into schema_migrations (version, name) values ($1, $2)",
+			migration.Version,
+			migration.Name,
+		)
+	} else {
+		if _, err := tx.Exec(ctx, migration.Down); err != nil {
+			return fmt.Errorf("can not revert migration %d_%s: %w", migration.Version, migration.Name, mapPgError(err))
+		}
+		_, err = tx.Exec(ctx, "delete from schema_migrations where version=$1", migration.Version)
+	}
+
+	if err != nil {
+		return fmt.Errorf("can not record migration %d: %w", migration.Version, mapPgError(err))
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("can not commit migration %d: %w", migration.Version, mapPgError(err))
+	}
+
+	return nil
+}
+
+// MigrateUp applies every embedded migration not yet recorded in
+// schema_migrations, oldest first.
+func MigrateUp(ctx context.Context, pool *pgxpool.Pool) error {
+	err, migrations := Migrations()
+	if err != nil {
+		return err
+	}
+
+	if err := ensureMigrationsTable(ctx, pool); err != nil {
+		return fmt.Errorf("can not create migrations table: %w", err)
+	}
+
+	for _, migration := range migrations {
+		if err := applyMigration(ctx, pool, migration, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first.
+func MigrateDown(ctx context.Context, pool *pgxpool.Pool, steps int) error {
+	err, migrations := Migrations()
+	if err != nil {
+		return err
+	}
+
+	if err := ensureMigrationsTable(ctx, pool); err != nil {
+		return fmt.Errorf("can not create migrations table: %w", err)
+	}
+
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		var applied bool
+		err := pool.QueryRow(
+			ctx,
+			"select exists(select 1 from schema_migrations where version=$1)",
+			migrations[i].Version,
+		).Scan(&applied)
+
+		if err != nil {
+			return fmt.Errorf("can not check migration %d: %w", migrations[i].Version, mapPgError(err))
+		}
+
+		if !applied {
+			continue
+		}
+
+		if err := applyMigration(ctx, pool, migrations[i], false); err != nil {
+			return err
+		}
+		steps--
+	}
+
+	return nil
+}
@@ -0,0 +1,8 @@
+drop table transactions;
+drop table routes;
+drop table accounts;
+drop table profiles;
+drop table routers;
+drop table instruments;
+drop table channels;
+drop table currencies;
@@ -0,0 +1,94 @@
+create table currencies (
+	id           serial primary key,
+	numeric_code integer not null unique,
+	name         text not null,
+	char_code    text not null unique,
+	exponent     integer not null default 2
+);
+
+create table channels (
+	id      integer primary key,
+	type_id integer not null,
+	key     text not null unique
+);
+
+create table instruments (
+	id  integer primary key,
+	key text not null unique
+);
+
+create table routers (
+	id  integer primary key,
+	key text not null unique
+);
+
+create table profiles (
+	id          serial primary key,
+	key         text not null unique,
+	description text,
+	currency_id integer references currencies (id)
+);
+
+create table accounts (
+	id                          serial primary key,
+	is_enabled                  boolean default true,
+	is_test                     boolean default false,
+	rebill_enabled              boolean default false,
+	refund_enabled              boolean default false,
+	reversal_enabled            boolean default false,
+	partial_confirm_enabled     boolean default false,
+	partial_reversal_enabled    boolean default false,
+	partial_refund_enabled      boolean default false,
+	currency_conversion_enabled boolean default false,
+	currency_id                 integer references currencies (id),
+	channel_id                  integer references channels (id),
+	settings                    jsonb
+);
+
+create index accounts_currency_id_idx on accounts (currency_id);
+create index accounts_channel_id_idx on accounts (channel_id);
+
+create table routes (
+	id            serial primary key,
+	profile_id    integer references profiles (id),
+	instrument_id integer references instruments (id),
+	account_id    integer references accounts (id),
+	router_id     integer references routers (id),
+	settings      jsonb
+);
+
+create index routes_profile_id_instrument_id_idx on routes (profile_id, instrument_id);
+create index routes_account_id_idx on routes (account_id);
+create index routes_router_id_idx on routes (router_id);
+
+create table transactions (
+	id                    bigserial primary key,
+	created               timestamptz not null default now(),
+	type                  text not null,
+	status                text not null,
+	profile_id            integer references profiles (id),
+	account_id            integer references accounts (id),
+	instrument_id         integer references instruments (id),
+	instrument            integer,
+	amount                bigint check (amount >= 0),
+	currency_id           integer references currencies (id),
+	amount_converted      bigint check (amount_converted >= 0),
+	currency_converted_id integer references currencies (id),
+	authcode              text,
+	rrn                   text,
+	response_code         text,
+	remote_id             text,
+	order_id              text,
+	reference_id          bigint references transactions (id),
+	threedsecure10        jsonb,
+	threedsecure20        jsonb,
+	threedsmethodurl      jsonb,
+	error_message         text,
+	additional_data       jsonb,
+	customer              text,
+	browser_info          jsonb
+);
+
+create index transactions_reference_id_status_idx on transactions (reference_id, status);
+create index transactions_profile_id_created_idx on transactions (profile_id, created);
+create index transactions_account_id_created_idx on transactions (account_id, created);
@@ -0,0 +1,5 @@
+alter table transactions
+	drop column conversion_rate,
+	drop column conversion_rate_id;
+
+drop table rates;
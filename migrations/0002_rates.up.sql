@@ -0,0 +1,13 @@
+create table rates (
+	id               serial primary key,
+	from_currency_id integer not null references currencies (id),
+	to_currency_id   integer not null references currencies (id),
+	value            numeric not null check (value > 0),
+	valid_from       timestamptz not null default now()
+);
+
+create index rates_from_currency_id_to_currency_id_valid_from_idx on rates (from_currency_id, to_currency_id, valid_from);
+
+alter table transactions
+	add column conversion_rate_id integer references rates (id) on delete set null,
+	add column conversion_rate    numeric;
@@ -0,0 +1,3 @@
+alter table rates
+	drop constraint rates_valid_interval_check,
+	drop column valid_to;
@@ -0,0 +1,3 @@
+alter table rates
+	add column valid_to timestamptz,
+	add constraint rates_valid_interval_check check (valid_to is null or valid_to > valid_from);
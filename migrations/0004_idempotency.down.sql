@@ -0,0 +1,5 @@
+drop index transactions_profile_id_idempotency_key_idx;
+
+alter table transactions
+	drop column request_hash,
+	drop column idempotency_key;
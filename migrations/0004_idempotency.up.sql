@@ -0,0 +1,5 @@
+alter table transactions
+	add column idempotency_key text,
+	add column request_hash    text;
+
+create unique index transactions_profile_id_idempotency_key_idx on transactions (profile_id, idempotency_key) where idempotency_key is not null;
@@ -0,0 +1,11 @@
+alter table transactions
+	drop column updated,
+	drop column version;
+
+alter table routes
+	drop column updated,
+	drop column version;
+
+alter table accounts
+	drop column updated,
+	drop column version;
@@ -0,0 +1,11 @@
+alter table accounts
+	add column version integer not null default 1,
+	add column updated timestamptz not null default now();
+
+alter table routes
+	add column version integer not null default 1,
+	add column updated timestamptz not null default now();
+
+alter table transactions
+	add column version integer not null default 1,
+	add column updated timestamptz not null default now();
@@ -0,0 +1,8 @@
+drop index transactions_amount_idx;
+drop index transactions_status_type_created_idx;
+drop index transactions_created_idx;
+drop index transactions_customer_created_idx;
+drop index transactions_authcode_idx;
+drop index transactions_rrn_idx;
+drop index transactions_remote_id_idx;
+drop index transactions_order_id_idx;
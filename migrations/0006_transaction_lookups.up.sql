@@ -0,0 +1,8 @@
+create index transactions_order_id_idx on transactions (order_id);
+create index transactions_remote_id_idx on transactions (remote_id);
+create index transactions_rrn_idx on transactions (rrn);
+create index transactions_authcode_idx on transactions (authcode);
+create index transactions_customer_created_idx on transactions (customer, created);
+create index transactions_created_idx on transactions (created);
+create index transactions_status_type_created_idx on transactions (status, type, created);
+create index transactions_amount_idx on transactions (amount);
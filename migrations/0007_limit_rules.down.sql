@@ -0,0 +1,2 @@
+drop index transactions_instrument_id_instrument_created_idx;
+drop table limit_rules;
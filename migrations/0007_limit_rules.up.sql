@@ -0,0 +1,16 @@
+create table limit_rules (
+	id             serial primary key,
+	is_enabled     boolean not null default true,
+	scope          text not null check (scope in ('profile', 'account', 'customer', 'card')),
+	profile_id     integer references profiles (id),
+	account_id     integer references accounts (id),
+	window_seconds integer not null check (window_seconds > 0),
+	max_count      bigint check (max_count >= 0),
+	max_amount     bigint check (max_amount >= 0),
+	currency_id    integer references currencies (id),
+	check (max_count is not null or max_amount is not null),
+	check (max_amount is null or currency_id is not null)
+);
+
+create index limit_rules_profile_id_account_id_idx on limit_rules (profile_id, account_id);
+create index transactions_instrument_id_instrument_created_idx on transactions (instrument_id, instrument, created);
@@ -0,0 +1 @@
+drop table transaction_events;
@@ -0,0 +1,17 @@
+create table transaction_events (
+	id              bigserial primary key,
+	created         timestamptz not null default now(),
+	transaction_id  bigint not null references transactions (id),
+	type            text not null,
+	status          text not null,
+	previous_status text,
+	version         integer not null,
+	payload         jsonb not null,
+	attempts        integer not null default 0,
+	next_attempt    timestamptz not null default now(),
+	last_error      text,
+	published       timestamptz
+);
+
+create index transaction_events_unpublished_idx on transaction_events (next_attempt, id) where published is null;
+create index transaction_events_transaction_id_idx on transaction_events (transaction_id, id) where published is null;
@@ -0,0 +1,15 @@
+create table cards (
+	id       serial primary key,
+	created  timestamptz not null default now(),
+	updated  timestamptz not null default now(),
+	token    text not null unique,
+	pan_hash text not null,
+	pan      bytea not null,
+	holder   bytea,
+	exp_date date,
+	key_id   text not null,
+	data_key bytea not null
+);
+
+create index cards_pan_hash_idx on cards (pan_hash);
+create index cards_key_id_idx on cards (key_id);
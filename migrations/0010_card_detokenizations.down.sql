@@ -0,0 +1 @@
+drop table card_detokenizations;
@@ -0,0 +1,13 @@
+create table card_detokenizations (
+	id            bigserial primary key,
+	created       timestamptz not null default now(),
+	token_hash    text not null,
+	card_id       integer,
+	actor         text not null,
+	purpose       text not null,
+	outcome       text not null check (outcome in ('granted', 'not_found', 'failed')),
+	error_message text
+);
+
+create index card_detokenizations_card_id_created_idx on card_detokenizations (card_id, created);
+create index card_detokenizations_token_hash_idx on card_detokenizations (token_hash);
@@ -0,0 +1,161 @@
+package repository
+
+import (
+	"fmt"
+	"strings"
+	"strconv"
+	"math/bits"
+)
+
+var (
+	ErrCurrencyMismatch = fmt.Errorf("currency mismatch: %w", ErrValidation)
+	ErrAmountOverflow   = fmt.Errorf("amount out of range: %w", ErrValidation)
+)
+
+// Money is an amount in minor units of its currency, so 12345 of a
+// currency with exponent 2 is 123.45.
+type Money struct {
+	Amount   uint      `json:"amount"`
+	Currency *Currency `json:"currency"`
+}
+
+func NewMoney(amount uint, currency *Currency) Money {
+	return Money{
+		Amount:   amount,
+		Currency: currency,
+	}
+}
+
+func (m Money) exponent() int {
+	if m.Currency == nil || m.Currency.Exponent == nil {
+		return 0
+	}
+	return *m.Currency.Exponent
+}
+
+func (m Money) sameCurrency(o Money) error {
+	if !sameCurrency(m.Currency, o.Currency) {
+		return fmt.Errorf("%s and %s: %w", m, o, ErrCurrencyMismatch)
+	}
+	return nil
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) Add(o Money) (error, Money) {
+	if err := m.sameCurrency(o); err != nil {
+		return err, m
+	}
+
+	sum, carry := bits.Add(m.Amount, o.Amount, 0)
+	if carry != 0 {
+		return fmt.Errorf("%s + %s: %w", m, o, ErrAmountOverflow), m
+	}
+
+	return nil, NewMoney(sum, m.Currency)
+}
+
+func (m Money) Sub(o Money) (error, Money) {
+	if err := m.sameCurrency(o); err != nil {
+		return err, m
+	}
+
+	diff, borrow := bits.Sub(m.Amount, o.Amount, 0)
+	if borrow != 0 {
+		return fmt.Errorf("%s - %s: %w", m, o, ErrAmountOverflow), m
+	}
+
+	return nil, NewMoney(diff, m.Currency)
+}
+
+func (m Money) Mul(n uint) (error, Money) {
+	hi, lo := bits.Mul(m.Amount, n)
+	if hi != 0 {
+		return fmt.Errorf("%s * %d: %w", m, n, ErrAmountOverflow), m
+	}
+
+	return nil, NewMoney(lo, m.Currency)
+}
+
+// Cmp returns -1, 0 or +1 as m is less than, equal to or greater than o.
+func (m Money) Cmp(o Money) (error, int) {
+	if err := m.sameCurrency(o); err != nil {
+		return err, 0
+	}
+
+	switch {
+	case m.Amount < o.Amount:
+		return nil, -1
+	case m.Amount > o.Amount:
+		return nil, 1
+	}
+	return nil, 0
+}
+
+// Decimal formats the amount in major units, e.g. "123.45".
+func (m Money) Decimal() string {
+	s := strconv.FormatUint(uint64(m.Amount), 10)
+
+	exp := m.exponent()
+	if exp == 0 {
+		return s
+	}
+
+	if len(s) <= exp {
+		s = strings.Repeat("0", exp-len(s)+1) + s
+	}
+
+	return s[:len(s)-exp] + "." + s[len(s)-exp:]
+}
+
+// String formats the amount with the currency char code, e.g. "123.45 USD".
+func (m Money) String() string {
+	if m.Currency == nil || m.Currency.CharCode == nil {
+		return m.Decimal()
+	}
+	return fmt.Sprintf("%s %s", m.Decimal(), *m.Currency.CharCode)
+}
+
+// ParseMoney parses an amount in major units, optionally followed by the
+// currency char code, e.g. "123.45" or "123.45 USD". The amount may not have
+// more fractional digits than the currency exponent.
+func ParseMoney(s string, currency *Currency) (error, Money) {
+	m := NewMoney(0, currency)
+	fields := strings.Fields(s)
+
+	switch len(fields) {
+	case 1:
+	case 2:
+		if currency == nil || currency.CharCode == nil || !strings.EqualFold(fields[1], *currency.CharCode) {
+			return fmt.Errorf("money %q: %w", s, ErrCurrencyMismatch), m
+		}
+	default:
+		return fmt.Errorf("invalid money %q: %w", s, ErrValidation), m
+	}
+
+	exp := m.exponent()
+	whole, frac := fields[0], ""
+	if i := strings.IndexByte(whole, '.'); i >= 0 {
+		whole, frac = whole[:i], whole[i+1:]
+	}
+
+	if len(frac) > exp {
+		return fmt.Errorf("money %q has more than %d fractional digits: %w", s, exp, ErrValidation), m
+	}
+
+	digits := whole + frac + strings.Repeat("0", exp-len(frac))
+	if whole == "" || strings.TrimLeft(digits, "0123456789") != "" {
+		return fmt.Errorf("invalid money %q: %w", s, ErrValidation), m
+	}
+
+	amount, err := strconv.ParseUint(digits, 10, bits.UintSize)
+	if err != nil {
+		return fmt.Errorf("money %q: %w", s, ErrAmountOverflow), m
+	}
+
+	m.Amount = uint(amount)
+
+	return nil, m
+}
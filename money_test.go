@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"math/bits"
+)
+
+func testCurrency(code string, exponent int) *Currency {
+	return &Currency{CharCode: &code, Exponent: &exponent}
+}
+
+func TestParseMoney(t *testing.T) {
+	usd, jpy := testCurrency("USD", 2), testCurrency("JPY", 0)
+	maxUint := strconv.FormatUint(uint64(^uint(0)), 10)
+
+	cases := []struct {
+		s        string
+		currency *Currency
+		amount   uint
+		err      error
+	}{
+		{"123.45", usd, 12345, nil},
+		{"123.4", usd, 12340, nil},
+		{"123", usd, 12300, nil},
+		{"1.", usd, 100, nil},
+		{"0.05", usd, 5, nil},
+		{"007", jpy, 7, nil},
+		{"123.45 USD", usd, 12345, nil},
+		{"123.45 usd", usd, 12345, nil},
+		{"  5  ", usd, 500, nil},
+		{maxUint, jpy, ^uint(0), nil},
+		{".5", usd, 0, ErrValidation},
+		{"1.234", usd, 0, ErrValidation},
+		{"1.5", jpy, 0, ErrValidation},
+		{"", usd, 0, ErrValidation},
+		{"-1", usd, 0, ErrValidation},
+		{"+1", usd, 0, ErrValidation},
+		{"1,5", usd, 0, ErrValidation},
+		{"1.2.3", usd, 0, ErrValidation},
+		{"1e3", usd, 0, ErrValidation},
+		{"1 USD EUR", usd, 0, ErrValidation},
+		{"123.45 EUR", usd, 0, ErrCurrencyMismatch},
+		{"123 JPY", nil, 0, ErrCurrencyMismatch},
+		{maxUint + "0", jpy, 0, ErrAmountOverflow},
+		{maxUint, usd, 0, ErrAmountOverflow},
+	}
+
+	for _, c := range cases {
+		err, m := ParseMoney(c.s, c.currency)
+
+		if c.err != nil {
+			if !errors.Is(err, c.err) {
+				t.Errorf("ParseMoney(%q): got %v, want %v", c.s, err, c.err)
+			}
+			continue
+		}
+
+		if err != nil || m.Amount != c.amount || m.Currency != c.currency {
+			t.Errorf("ParseMoney(%q) = %d, %v, want %d", c.s, m.Amount, err, c.amount)
+		}
+	}
+}
+
+func TestMoneyDecimal(t *testing.T) {
+	usd, jpy, kwd := testCurrency("USD", 2), testCurrency("JPY", 0), testCurrency("KWD", 3)
+
+	cases := []struct {
+		m    Money
+		want string
+	}{
+		{NewMoney(12345, usd), "123.45 USD"},
+		{NewMoney(5, usd), "0.05 USD"},
+		{NewMoney(0, usd), "0.00 USD"},
+		{NewMoney(7, jpy), "7 JPY"},
+		{NewMoney(1, kwd), "0.001 KWD"},
+		{NewMoney(42, nil), "42"},
+	}
+
+	for _, c := range cases {
+		if got := c.m.String(); got != c.want {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+
+		if c.m.Currency == nil {
+			continue
+		}
+
+		err, parsed := ParseMoney(c.m.String(), c.m.Currency)
+		if err != nil || parsed.Amount != c.m.Amount {
+			t.Errorf("%q does not parse back: %d, %v", c.want, parsed.Amount, err)
+		}
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	usd, eur := testCurrency("USD", 2), testCurrency("EUR", 2)
+	largest := NewMoney(^uint(0), usd)
+
+	err, m := NewMoney(150, usd).Add(NewMoney(250, usd))
+	if err != nil || m.Amount != 400 || m.Currency != usd {
+		t.Errorf("add = %s, %v", m, err)
+	}
+
+	err, m = NewMoney(250, usd).Sub(NewMoney(250, usd))
+	if err != nil || !m.IsZero() {
+		t.Errorf("sub = %s, %v", m, err)
+	}
+
+	err, m = NewMoney(250, usd).Mul(3)
+	if err != nil || m.Amount != 750 {
+		t.Errorf("mul = %s, %v", m, err)
+	}
+
+	if err, _ := largest.Add(NewMoney(1, usd)); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("add overflow: got %v", err)
+	}
+
+	if err, _ := NewMoney(1, usd).Sub(NewMoney(2, usd)); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("sub underflow: got %v", err)
+	}
+
+	if err, _ := NewMoney(1<<(bits.UintSize/2), usd).Mul(1 << (bits.UintSize / 2)); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("mul overflow: got %v", err)
+	}
+
+	if err, m := largest.Mul(1); err != nil || m.Amount != largest.Amount {
+		t.Errorf("mul by one = %s, %v", m, err)
+	}
+
+	if err, _ := NewMoney(1, usd).Add(NewMoney(1, eur)); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("add mismatch: got %v", err)
+	}
+
+	if err, _ := NewMoney(1, usd).Sub(NewMoney(1, eur)); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("sub mismatch: got %v", err)
+	}
+
+	if err, _ := NewMoney(1, usd).Cmp(NewMoney(1, eur)); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("cmp mismatch: got %v", err)
+	}
+
+	if err, c := NewMoney(1, usd).Cmp(NewMoney(2, usd)); err != nil || c != -1 {
+		t.Errorf("cmp = %d, %v", c, err)
+	}
+}
@@ -0,0 +1,394 @@
+package repository
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"context"
+	"strconv"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	TRANSACTION_CREATED        = "transaction.created"
+	TRANSACTION_STATUS_CHANGED = "transaction.status_changed"
+	TRANSACTION_UPDATED        = "transaction.updated"
+)
+
+// TransactionEvent is a change of a transaction recorded in the outbox.
+// Payload is the transaction as stored when the event was recorded.
+type TransactionEvent struct {
+	Id             *int            `json:"id"`
+	TransactionId  *int            `json:"transaction_id"`
+	Type           *string         `json:"type"`
+	Status         *string         `json:"status"`
+	PreviousStatus *string         `json:"previous_status"`
+	Version        *int            `json:"version"`
+	Payload        json.RawMessage `json:"payload"`
+	Created        *time.Time      `json:"created"`
+	Attempts       int             `json:"attempts"`
+}
+
+// EventSink delivers events to downstream consumers. An event may be
+// published more than once, consumers deduplicate by its Id.
+type EventSink interface {
+	Publish(ctx context.Context, event *TransactionEvent) error
+}
+
+// enqueueEvent records the current state of the transaction in the outbox.
+// It must run in the database transaction that changed the row, so the
+// event is stored if and only if the change is.
+func (ts *PGPoolTransactionStore) enqueueEvent(ctx context.Context, transaction *Transaction, eventType string, previousStatus *string) error {
+	_, err := pgQuerierFromContext(ctx, ts.pool).Exec(
+		ctx,
+		`insert into transaction_events (
+			transaction_id,
+			type,
+			status,
+			previous_status,
+			version,
+			payload
+		)
+		select
+			t.id,
+			$2,
+			t.status,
+			$3,
+			t.version,
+			jsonb_build_object(
+				'id', t.id,
+				'created', t.created,
+				'updated', t.updated,
+				'version', t.version,
+				'type', t.type,
+				'status', t.status,
+				'profile_id', t.profile_id,
+				'account_id', t.account_id,
+				'amount', t.amount,
+				'currency', c.char_code,
+				'amount_converted', t.amount_converted,
+				'currency_converted', cc.char_code,
+				'conversion_rate', t.conversion_rate::text,
+				'reference_id', t.reference_id,
+				'order_id', t.order_id,
+				'remote_id', t.remote_id,
+				'rrn', t.rrn,
+				'auth_code', t.authcode,
+				'response_code', t.response_code,
+				'error_message', t.error_message,
+				'customer', t.customer
+			)
+		from transactions t
+		left join currencies c on c.id=t.currency_id
+		left join currencies cc on cc.id=t.currency_converted_id
+		where
+			t.id=$1`,
+		transaction.Id,
+		eventType,
+		previousStatus,
+	)
+
+	if err != nil {
+		return fmt.Errorf("Can not enqueue %s event of transaction with id=%v: %w", eventType, *transaction.Id, mapPgError(err))
+	}
+
+	return nil
+}
+
+type OutboxRelay struct {
+	pool       *pgxpool.Pool
+	sink       EventSink
+	batchSize  int
+	lease      time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	logger     LoggerFunc
+}
+
+func (r *OutboxRelay) backoff(attempts int) time.Duration {
+	backoff := r.minBackoff
+	for i := 1; i < attempts && backoff < r.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.maxBackoff {
+		backoff = r.maxBackoff
+	}
+	return backoff
+}
+
+// RelayOnce publishes a batch of due events and returns how many were
+// delivered. The batch is claimed by pushing its next attempt one lease
+// ahead, so other relays skip it while it is published outside of any
+// database transaction. Each event is then marked published or rescheduled
+// on its own, only after the sink answered, so a crash in between makes it
+// published again once the lease runs out. Events of a transaction are
+// delivered in order: an event is not claimed until the earlier ones of the
+// same transaction are delivered.
+func (r *OutboxRelay) RelayOnce(ctx context.Context) (error, int) {
+	var published int
+
+	if r.batchSize <= 0 {
+		return fmt.Errorf("batch size %d is not positive: %w", r.batchSize, ErrValidation), published
+	}
+
+	conn := pgQuerierFromContext(ctx, r.pool)
+
+	rows, err := conn.Query(
+		ctx,
+		`update transaction_events set
+			next_attempt=now()+$2::interval
+		where id in (
+			select e.id
+			from transaction_events e
+			where
+				e.published is null and
+				e.next_attempt<=now() and
+				not exists (
+					select 1
+					from transaction_events p
+					where
+						p.transaction_id=e.transaction_id and
+						p.published is null and
+						p.id<e.id
+				)
+			order by e.id
+			limit $1
+			for update skip locked
+		)
+		returning
+			id,
+			transaction_id,
+			type,
+			status,
+			previous_status,
+			version,
+			payload,
+			created,
+			attempts`,
+		r.batchSize,
+		r.lease,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to claim transaction events rows: %w", mapPgError(err)), published
+	}
+	defer rows.Close()
+
+	var events []*TransactionEvent
+
+	for rows.Next() {
+		var event TransactionEvent
+		var payload []byte
+
+		if err := rows.Scan(
+			&event.Id,
+			&event.TransactionId,
+			&event.Type,
+			&event.Status,
+			&event.PreviousStatus,
+			&event.Version,
+			&payload,
+			&event.Created,
+			&event.Attempts,
+		); err != nil {
+			return fmt.Errorf("failed to get transaction event row: %w", mapPgError(err)), published
+		}
+
+		event.Payload = json.RawMessage(payload)
+		events = append(events, &event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterating over rows of transaction events: %w", mapPgError(err)), published
+	}
+	rows.Close()
+
+	// returning does not keep the order of the claim
+	sort.Slice(events, func(i, j int) bool {
+		return *events[i].Id < *events[j].Id
+	})
+
+	for _, event := range events {
+		event.Attempts++
+
+		if err := r.sink.Publish(ctx, event); err != nil {
+			r.logger(ctx).Printf("Can not publish transaction event with id=%v: %v", *event.Id, err)
+
+			_, err = conn.Exec(
+				ctx,
+				`update transaction_events set
+					attempts=$2,
+					next_attempt=now()+$3::interval,
+					last_error=$4
+				where
+					id=$1`,
+				event.Id,
+				event.Attempts,
+				r.backoff(event.Attempts),
+				err.Error(),
+			)
+
+			if err != nil {
+				return fmt.Errorf("Can not update transaction event with id=%v: %w", *event.Id, mapPgError(err)), published
+			}
+
+			continue
+		}
+
+		_, err := conn.Exec(
+			ctx,
+			"update transaction_events set attempts=$2, published=now(), last_error=null where id=$1",
+			event.Id,
+			event.Attempts,
+		)
+
+		if err != nil {
+			return fmt.Errorf("Can not update transaction event with id=%v: %w", *event.Id, mapPgError(err)), published
+		}
+
+		published++
+	}
+
+	return nil, published
+}
+
+// Run relays events every interval until ctx is done. A full batch is
+// followed by the next one immediately.
+func (r *OutboxRelay) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err, published := r.RelayOnce(ctx)
+		if err != nil {
+			r.logger(ctx).Printf("Can not relay transaction events: %v", err)
+		}
+
+		if err == nil && published > 0 && published == r.batchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// NewOutboxRelay makes a relay claiming batchSize events at a time. The
+// lease has to outlast publishing a whole batch, otherwise another relay
+// may claim the same events and publish them twice.
+func NewOutboxRelay(
+	pool       *pgxpool.Pool,
+	sink       EventSink,
+	batchSize  int,
+	lease      time.Duration,
+	minBackoff time.Duration,
+	maxBackoff time.Duration,
+	logger     LoggerFunc,
+) *OutboxRelay {
+	return &OutboxRelay{
+		pool:       pool,
+		sink:       sink,
+		batchSize:  batchSize,
+		lease:      lease,
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+		logger:     logger,
+	}
+}
+
+type InMemoryEventSink struct {
+	mu     sync.Mutex
+	events []*TransactionEvent
+}
+
+func (s *InMemoryEventSink) Publish(ctx context.Context, event *TransactionEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, event)
+
+	return nil
+}
+
+// Events returns the events published so far.
+func (s *InMemoryEventSink) Events() []*TransactionEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := make([]*TransactionEvent, len(s.events))
+	copy(events, s.events)
+
+	return events
+}
+
+func NewInMemoryEventSink() *InMemoryEventSink {
+	return &InMemoryEventSink{}
+}
+
+// HttpWebhookEventSink posts every event as JSON to url. Any non 2xx answer
+// is a failed delivery and is retried. The event id is sent in the
+// Idempotency-Key header for deduplication on the receiving side.
+type HttpWebhookEventSink struct {
+	url     string
+	client  *http.Client
+	headers map[string]string
+	logger  LoggerFunc
+}
+
+func (s *HttpWebhookEventSink) Publish(ctx context.Context, event *TransactionEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("can not marshal transaction event: %v", err)
+	}
+
+	s.logger(ctx).Printf("Posting %s event with id=%v to %s", *event.Type, *event.Id, s.url)
+	r, err := http.NewRequestWithContext(ctx, "POST", s.url, strings.NewReader(string(body)))
+	if err != nil {
+		return fmt.Errorf("can not make new request: %v", err)
+	}
+
+	r.Header.Add("Content-Type", "application/json; charset=utf-8")
+	r.Header.Add("Content-Length", strconv.Itoa(len(body)))
+	r.Header.Add("Idempotency-Key", strconv.Itoa(*event.Id))
+	for name, value := range s.headers {
+		r.Header.Add(name, value)
+	}
+
+	res, err := s.client.Do(r)
+	if err != nil {
+		return fmt.Errorf("can not do request: %w", NewRepositoryError(ErrUnavailable, err))
+	}
+	defer res.Body.Close()
+
+	if _, err := ioutil.ReadAll(res.Body); err != nil {
+		return fmt.Errorf("can not read body: %v", err)
+	}
+
+	if err := httpStatusError(res.StatusCode); err != nil {
+		return fmt.Errorf("webhook failed: %w", err)
+	}
+
+	return nil
+}
+
+func NewHttpWebhookEventSink(
+	url     string,
+	client  *http.Client,
+	headers map[string]string,
+	logger  LoggerFunc,
+) EventSink {
+	return &HttpWebhookEventSink{
+		url:     url,
+		client:  client,
+		headers: headers,
+		logger:  logger,
+	}
+}
@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"context"
+	"strings"
+	"testing"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgconn"
+)
+
+func TestOutboxRelayRejectsEmptyBatch(t *testing.T) {
+	relay := NewOutboxRelay(nil, NewInMemoryEventSink(), 0, time.Minute, time.Second, time.Minute, testLogger)
+
+	if err, _ := relay.RelayOnce(context.Background()); !errors.Is(err, ErrValidation) {
+		t.Fatalf("relay with batch size 0 = %v, want validation error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		relay.Run(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("run did not return after the context was done")
+	}
+}
+
+// outboxTx answers the claim of RelayOnce with rows out of id order and
+// records the statements run after it.
+type outboxTx struct {
+	pgx.Tx
+
+	claimed [][]interface{}
+	begins  int
+	execs   []string
+	sink    *recordingSink
+}
+
+func (tx *outboxTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	tx.begins++
+	return tx, nil
+}
+
+func (tx *outboxTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	if !strings.HasPrefix(sql, "update transaction_events set") {
+		return nil, fmt.Errorf("unexpected query %q", sql)
+	}
+	return &fakeRows{values: tx.claimed}, nil
+}
+
+func (tx *outboxTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	if len(tx.sink.published) == 0 {
+		return nil, fmt.Errorf("event marked before any was published")
+	}
+
+	state := "published"
+	if strings.Contains(sql, "last_error=$4") {
+		state = "rescheduled"
+	}
+	tx.execs = append(tx.execs, fmt.Sprintf("%d %s", *args[0].(*int), state))
+
+	return nil, nil
+}
+
+type recordingSink struct {
+	published []int
+	fail      int
+}
+
+func (s *recordingSink) Publish(ctx context.Context, event *TransactionEvent) error {
+	s.published = append(s.published, *event.Id)
+	if *event.Id == s.fail {
+		return fmt.Errorf("webhook is down")
+	}
+	return nil
+}
+
+func TestOutboxRelayPublishesOutsideTransaction(t *testing.T) {
+	sink := &recordingSink{fail: 2}
+	tx := &outboxTx{sink: sink}
+	for _, id := range []int{3, 1, 2} {
+		tx.claimed = append(tx.claimed, []interface{}{id, id + 10, TRANSACTION_CREATED, "new", nil, 1, []byte("{}"), time.Now(), 0})
+	}
+
+	ctx := context.WithValue(context.Background(), pgTxKey{}, pgx.Tx(tx))
+	relay := NewOutboxRelay(nil, sink, 10, time.Minute, time.Second, time.Minute, testLogger)
+
+	err, published := relay.RelayOnce(ctx)
+	if err != nil || published != 2 {
+		t.Fatalf("relay = %d, %v, want 2", published, err)
+	}
+
+	if tx.begins != 0 {
+		t.Errorf("relay opened %d database transactions", tx.begins)
+	}
+
+	if fmt.Sprint(sink.published) != "[1 2 3]" {
+		t.Errorf("published %v, want in id order", sink.published)
+	}
+
+	want := "[1 published 2 rescheduled 3 published]"
+	if fmt.Sprint(tx.execs) != want {
+		t.Errorf("marked %v, want %s", tx.execs, want)
+	}
+}
@@ -2,10 +2,10 @@ package repository
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"context"
 	"github.com/wk8/go-ordered-map"
-	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
@@ -18,14 +18,14 @@ type Profile struct {
 
 type ProfileSpecification interface {
 	Specified(profile *Profile, i int) bool
-	ToSqlClauses() string
+	ToSqlClauses() *SqlClauses
 }
 
 type ProfileRepository interface {
-	Add(ctx interface{}, profile *Profile) error
-	Delete(ctx interface{}, profile *Profile) (error, bool)
-	Update(ctx interface{}, profile *Profile) (error, bool)
-	Query(ctx interface{}, specification ProfileSpecification) (error, int, []*Profile)
+	Add(ctx context.Context, profile *Profile) error
+	Delete(ctx context.Context, profile *Profile) error
+	Update(ctx context.Context, profile *Profile) error
+	Query(ctx context.Context, specification ProfileSpecification) (error, int, []*Profile)
 }
 
 type ProfileSpecificationWithLimitAndOffset struct {
@@ -34,11 +34,12 @@ type ProfileSpecificationWithLimitAndOffset struct {
 }
 
 func (pswlao *ProfileSpecificationWithLimitAndOffset) Specified(profile *Profile, i int) bool {
-	return i >= pswlao.offset && i < pswlao.offset + pswlao.limit
+	// paging is applied by the store once the matched profiles are ordered
+	return true
 }
 
-func (pswlao *ProfileSpecificationWithLimitAndOffset) ToSqlClauses() string {
-	return fmt.Sprintf("limit %d offset %d", pswlao.limit, pswlao.offset)
+func (pswlao *ProfileSpecificationWithLimitAndOffset) ToSqlClauses() *SqlClauses {
+	return NewSqlLimitAndOffsetClauses(pswlao.limit, pswlao.offset)
 }
 
 type ProfileSpecificationByID struct {
@@ -49,8 +50,25 @@ func (psbyid *ProfileSpecificationByID) Specified(profile *Profile, i int) bool
 	return psbyid.id == *profile.Id
 }
 
-func (psbyid *ProfileSpecificationByID) ToSqlClauses() string {
-	return fmt.Sprintf("where id=%d", psbyid.id)
+func (psbyid *ProfileSpecificationByID) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=?", psbyid.id)
+}
+
+type ProfileSpecificationByIDs struct {
+	ids []int
+}
+
+func (psbyids *ProfileSpecificationByIDs) Specified(profile *Profile, i int) bool {
+	for _, id := range psbyids.ids {
+		if id == *profile.Id {
+			return true
+		}
+	}
+	return false
+}
+
+func (psbyids *ProfileSpecificationByIDs) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=any(?)", psbyids.ids)
 }
 
 type ProfileSpecificationByKey struct {
@@ -61,8 +79,129 @@ func (psbykey *ProfileSpecificationByKey) Specified(profile *Profile, i int) boo
 	return psbykey.key == *profile.Key
 }
 
-func (psbykey *ProfileSpecificationByKey) ToSqlClauses() string {
-	return fmt.Sprintf("where key='%s'", psbykey.key)
+func (psbykey *ProfileSpecificationByKey) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("key=?", psbykey.key)
+}
+
+type ProfileSpecificationAnd struct {
+	specs []ProfileSpecification
+}
+
+func (psand *ProfileSpecificationAnd) Specified(profile *Profile, i int) bool {
+	for _, spec := range psand.specs {
+		if !spec.Specified(profile, i) {
+			return false
+		}
+	}
+	return true
+}
+
+func (psand *ProfileSpecificationAnd) ToSqlClauses() *SqlClauses {
+	var clauses []*SqlClauses
+	for _, spec := range psand.specs {
+		clauses = append(clauses, spec.ToSqlClauses())
+	}
+	return andSqlClauses(clauses...)
+}
+
+type ProfileSpecificationOr struct {
+	specs []ProfileSpecification
+}
+
+func (psor *ProfileSpecificationOr) Specified(profile *Profile, i int) bool {
+	for _, spec := range psor.specs {
+		if spec.Specified(profile, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (psor *ProfileSpecificationOr) ToSqlClauses() *SqlClauses {
+	var clauses []*SqlClauses
+	for _, spec := range psor.specs {
+		clauses = append(clauses, spec.ToSqlClauses())
+	}
+	return orSqlClauses(clauses...)
+}
+
+type ProfileSpecificationNot struct {
+	spec ProfileSpecification
+}
+
+func (psnot *ProfileSpecificationNot) Specified(profile *Profile, i int) bool {
+	return !psnot.spec.Specified(profile, i)
+}
+
+func (psnot *ProfileSpecificationNot) ToSqlClauses() *SqlClauses {
+	return notSqlClauses(psnot.spec.ToSqlClauses())
+}
+
+type ProfileSpecificationOrderBy struct {
+	spec   ProfileSpecification
+	column string
+	desc   bool
+}
+
+func (psob *ProfileSpecificationOrderBy) Specified(profile *Profile, i int) bool {
+	return psob.spec.Specified(profile, i)
+}
+
+func (psob *ProfileSpecificationOrderBy) ToSqlClauses() *SqlClauses {
+	return orderBySqlClauses(psob.spec.ToSqlClauses(), psob.column, psob.desc)
+}
+
+type ProfileSpecificationPaged struct {
+	spec   ProfileSpecification
+	limit  int
+	offset int
+}
+
+func (psp *ProfileSpecificationPaged) Specified(profile *Profile, i int) bool {
+	return psp.spec.Specified(profile, i)
+}
+
+func (psp *ProfileSpecificationPaged) ToSqlClauses() *SqlClauses {
+	return pagedSqlClauses(psp.spec.ToSqlClauses(), psp.limit, psp.offset)
+}
+
+type ProfileSpecificationWithLoad struct {
+	spec ProfileSpecification
+	load *LoadOptions
+}
+
+func (pswl *ProfileSpecificationWithLoad) Specified(profile *Profile, i int) bool {
+	return pswl.spec.Specified(profile, i)
+}
+
+func (pswl *ProfileSpecificationWithLoad) ToSqlClauses() *SqlClauses {
+	return loadSqlClauses(pswl.spec.ToSqlClauses(), pswl.load)
+}
+
+var profileOrderColumns = []string{"id", "key", "description"}
+
+func compareProfiles(a *Profile, b *Profile, column string) int {
+	switch column {
+	case "id":
+		return compareIntPtr(a.Id, b.Id)
+	case "key":
+		return compareStringPtr(a.Key, b.Key)
+	case "description":
+		return compareStringPtr(a.Description, b.Description)
+	}
+	return 0
+}
+
+func sortProfiles(profiles []*Profile, orderBy []SqlOrder) {
+	sort.SliceStable(profiles, func(i, j int) bool {
+		for _, order := range orderBy {
+			c := compareProfiles(profiles[i], profiles[j], order.Column)
+			if c != 0 {
+				return (c < 0) != order.Desc
+			}
+		}
+		return false
+	})
 }
 
 type OrderedMapProfileStore struct {
@@ -74,7 +213,7 @@ type OrderedMapProfileStore struct {
 	logger        LoggerFunc
 }
 
-func (ps *OrderedMapProfileStore) Add(ctx interface{}, profile *Profile) error {
+func (ps *OrderedMapProfileStore) Add(ctx context.Context, profile *Profile) error {
 	ps.Lock()
 	defer ps.Unlock()
 
@@ -86,41 +225,38 @@ func (ps *OrderedMapProfileStore) Add(ctx interface{}, profile *Profile) error {
 	return nil
 }
 
-func (ps *OrderedMapProfileStore) refreshProfileCurrency(ctx interface{}, profile *Profile) error {
-	if !(profile.Currency != nil && profile.Currency.Id != nil) {
-		return nil
-	}
-
-	err, _, currencies := ps.currencyStore.Query(ctx, NewCurrencySpecificationByID(
-		*profile.Currency.Id,
-	))
+func (ps *OrderedMapProfileStore) refreshProfileForeigns(ctx context.Context, load *LoadOptions, profiles ...*Profile) error {
+	currencyIds := make(idSet)
 
-	if err != nil {
-		return fmt.Errorf("Can not update profile currency: %v", err)
+	for _, profile := range profiles {
+		if profile.Currency != nil && load.Hydrates("currency") {
+			currencyIds.add(profile.Currency.Id)
+		}
 	}
 
-	for _, currency := range currencies {
-		profile.Currency = currency
+	err, currencies := currenciesByIds(ctx, ps.currencyStore, currencyIds)
+	if err != nil {
+		return fmt.Errorf("Can not update profile currency: %w", err)
 	}
 
-	return nil
-}
-
-func (ps *OrderedMapProfileStore) refreshProfileForeigns(ctx interface{}, profile *Profile) error {
-	if err := ps.refreshProfileCurrency(ctx, profile); err != nil {
-		return err
+	for _, profile := range profiles {
+		if profile.Currency != nil && profile.Currency.Id != nil {
+			if currency, ok := currencies[*profile.Currency.Id]; ok {
+				profile.Currency = currency
+			}
+		}
 	}
 
 	return nil
 }
 
-func (ps *OrderedMapProfileStore) Delete(ctx interface{}, profile *Profile) (error, bool) {
+func (ps *OrderedMapProfileStore) Delete(ctx context.Context, profile *Profile) error {
 	ps.Lock()
 	defer ps.Unlock()
 
 	value, present := ps.profiles.Delete(*profile.Id)
 	if !present {
-		return fmt.Errorf("profile with id=%v not found", *profile.Id), true
+		return fmt.Errorf("profile with id=%v: %w", *profile.Id, ErrNotFound)
 	}
 
 	deleted := value.(Profile)
@@ -128,20 +264,20 @@ func (ps *OrderedMapProfileStore) Delete(ctx interface{}, profile *Profile) (err
 	profile.Description = deleted.Description
 	profile.Currency = deleted.Currency
 
-	if err := ps.refreshProfileForeigns(ctx, profile); err != nil {
-		return fmt.Errorf("Can not update profile foreigns: %v", err), false
+	if err := ps.refreshProfileForeigns(ctx, nil, profile); err != nil {
+		return fmt.Errorf("Can not update profile foreigns: %w", err)
 	}
 
-	return nil, false
+	return nil
 }
 
-func (ps *OrderedMapProfileStore) Update(ctx interface{}, profile *Profile) (error, bool) {
+func (ps *OrderedMapProfileStore) Update(ctx context.Context, profile *Profile) error {
 	ps.Lock()
 	defer ps.Unlock()
 
 	value, present := ps.profiles.Get(*profile.Id)
 	if !present {
-		return fmt.Errorf("profile with id=%v not found", *profile.Id), true
+		return fmt.Errorf("profile with id=%v: %w", *profile.Id, ErrNotFound)
 	}
 
 	old := value.(Profile)
@@ -166,14 +302,14 @@ func (ps *OrderedMapProfileStore) Update(ctx interface{}, profile *Profile) (err
 
 	ps.profiles.Set(*old.Id, old)
 
-	if err := ps.refreshProfileForeigns(ctx, profile); err != nil {
-		return fmt.Errorf("Can not update profile foreigns: %v", err), false
+	if err := ps.refreshProfileForeigns(ctx, nil, profile); err != nil {
+		return fmt.Errorf("Can not update profile foreigns: %w", err)
 	}
 
-	return nil, false
+	return nil
 }
 
-func (ps *OrderedMapProfileStore) Query(ctx interface{}, specification ProfileSpecification) (error, int, []*Profile) {
+func (ps *OrderedMapProfileStore) Query(ctx context.Context, specification ProfileSpecification) (error, int, []*Profile) {
 	ps.Lock()
 	defer ps.Unlock()
 
@@ -183,15 +319,26 @@ func (ps *OrderedMapProfileStore) Query(ctx interface{}, specification ProfileSp
 	for el := ps.profiles.Oldest(); el != nil; el = el.Next() {
 		profile := el.Value.(Profile)
 		if specification.Specified(&profile, c) {
-			if err := ps.refreshProfileForeigns(ctx, &profile); err != nil {
-				return fmt.Errorf("Can not update profile foreigns: %v", err), c, l
-			}
 			l = append(l, &profile)
 		}
 		c++
 	}
 
-	return nil, ps.profiles.Len(), l
+	c = len(l)
+	clauses := specification.ToSqlClauses()
+	if err := clauses.checkOrderBy(profileOrderColumns...); err != nil {
+		return err, 0, nil
+	}
+
+	sortProfiles(l, clauses.OrderBy)
+	start, end := pageBounds(clauses, c)
+	l = l[start:end]
+
+	if err := ps.refreshProfileForeigns(ctx, clauses.Load, l...); err != nil {
+		return fmt.Errorf("Can not update profile foreigns: %w", err), c, l
+	}
+
+	return nil, c, l
 }
 
 func NewOrderedMapProfileStore(
@@ -213,6 +360,12 @@ func NewProfileSpecificationByID(id int) ProfileSpecification {
 	}
 }
 
+func NewProfileSpecificationByIDs(ids []int) ProfileSpecification {
+	return &ProfileSpecificationByIDs{
+		ids: ids,
+	}
+}
+
 func NewProfileSpecificationByKey(key string) ProfileSpecification {
 	return &ProfileSpecificationByKey{
 		key: key,
@@ -226,21 +379,79 @@ func NewProfileSpecificationWithLimitAndOffset(limit int, offset int) ProfileSpe
 	}
 }
 
+func NewProfileSpecificationAnd(specs ...ProfileSpecification) ProfileSpecification {
+	return &ProfileSpecificationAnd{specs: specs}
+}
+
+func NewProfileSpecificationOr(specs ...ProfileSpecification) ProfileSpecification {
+	return &ProfileSpecificationOr{specs: specs}
+}
+
+func NewProfileSpecificationNot(spec ProfileSpecification) ProfileSpecification {
+	return &ProfileSpecificationNot{spec: spec}
+}
+
+func NewProfileSpecificationOrderBy(spec ProfileSpecification, column string, desc bool) ProfileSpecification {
+	return &ProfileSpecificationOrderBy{
+		spec:   spec,
+		column: column,
+		desc:   desc,
+	}
+}
+
+func NewProfileSpecificationPaged(spec ProfileSpecification, limit int, offset int) ProfileSpecification {
+	return &ProfileSpecificationPaged{
+		spec:   spec,
+		limit:  limit,
+		offset: offset,
+	}
+}
+
+func NewProfileSpecificationWithLoad(spec ProfileSpecification, load *LoadOptions) ProfileSpecification {
+	return &ProfileSpecificationWithLoad{
+		spec: spec,
+		load: load,
+	}
+}
+
+func profilesByIds(ctx context.Context, store ProfileRepository, ids idSet, load *LoadOptions) (error, map[int]*Profile) {
+	m := make(map[int]*Profile)
+	if len(ids) == 0 {
+		return nil, m
+	}
+
+	specification := NewProfileSpecificationByIDs(ids.slice())
+	if load != nil {
+		specification = NewProfileSpecificationWithLoad(specification, load)
+	}
+
+	err, _, profiles := store.Query(ctx, specification)
+	if err != nil {
+		return err, m
+	}
+
+	for _, profile := range profiles {
+		m[*profile.Id] = profile
+	}
+
+	return nil, m
+}
+
 type PGPoolProfileStore struct {
 	pool          *pgxpool.Pool
 	currencyStore CurrencyRepository
 	logger        LoggerFunc
 }
 
-func (ps *PGPoolProfileStore) Add(ctx interface{}, profile *Profile) error {
+func (ps *PGPoolProfileStore) Add(ctx context.Context, profile *Profile) error {
 	var currencyId *int
 
 	if profile.Currency != nil {
 		currencyId = profile.Currency.Id
 	}
 
-	return ps.pool.QueryRow(
-		context.Background(),
+	return mapPgError(pgQuerierFromContext(ctx, ps.pool).QueryRow(
+		ctx,
 		`insert into profiles (
 			key,
 			description,
@@ -249,42 +460,39 @@ func (ps *PGPoolProfileStore) Add(ctx interface{}, profile *Profile) error {
 		profile.Key,
 		profile.Description,
 		currencyId,
-	).Scan(&profile.Id)
+	).Scan(&profile.Id))
 }
 
-func (ps *PGPoolProfileStore) refreshProfileCurrency(ctx interface{}, profile *Profile) error {
-	if !(profile.Currency != nil && profile.Currency.Id != nil) {
-		return nil
-	}
+func (ps *PGPoolProfileStore) refreshProfileForeigns(ctx context.Context, load *LoadOptions, profiles ...*Profile) error {
+	currencyIds := make(idSet)
 
-	err, _, currencies := ps.currencyStore.Query(ctx, NewCurrencySpecificationByID(
-		*profile.Currency.Id,
-	))
-
-	if err != nil {
-		return fmt.Errorf("Can not update profile currency: %v", err)
+	for _, profile := range profiles {
+		if profile.Currency != nil && load.Hydrates("currency") {
+			currencyIds.add(profile.Currency.Id)
+		}
 	}
 
-	for _, currency := range currencies {
-		profile.Currency = currency
+	err, currencies := currenciesByIds(ctx, ps.currencyStore, currencyIds)
+	if err != nil {
+		return fmt.Errorf("Can not update profile currency: %w", err)
 	}
 
-	return nil
-}
-
-func (ps *PGPoolProfileStore) refreshProfileForeigns(ctx interface{}, profile *Profile) error {
-	if err := ps.refreshProfileCurrency(ctx, profile); err != nil {
-		return err
+	for _, profile := range profiles {
+		if profile.Currency != nil && profile.Currency.Id != nil {
+			if currency, ok := currencies[*profile.Currency.Id]; ok {
+				profile.Currency = currency
+			}
+		}
 	}
 
 	return nil
 }
 
-func (ps *PGPoolProfileStore) Delete(ctx interface{}, profile *Profile) (error, bool) {
+func (ps *PGPoolProfileStore) Delete(ctx context.Context, profile *Profile) error {
 	var currencyId *int
 
-	err := ps.pool.QueryRow(
-		context.Background(),
+	err := pgQuerierFromContext(ctx, ps.pool).QueryRow(
+		ctx,
 		`delete from
 			profiles
 		where
@@ -300,53 +508,51 @@ func (ps *PGPoolProfileStore) Delete(ctx interface{}, profile *Profile) (error,
 		&currencyId,
 	)
 
+	if err != nil {
+		return mapPgError(err)
+	}
+
 	if currencyId != nil {
 		profile.Currency = &Currency{
 			Id: currencyId,
 		}
 	}
 
-	if e := ps.refreshProfileForeigns(ctx, profile); e != nil {
-		return fmt.Errorf("Can not update profile foreigns: %v", e), err == pgx.ErrNoRows
+	if err := ps.refreshProfileForeigns(ctx, nil, profile); err != nil {
+		return fmt.Errorf("Can not update profile foreigns: %w", err)
 	}
 
-	return err, err == pgx.ErrNoRows
+	return nil
 }
 
-func (ps *PGPoolProfileStore) Query(ctx interface{}, specification ProfileSpecification) (error, int, []*Profile) {
+func (ps *PGPoolProfileStore) Query(ctx context.Context, specification ProfileSpecification) (error, int, []*Profile) {
 	var l []*Profile
 	var c int = 0
 
-	conn, err := ps.pool.Acquire(context.Background())
-
-	if err != nil {
-		return fmt.Errorf("failed to acquire connection from the pool: %v", err), c, l
+	conn := pgQuerierFromContext(ctx, ps.pool)
+	sqlClauses := specification.ToSqlClauses()
+	if err := sqlClauses.checkOrderBy(profileOrderColumns...); err != nil {
+		return err, c, l
 	}
-	defer conn.Release()
-
-	err = conn.QueryRow(
-		context.Background(),
-		"select count(*) from profiles",
-	).Scan(&c)
 
-	if err != nil {
-		return fmt.Errorf("failed to get profiles cnt: %v", err), c, l
-	}
+	clauses, args := sqlClauses.Build()
 
 	rows, err := conn.Query(
-		context.Background(), fmt.Sprintf(
+		ctx, fmt.Sprintf(
 			`select
+				count(*) over(),
 				id,
 				key,
 				description,
 				currency_id
 			from profiles %s`,
-			specification.ToSqlClauses(),
+			clauses,
 		),
+		args...,
 	)
 
 	if err != nil {
-		return fmt.Errorf("failed to query profiles rows: %v", err), c, l
+		return fmt.Errorf("failed to query profiles rows: %w", mapPgError(err)), c, l
 	}
 	defer rows.Close()
 
@@ -355,40 +561,56 @@ func (ps *PGPoolProfileStore) Query(ctx interface{}, specification ProfileSpecif
 		var currencyId *int
 
 		if err = rows.Scan(
+			&c,
 			&profile.Id,
 			&profile.Key,
 			&profile.Description,
 			&currencyId,
 		); err != nil {
-			return fmt.Errorf("failed to get profile row: %v", err), c, l
+			return fmt.Errorf("failed to get profile row: %w", mapPgError(err)), c, l
 		}
 		if currencyId != nil {
 			profile.Currency = &Currency{
 				Id: currencyId,
 			}
 		}
-		if err := ps.refreshProfileForeigns(ctx, &profile); err != nil {
-			return fmt.Errorf("Can not update profile foreigns: %v", err), c, l
-		}
 		l = append(l, &profile)
 	}
 
 	if err = rows.Err(); err != nil {
-		return fmt.Errorf("failed to iterating over rows of profiles: %v", err), c, l
+		return fmt.Errorf("failed to iterating over rows of profiles: %w", mapPgError(err)), c, l
+	}
+
+	if len(l) == 0 && sqlClauses.Offset != nil && *sqlClauses.Offset > 0 {
+		filter, filterArgs := sqlClauses.Filter().Build()
+
+		err = conn.QueryRow(
+			ctx,
+			fmt.Sprintf("select count(*) from profiles %s", filter),
+			filterArgs...,
+		).Scan(&c)
+
+		if err != nil {
+			return fmt.Errorf("failed to get profiles cnt: %w", mapPgError(err)), c, l
+		}
+	}
+
+	if err := ps.refreshProfileForeigns(ctx, sqlClauses.Load, l...); err != nil {
+		return fmt.Errorf("Can not update profile foreigns: %w", err), c, l
 	}
 
 	return nil, c, l
 }
 
-func (ps *PGPoolProfileStore) Update(ctx interface{}, profile *Profile) (error, bool) {
+func (ps *PGPoolProfileStore) Update(ctx context.Context, profile *Profile) error {
 	var currencyId *int
 
 	if profile.Currency != nil {
 		currencyId = profile.Currency.Id
 	}
 
-	err := ps.pool.QueryRow(
-		context.Background(),
+	err := pgQuerierFromContext(ctx, ps.pool).QueryRow(
+		ctx,
 		`update profiles set
 			key=COALESCE($2, key),
 			description=COALESCE($3, description),
@@ -409,17 +631,21 @@ func (ps *PGPoolProfileStore) Update(ctx interface{}, profile *Profile) (error,
 		&currencyId,
 	)
 
+	if err != nil {
+		return mapPgError(err)
+	}
+
 	if currencyId != nil {
 		profile.Currency = &Currency{
 			Id: currencyId,
 		}
 	}
 
-	if e := ps.refreshProfileForeigns(ctx, profile); e != nil {
-		return fmt.Errorf("Can not update profile foreigns: %v", e), err == pgx.ErrNoRows
+	if err := ps.refreshProfileForeigns(ctx, nil, profile); err != nil {
+		return fmt.Errorf("Can not update profile foreigns: %w", err)
 	}
 
-	return err, err == pgx.ErrNoRows
+	return nil
 }
 
 func NewPGPoolProfileStore(
@@ -0,0 +1,846 @@
+package repository
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"context"
+	"strings"
+	"math/big"
+	"github.com/wk8/go-ordered-map"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Rate is the price of one major unit of From expressed in major units of
+// To. Value is kept as a decimal string so it round trips without loss.
+// The rate is in effect from ValidFrom up to, but not including, ValidTo;
+// an empty ValidTo means the rate has not been superseded.
+type Rate struct {
+	Id        *int       `json:"id"`
+	From      *Currency  `json:"from"`
+	To        *Currency  `json:"to"`
+	Value     *string    `json:"value"`
+	ValidFrom *time.Time `json:"valid_from"`
+	ValidTo   *time.Time `json:"valid_to"`
+}
+
+type RateSpecification interface {
+	Specified(rate *Rate, i int) bool
+	ToSqlClauses() *SqlClauses
+}
+
+type RateRepository interface {
+	Add(ctx context.Context, rate *Rate) error
+	Delete(ctx context.Context, rate *Rate) error
+	Update(ctx context.Context, rate *Rate) error
+	Query(ctx context.Context, specification RateSpecification) (error, int, []*Rate)
+}
+
+type RateSpecificationWithLimitAndOffset struct {
+	limit  int
+	offset int
+}
+
+func (rswlao *RateSpecificationWithLimitAndOffset) Specified(rate *Rate, i int) bool {
+	// paging is applied by the store once the matched rates are ordered
+	return true
+}
+
+func (rswlao *RateSpecificationWithLimitAndOffset) ToSqlClauses() *SqlClauses {
+	return NewSqlLimitAndOffsetClauses(rswlao.limit, rswlao.offset)
+}
+
+type RateSpecificationByID struct {
+	id int
+}
+
+func (rsbyid *RateSpecificationByID) Specified(rate *Rate, i int) bool {
+	return rsbyid.id == *rate.Id
+}
+
+func (rsbyid *RateSpecificationByID) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=?", rsbyid.id)
+}
+
+type RateSpecificationByIDs struct {
+	ids []int
+}
+
+func (rsbyids *RateSpecificationByIDs) Specified(rate *Rate, i int) bool {
+	for _, id := range rsbyids.ids {
+		if id == *rate.Id {
+			return true
+		}
+	}
+	return false
+}
+
+func (rsbyids *RateSpecificationByIDs) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=any(?)", rsbyids.ids)
+}
+
+type RateSpecificationByCurrencies struct {
+	fromId int
+	toId   int
+}
+
+func (rsbyc *RateSpecificationByCurrencies) Specified(rate *Rate, i int) bool {
+	return rate.From != nil && rate.From.Id != nil && *rate.From.Id == rsbyc.fromId &&
+		rate.To != nil && rate.To.Id != nil && *rate.To.Id == rsbyc.toId
+}
+
+func (rsbyc *RateSpecificationByCurrencies) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("from_currency_id=? and to_currency_id=?", rsbyc.fromId, rsbyc.toId)
+}
+
+type RateSpecificationValidAt struct {
+	at time.Time
+}
+
+func (rsva *RateSpecificationValidAt) Specified(rate *Rate, i int) bool {
+	return rate.ValidFrom != nil && !rate.ValidFrom.After(rsva.at) &&
+		(rate.ValidTo == nil || rate.ValidTo.After(rsva.at))
+}
+
+func (rsva *RateSpecificationValidAt) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("valid_from<=? and (valid_to is null or valid_to>?)", rsva.at, rsva.at)
+}
+
+type RateSpecificationAnd struct {
+	specs []RateSpecification
+}
+
+func (rsand *RateSpecificationAnd) Specified(rate *Rate, i int) bool {
+	for _, spec := range rsand.specs {
+		if !spec.Specified(rate, i) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rsand *RateSpecificationAnd) ToSqlClauses() *SqlClauses {
+	var clauses []*SqlClauses
+	for _, spec := range rsand.specs {
+		clauses = append(clauses, spec.ToSqlClauses())
+	}
+	return andSqlClauses(clauses...)
+}
+
+type RateSpecificationOr struct {
+	specs []RateSpecification
+}
+
+func (rsor *RateSpecificationOr) Specified(rate *Rate, i int) bool {
+	for _, spec := range rsor.specs {
+		if spec.Specified(rate, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rsor *RateSpecificationOr) ToSqlClauses() *SqlClauses {
+	var clauses []*SqlClauses
+	for _, spec := range rsor.specs {
+		clauses = append(clauses, spec.ToSqlClauses())
+	}
+	return orSqlClauses(clauses...)
+}
+
+type RateSpecificationNot struct {
+	spec RateSpecification
+}
+
+func (rsnot *RateSpecificationNot) Specified(rate *Rate, i int) bool {
+	return !rsnot.spec.Specified(rate, i)
+}
+
+func (rsnot *RateSpecificationNot) ToSqlClauses() *SqlClauses {
+	return notSqlClauses(rsnot.spec.ToSqlClauses())
+}
+
+type RateSpecificationOrderBy struct {
+	spec   RateSpecification
+	column string
+	desc   bool
+}
+
+func (rsob *RateSpecificationOrderBy) Specified(rate *Rate, i int) bool {
+	return rsob.spec.Specified(rate, i)
+}
+
+func (rsob *RateSpecificationOrderBy) ToSqlClauses() *SqlClauses {
+	return orderBySqlClauses(rsob.spec.ToSqlClauses(), rsob.column, rsob.desc)
+}
+
+type RateSpecificationPaged struct {
+	spec   RateSpecification
+	limit  int
+	offset int
+}
+
+func (rsp *RateSpecificationPaged) Specified(rate *Rate, i int) bool {
+	return rsp.spec.Specified(rate, i)
+}
+
+func (rsp *RateSpecificationPaged) ToSqlClauses() *SqlClauses {
+	return pagedSqlClauses(rsp.spec.ToSqlClauses(), rsp.limit, rsp.offset)
+}
+
+type RateSpecificationWithLoad struct {
+	spec RateSpecification
+	load *LoadOptions
+}
+
+func (rswl *RateSpecificationWithLoad) Specified(rate *Rate, i int) bool {
+	return rswl.spec.Specified(rate, i)
+}
+
+func (rswl *RateSpecificationWithLoad) ToSqlClauses() *SqlClauses {
+	return loadSqlClauses(rswl.spec.ToSqlClauses(), rswl.load)
+}
+
+var rateOrderColumns = []string{"id", "valid_from", "valid_to"}
+
+func compareRates(a *Rate, b *Rate, column string) int {
+	switch column {
+	case "id":
+		return compareIntPtr(a.Id, b.Id)
+	case "valid_from":
+		return compareTimePtr(a.ValidFrom, b.ValidFrom)
+	case "valid_to":
+		return compareTimePtr(a.ValidTo, b.ValidTo)
+	}
+	return 0
+}
+
+func sortRates(rates []*Rate, orderBy []SqlOrder) {
+	sort.SliceStable(rates, func(i, j int) bool {
+		for _, order := range orderBy {
+			c := compareRates(rates[i], rates[j], order.Column)
+			if c != 0 {
+				return (c < 0) != order.Desc
+			}
+		}
+		return false
+	})
+}
+
+func refreshRateCurrencies(ctx context.Context, store CurrencyRepository, load *LoadOptions, rates ...*Rate) error {
+	currencyIds := make(idSet)
+
+	for _, rate := range rates {
+		if rate.From != nil && load.Hydrates("from") {
+			currencyIds.add(rate.From.Id)
+		}
+		if rate.To != nil && load.Hydrates("to") {
+			currencyIds.add(rate.To.Id)
+		}
+	}
+
+	err, currencies := currenciesByIds(ctx, store, currencyIds)
+	if err != nil {
+		return fmt.Errorf("Can not update rate currencies: %w", err)
+	}
+
+	for _, rate := range rates {
+		if rate.From != nil && rate.From.Id != nil {
+			if currency, ok := currencies[*rate.From.Id]; ok {
+				rate.From = currency
+			}
+		}
+		if rate.To != nil && rate.To.Id != nil {
+			if currency, ok := currencies[*rate.To.Id]; ok {
+				rate.To = currency
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateRateInterval(rate *Rate) error {
+	if rate.ValidFrom != nil && rate.ValidTo != nil && !rate.ValidTo.After(*rate.ValidFrom) {
+		return fmt.Errorf("rate valid_to must be after valid_from: %w", ErrValidation)
+	}
+	return nil
+}
+
+type OrderedMapRateStore struct {
+	sync.Mutex
+
+	rates         *orderedmap.OrderedMap
+	nextId        int
+	currencyStore CurrencyRepository
+	logger        LoggerFunc
+}
+
+func (rs *OrderedMapRateStore) Add(ctx context.Context, rate *Rate) error {
+	rs.Lock()
+	defer rs.Unlock()
+
+	if rate.ValidFrom == nil {
+		now := time.Now()
+		rate.ValidFrom = &now
+	}
+
+	if err := validateRateInterval(rate); err != nil {
+		return err
+	}
+
+	id := rs.nextId
+	rate.Id = &id
+	rs.rates.Set(*rate.Id, *rate)
+	rs.nextId++
+
+	return nil
+}
+
+func (rs *OrderedMapRateStore) Delete(ctx context.Context, rate *Rate) error {
+	rs.Lock()
+	defer rs.Unlock()
+
+	value, present := rs.rates.Delete(*rate.Id)
+	if !present {
+		return fmt.Errorf("rate with id=%v: %w", *rate.Id, ErrNotFound)
+	}
+
+	deleted := value.(Rate)
+	rate.From = deleted.From
+	rate.To = deleted.To
+	rate.Value = deleted.Value
+	rate.ValidFrom = deleted.ValidFrom
+	rate.ValidTo = deleted.ValidTo
+
+	if err := refreshRateCurrencies(ctx, rs.currencyStore, nil, rate); err != nil {
+		return fmt.Errorf("Can not update rate foreigns: %w", err)
+	}
+
+	return nil
+}
+
+func (rs *OrderedMapRateStore) Update(ctx context.Context, rate *Rate) error {
+	rs.Lock()
+	defer rs.Unlock()
+
+	value, present := rs.rates.Get(*rate.Id)
+	if !present {
+		return fmt.Errorf("rate with id=%v: %w", *rate.Id, ErrNotFound)
+	}
+
+	old := value.(Rate)
+
+	if rate.From != nil {
+		old.From = rate.From
+	} else {
+		rate.From = old.From
+	}
+
+	if rate.To != nil {
+		old.To = rate.To
+	} else {
+		rate.To = old.To
+	}
+
+	if rate.Value != nil {
+		old.Value = rate.Value
+	} else {
+		rate.Value = old.Value
+	}
+
+	if rate.ValidFrom != nil {
+		old.ValidFrom = rate.ValidFrom
+	} else {
+		rate.ValidFrom = old.ValidFrom
+	}
+
+	if rate.ValidTo != nil {
+		old.ValidTo = rate.ValidTo
+	} else {
+		rate.ValidTo = old.ValidTo
+	}
+
+	if err := validateRateInterval(&old); err != nil {
+		return err
+	}
+
+	rs.rates.Set(*old.Id, old)
+
+	if err := refreshRateCurrencies(ctx, rs.currencyStore, nil, rate); err != nil {
+		return fmt.Errorf("Can not update rate foreigns: %w", err)
+	}
+
+	return nil
+}
+
+func (rs *OrderedMapRateStore) Query(ctx context.Context, specification RateSpecification) (error, int, []*Rate) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	var l []*Rate
+	var c int = 0
+
+	for el := rs.rates.Oldest(); el != nil; el = el.Next() {
+		rate := el.Value.(Rate)
+		if specification.Specified(&rate, c) {
+			l = append(l, &rate)
+		}
+		c++
+	}
+
+	c = len(l)
+	clauses := specification.ToSqlClauses()
+	if err := clauses.checkOrderBy(rateOrderColumns...); err != nil {
+		return err, 0, nil
+	}
+
+	sortRates(l, clauses.OrderBy)
+	start, end := pageBounds(clauses, c)
+	l = l[start:end]
+
+	if err := refreshRateCurrencies(ctx, rs.currencyStore, clauses.Load, l...); err != nil {
+		return fmt.Errorf("Can not update rate foreigns: %w", err), c, l
+	}
+
+	return nil, c, l
+}
+
+func NewOrderedMapRateStore(
+	rates *orderedmap.OrderedMap,
+	currencyStore CurrencyRepository,
+	logger LoggerFunc,
+) RateRepository {
+	return &OrderedMapRateStore{
+		rates:         rates,
+		nextId:        1,
+		currencyStore: currencyStore,
+		logger:        logger,
+	}
+}
+
+func NewRateSpecificationByID(id int) RateSpecification {
+	return &RateSpecificationByID{
+		id: id,
+	}
+}
+
+func NewRateSpecificationByIDs(ids []int) RateSpecification {
+	return &RateSpecificationByIDs{
+		ids: ids,
+	}
+}
+
+func NewRateSpecificationByCurrencies(fromId int, toId int) RateSpecification {
+	return &RateSpecificationByCurrencies{
+		fromId: fromId,
+		toId:   toId,
+	}
+}
+
+func NewRateSpecificationValidAt(at time.Time) RateSpecification {
+	return &RateSpecificationValidAt{
+		at: at,
+	}
+}
+
+func NewRateSpecificationWithLimitAndOffset(limit int, offset int) RateSpecification {
+	return &RateSpecificationWithLimitAndOffset{
+		limit:  limit,
+		offset: offset,
+	}
+}
+
+func NewRateSpecificationAnd(specs ...RateSpecification) RateSpecification {
+	return &RateSpecificationAnd{specs: specs}
+}
+
+func NewRateSpecificationOr(specs ...RateSpecification) RateSpecification {
+	return &RateSpecificationOr{specs: specs}
+}
+
+func NewRateSpecificationNot(spec RateSpecification) RateSpecification {
+	return &RateSpecificationNot{spec: spec}
+}
+
+func NewRateSpecificationOrderBy(spec RateSpecification, column string, desc bool) RateSpecification {
+	return &RateSpecificationOrderBy{
+		spec:   spec,
+		column: column,
+		desc:   desc,
+	}
+}
+
+func NewRateSpecificationPaged(spec RateSpecification, limit int, offset int) RateSpecification {
+	return &RateSpecificationPaged{
+		spec:   spec,
+		limit:  limit,
+		offset: offset,
+	}
+}
+
+func NewRateSpecificationWithLoad(spec RateSpecification, load *LoadOptions) RateSpecification {
+	return &RateSpecificationWithLoad{
+		spec: spec,
+		load: load,
+	}
+}
+
+// NewRateSpecificationAsOf selects the single rate for the currency pair
+// that was in effect at the given time.
+func NewRateSpecificationAsOf(fromId int, toId int, at time.Time) RateSpecification {
+	return NewRateSpecificationPaged(
+		NewRateSpecificationOrderBy(
+			NewRateSpecificationAnd(
+				NewRateSpecificationByCurrencies(fromId, toId),
+				NewRateSpecificationValidAt(at),
+			),
+			"valid_from",
+			true,
+		),
+		1,
+		0,
+	)
+}
+
+// crossRateScale is the number of decimal places kept for rates derived by
+// inversion or through the base currency.
+const crossRateScale = 12
+
+func rateValue(rate *Rate) (error, *big.Rat) {
+	value, ok := new(big.Rat).SetString(*rate.Value)
+	if !ok || value.Sign() <= 0 {
+		return fmt.Errorf("rate with id=%v has invalid value %q: %w", *rate.Id, *rate.Value, ErrValidation), nil
+	}
+	return nil, value
+}
+
+func formatRateValue(value *big.Rat) string {
+	s := value.FloatString(crossRateScale)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// directOrInverseRate returns the stored rate for the pair, or one derived
+// from the opposite pair, along with its exact value.
+func directOrInverseRate(ctx context.Context, rates RateRepository, from *Currency, to *Currency, at time.Time) (error, *Rate, *big.Rat) {
+	err, _, l := rates.Query(ctx, NewRateSpecificationAsOf(*from.Id, *to.Id, at))
+	if err != nil {
+		return err, nil, nil
+	}
+
+	if len(l) > 0 {
+		err, value := rateValue(l[0])
+		return err, l[0], value
+	}
+
+	err, _, l = rates.Query(ctx, NewRateSpecificationAsOf(*to.Id, *from.Id, at))
+	if err != nil {
+		return err, nil, nil
+	}
+
+	if len(l) == 0 {
+		return nil, nil, nil
+	}
+
+	err, value := rateValue(l[0])
+	if err != nil {
+		return err, nil, nil
+	}
+
+	value.Inv(value)
+	inverse := formatRateValue(value)
+
+	return nil, &Rate{
+		From:      from,
+		To:        to,
+		Value:     &inverse,
+		ValidFrom: l[0].ValidFrom,
+		ValidTo:   l[0].ValidTo,
+	}, value
+}
+
+func laterTime(a *time.Time, b *time.Time) *time.Time {
+	if compareTimePtr(a, b) >= 0 {
+		return a
+	}
+	return b
+}
+
+func earlierTime(a *time.Time, b *time.Time) *time.Time {
+	if a == nil {
+		return b
+	}
+	if b == nil || a.Before(*b) {
+		return a
+	}
+	return b
+}
+
+// RateAsOf finds the rate from one currency to another in effect at the
+// given time. A stored rate for the pair is used when there is one, then
+// the inverse of the opposite pair, then, when base is not nil, the cross
+// rate through the base currency. Derived rates have no Id and are valid
+// for the intersection of the intervals they were derived from.
+func RateAsOf(ctx context.Context, rates RateRepository, from *Currency, to *Currency, base *Currency, at time.Time) (error, *Rate) {
+	if from == nil || from.Id == nil || to == nil || to.Id == nil {
+		return fmt.Errorf("currency is unknown: %w", ErrValidation), nil
+	}
+
+	err, rate, _ := directOrInverseRate(ctx, rates, from, to, at)
+	if err != nil {
+		return fmt.Errorf("Can not get rate: %w", err), nil
+	}
+
+	if rate != nil {
+		return nil, rate
+	}
+
+	if base != nil && base.Id != nil && !sameCurrency(base, from) && !sameCurrency(base, to) {
+		err, fromBase, a := directOrInverseRate(ctx, rates, from, base, at)
+		if err != nil {
+			return fmt.Errorf("Can not get rate: %w", err), nil
+		}
+
+		err, baseTo, b := directOrInverseRate(ctx, rates, base, to, at)
+		if err != nil {
+			return fmt.Errorf("Can not get rate: %w", err), nil
+		}
+
+		if fromBase != nil && baseTo != nil {
+			cross := formatRateValue(new(big.Rat).Mul(a, b))
+
+			return nil, &Rate{
+				From:      from,
+				To:        to,
+				Value:     &cross,
+				ValidFrom: laterTime(fromBase.ValidFrom, baseTo.ValidFrom),
+				ValidTo:   earlierTime(fromBase.ValidTo, baseTo.ValidTo),
+			}
+		}
+	}
+
+	return fmt.Errorf("rate from currency %d to %d at %s: %w", *from.Id, *to.Id, at, ErrNotFound), nil
+}
+
+type PGPoolRateStore struct {
+	pool          *pgxpool.Pool
+	currencyStore CurrencyRepository
+	logger        LoggerFunc
+}
+
+func (rs *PGPoolRateStore) Add(ctx context.Context, rate *Rate) error {
+	var fromId *int
+	var toId *int
+
+	if rate.From != nil {
+		fromId = rate.From.Id
+	}
+
+	if rate.To != nil {
+		toId = rate.To.Id
+	}
+
+	return mapPgError(pgQuerierFromContext(ctx, rs.pool).QueryRow(
+		ctx,
+		`insert into rates (
+			from_currency_id,
+			to_currency_id,
+			value,
+			valid_from,
+			valid_to
+		) values ($1, $2, $3::numeric, COALESCE($4, now()), $5) returning id, valid_from`,
+		fromId,
+		toId,
+		rate.Value,
+		rate.ValidFrom,
+		rate.ValidTo,
+	).Scan(&rate.Id, &rate.ValidFrom))
+}
+
+func (rs *PGPoolRateStore) Delete(ctx context.Context, rate *Rate) error {
+	var fromId *int
+	var toId *int
+
+	err := pgQuerierFromContext(ctx, rs.pool).QueryRow(
+		ctx,
+		`delete from
+			rates
+		where
+			id=$1
+		returning
+			from_currency_id,
+			to_currency_id,
+			value::text,
+			valid_from,
+			valid_to`,
+		rate.Id,
+	).Scan(
+		&fromId,
+		&toId,
+		&rate.Value,
+		&rate.ValidFrom,
+		&rate.ValidTo,
+	)
+
+	if err != nil {
+		return mapPgError(err)
+	}
+
+	rate.From = &Currency{Id: fromId}
+	rate.To = &Currency{Id: toId}
+
+	if err := refreshRateCurrencies(ctx, rs.currencyStore, nil, rate); err != nil {
+		return fmt.Errorf("Can not update rate foreigns: %w", err)
+	}
+
+	return nil
+}
+
+func (rs *PGPoolRateStore) Query(ctx context.Context, specification RateSpecification) (error, int, []*Rate) {
+	var l []*Rate
+	var c int = 0
+
+	conn := pgQuerierFromContext(ctx, rs.pool)
+	sqlClauses := specification.ToSqlClauses()
+	if err := sqlClauses.checkOrderBy(rateOrderColumns...); err != nil {
+		return err, c, l
+	}
+
+	clauses, args := sqlClauses.Build()
+
+	rows, err := conn.Query(
+		ctx, fmt.Sprintf(
+			`select
+				count(*) over(),
+				id,
+				from_currency_id,
+				to_currency_id,
+				value::text,
+				valid_from,
+				valid_to
+			from rates %s`,
+			clauses,
+		),
+		args...,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to query rates rows: %w", mapPgError(err)), c, l
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rate Rate
+		var fromId *int
+		var toId *int
+
+		if err = rows.Scan(
+			&c,
+			&rate.Id,
+			&fromId,
+			&toId,
+			&rate.Value,
+			&rate.ValidFrom,
+			&rate.ValidTo,
+		); err != nil {
+			return fmt.Errorf("failed to get rate row: %w", mapPgError(err)), c, l
+		}
+		rate.From = &Currency{Id: fromId}
+		rate.To = &Currency{Id: toId}
+		l = append(l, &rate)
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterating over rows of rates: %w", mapPgError(err)), c, l
+	}
+
+	if len(l) == 0 && sqlClauses.Offset != nil && *sqlClauses.Offset > 0 {
+		filter, filterArgs := sqlClauses.Filter().Build()
+
+		err = conn.QueryRow(
+			ctx,
+			fmt.Sprintf("select count(*) from rates %s", filter),
+			filterArgs...,
+		).Scan(&c)
+
+		if err != nil {
+			return fmt.Errorf("failed to get rates cnt: %w", mapPgError(err)), c, l
+		}
+	}
+
+	if err := refreshRateCurrencies(ctx, rs.currencyStore, sqlClauses.Load, l...); err != nil {
+		return fmt.Errorf("Can not update rate foreigns: %w", err), c, l
+	}
+
+	return nil, c, l
+}
+
+func (rs *PGPoolRateStore) Update(ctx context.Context, rate *Rate) error {
+	var fromId *int
+	var toId *int
+
+	if rate.From != nil {
+		fromId = rate.From.Id
+	}
+
+	if rate.To != nil {
+		toId = rate.To.Id
+	}
+
+	err := pgQuerierFromContext(ctx, rs.pool).QueryRow(
+		ctx,
+		`update rates set
+			from_currency_id=COALESCE($2, from_currency_id),
+			to_currency_id=COALESCE($3, to_currency_id),
+			value=COALESCE($4::numeric, value),
+			valid_from=COALESCE($5, valid_from),
+			valid_to=COALESCE($6, valid_to)
+		where
+			id=$1
+		returning
+			from_currency_id,
+			to_currency_id,
+			value::text,
+			valid_from,
+			valid_to`,
+		rate.Id,
+		fromId,
+		toId,
+		rate.Value,
+		rate.ValidFrom,
+		rate.ValidTo,
+	).Scan(
+		&fromId,
+		&toId,
+		&rate.Value,
+		&rate.ValidFrom,
+		&rate.ValidTo,
+	)
+
+	if err != nil {
+		return mapPgError(err)
+	}
+
+	rate.From = &Currency{Id: fromId}
+	rate.To = &Currency{Id: toId}
+
+	if err := refreshRateCurrencies(ctx, rs.currencyStore, nil, rate); err != nil {
+		return fmt.Errorf("Can not update rate foreigns: %w", err)
+	}
+
+	return nil
+}
+
+func NewPGPoolRateStore(
+	pool          *pgxpool.Pool,
+	currencyStore CurrencyRepository,
+	logger        LoggerFunc,
+) RateRepository {
+	return &PGPoolRateStore{
+		pool:          pool,
+		currencyStore: currencyStore,
+		logger:        logger,
+	}
+}
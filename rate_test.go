@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"time"
+	"errors"
+	"context"
+	"testing"
+	"github.com/wk8/go-ordered-map"
+)
+
+var rateEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type testRates struct {
+	currencies CurrencyRepository
+	rates      RateRepository
+
+	usd, eur, jpy, rub *Currency
+}
+
+func newTestCurrency(t *testing.T, store CurrencyRepository, code string, exponent int) *Currency {
+	currency := &Currency{CharCode: &code, Exponent: &exponent}
+	if err := store.Add(context.Background(), currency); err != nil {
+		t.Fatalf("can not add currency %s: %v", code, err)
+	}
+	return currency
+}
+
+func addTestRate(t *testing.T, store RateRepository, from *Currency, to *Currency, value string, validFrom time.Time, validTo *time.Time) *Rate {
+	rate := &Rate{From: from, To: to, Value: &value, ValidFrom: &validFrom, ValidTo: validTo}
+	if err := store.Add(context.Background(), rate); err != nil {
+		t.Fatalf("can not add rate %s: %v", value, err)
+	}
+	return rate
+}
+
+// newTestRates stores USD to RUB at 90 for the first day and at 95 after
+// it, EUR to RUB at 100 and USD to JPY at 150. RUB is the base currency.
+func newTestRates(t *testing.T) *testRates {
+	tr := &testRates{currencies: NewOrderedMapCurrencyStore(orderedmap.New(), testLogger)}
+	tr.rates = NewOrderedMapRateStore(orderedmap.New(), tr.currencies, testLogger)
+
+	tr.usd = newTestCurrency(t, tr.currencies, "USD", 2)
+	tr.eur = newTestCurrency(t, tr.currencies, "EUR", 2)
+	tr.jpy = newTestCurrency(t, tr.currencies, "JPY", 0)
+	tr.rub = newTestCurrency(t, tr.currencies, "RUB", 2)
+
+	day := rateEpoch.Add(24 * time.Hour)
+	addTestRate(t, tr.rates, tr.usd, tr.rub, "90", rateEpoch, &day)
+	addTestRate(t, tr.rates, tr.usd, tr.rub, "95", day, nil)
+	addTestRate(t, tr.rates, tr.eur, tr.rub, "100", rateEpoch, nil)
+	addTestRate(t, tr.rates, tr.usd, tr.jpy, "150", rateEpoch, nil)
+
+	return tr
+}
+
+func TestRateAsOf(t *testing.T) {
+	ctx := context.Background()
+	tr := newTestRates(t)
+	day := rateEpoch.Add(24 * time.Hour)
+
+	cases := []struct {
+		name    string
+		from    *Currency
+		to      *Currency
+		base    *Currency
+		at      time.Time
+		value   string
+		derived bool
+	}{
+		{"direct", tr.usd, tr.rub, nil, rateEpoch, "90", false},
+		{"last instant before valid_to", tr.usd, tr.rub, nil, day.Add(-time.Nanosecond), "90", false},
+		{"valid_to is exclusive", tr.usd, tr.rub, nil, day, "95", false},
+		{"inverse", tr.rub, tr.usd, nil, day, "0.010526315789", true},
+		{"inverse of a round rate", tr.jpy, tr.usd, nil, day, "0.006666666667", true},
+		{"cross through base", tr.eur, tr.usd, tr.rub, day, "1.052631578947", true},
+		{"cross before valid_to", tr.eur, tr.usd, tr.rub, rateEpoch, "1.111111111111", true},
+	}
+
+	for _, c := range cases {
+		err, rate := RateAsOf(ctx, tr.rates, c.from, c.to, c.base, c.at)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		if *rate.Value != c.value {
+			t.Errorf("%s: got %s, want %s", c.name, *rate.Value, c.value)
+		}
+
+		if (rate.Id == nil) != c.derived {
+			t.Errorf("%s: rate id is %v", c.name, rate.Id)
+		}
+	}
+
+	err, rate := RateAsOf(ctx, tr.rates, tr.eur, tr.rub, nil, day)
+	if err != nil || *rate.Value != "100" {
+		t.Fatalf("eur to rub = %v, %v", rate, err)
+	}
+
+	// the cross rate is valid while both rates it is made of are
+	err, rate = RateAsOf(ctx, tr.rates, tr.eur, tr.usd, tr.rub, rateEpoch)
+	if err != nil || !rate.ValidFrom.Equal(rateEpoch) || rate.ValidTo == nil || !rate.ValidTo.Equal(day) {
+		t.Errorf("cross rate validity = %v - %v, %v", rate.ValidFrom, rate.ValidTo, err)
+	}
+
+	if err, _ := RateAsOf(ctx, tr.rates, tr.eur, tr.usd, nil, day); !errors.Is(err, ErrNotFound) {
+		t.Errorf("cross rate without base: got %v, want not found", err)
+	}
+
+	if err, _ := RateAsOf(ctx, tr.rates, tr.usd, tr.rub, nil, rateEpoch.Add(-time.Nanosecond)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("rate before valid_from: got %v, want not found", err)
+	}
+}
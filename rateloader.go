@@ -0,0 +1,174 @@
+package repository
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"errors"
+	"context"
+	"strings"
+	"math/big"
+	"encoding/csv"
+	"encoding/json"
+)
+
+// RateRecord is one rate of a bulk load file. Currencies are referenced by
+// char code and times are RFC 3339; an empty valid_to leaves the rate open.
+type RateRecord struct {
+	From      string  `json:"from"`
+	To        string  `json:"to"`
+	Value     string  `json:"value"`
+	ValidFrom string  `json:"valid_from"`
+	ValidTo   *string `json:"valid_to"`
+}
+
+var rateCsvHeader = []string{"from", "to", "value", "valid_from", "valid_to"}
+
+type rateLoader struct {
+	rates      RateRepository
+	currencies CurrencyRepository
+	byCharCode map[string]*Currency
+}
+
+func (rl *rateLoader) currency(ctx context.Context, charCode string) (error, *Currency) {
+	if currency, ok := rl.byCharCode[charCode]; ok {
+		return nil, currency
+	}
+
+	err, _, l := rl.currencies.Query(ctx, NewCurrencySpecificationByCharCode(charCode))
+	if err != nil {
+		return err, nil
+	}
+
+	if len(l) == 0 {
+		return fmt.Errorf("currency %s: %w", charCode, ErrNotFound), nil
+	}
+
+	rl.byCharCode[charCode] = l[0]
+
+	return nil, l[0]
+}
+
+func (rl *rateLoader) add(ctx context.Context, record *RateRecord) error {
+	err, from := rl.currency(ctx, record.From)
+	if err != nil {
+		return err
+	}
+
+	err, to := rl.currency(ctx, record.To)
+	if err != nil {
+		return err
+	}
+
+	value, ok := new(big.Rat).SetString(record.Value)
+	if !ok || value.Sign() <= 0 {
+		return fmt.Errorf("invalid rate value %q: %w", record.Value, ErrValidation)
+	}
+
+	validFrom, err := time.Parse(time.RFC3339, record.ValidFrom)
+	if err != nil {
+		return fmt.Errorf("invalid valid_from %q: %w", record.ValidFrom, NewRepositoryError(ErrValidation, err))
+	}
+
+	rate := &Rate{
+		From:      from,
+		To:        to,
+		Value:     &record.Value,
+		ValidFrom: &validFrom,
+	}
+
+	if record.ValidTo != nil && *record.ValidTo != "" {
+		validTo, err := time.Parse(time.RFC3339, *record.ValidTo)
+		if err != nil {
+			return fmt.Errorf("invalid valid_to %q: %w", *record.ValidTo, NewRepositoryError(ErrValidation, err))
+		}
+		rate.ValidTo = &validTo
+	}
+
+	return rl.rates.Add(ctx, rate)
+}
+
+func newRateLoader(rates RateRepository, currencies CurrencyRepository) *rateLoader {
+	return &rateLoader{
+		rates:      rates,
+		currencies: currencies,
+		byCharCode: make(map[string]*Currency),
+	}
+}
+
+// LoadRatesCSV adds the rates read from r, a CSV file with the header
+// from,to,value,valid_from,valid_to, and returns how many were added. Run
+// it inside a UnitOfWork to load the file all or nothing.
+func LoadRatesCSV(ctx context.Context, rates RateRepository, currencies CurrencyRepository, r io.Reader) (error, int) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("can not read rates header: %w", NewRepositoryError(ErrValidation, err)), 0
+	}
+
+	// valid_to is the only optional column
+	if len(header) < len(rateCsvHeader)-1 || len(header) > len(rateCsvHeader) ||
+		strings.Join(header, ",") != strings.Join(rateCsvHeader[:len(header)], ",") {
+		return fmt.Errorf("unexpected rates header %v: %w", header, ErrValidation), 0
+	}
+
+	loader := newRateLoader(rates, currencies)
+	c := 0
+
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("can not read rates line %d: %w", line, NewRepositoryError(ErrValidation, err)), c
+		}
+
+		if len(row) != len(header) {
+			return fmt.Errorf("rates line %d has %d fields: %w", line, len(row), ErrValidation), c
+		}
+
+		record := &RateRecord{
+			From:      row[0],
+			To:        row[1],
+			Value:     row[2],
+			ValidFrom: row[3],
+		}
+
+		if len(row) > 4 {
+			record.ValidTo = &row[4]
+		}
+
+		if err := loader.add(ctx, record); err != nil {
+			return fmt.Errorf("can not load rates line %d: %w", line, err), c
+		}
+		c++
+	}
+
+	return nil, c
+}
+
+// LoadRatesJSON adds the rates read from r, a JSON array of RateRecord,
+// and returns how many were added. Run it inside a UnitOfWork to load the
+// file all or nothing.
+func LoadRatesJSON(ctx context.Context, rates RateRepository, currencies CurrencyRepository, r io.Reader) (error, int) {
+	var records []*RateRecord
+
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return fmt.Errorf("can not decode rates: %w", NewRepositoryError(ErrValidation, err)), 0
+	}
+
+	loader := newRateLoader(rates, currencies)
+
+	for i, record := range records {
+		if err := loader.add(ctx, record); err != nil {
+			return fmt.Errorf("can not load rate #%d: %w", i, err), i
+		}
+	}
+
+	return nil, len(records)
+}
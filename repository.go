@@ -2,6 +2,7 @@ package repository
 
 import (
 	"fmt"
+	"sort"
 	"context"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/sirupsen/logrus"
@@ -37,3 +38,20 @@ func MakePgPoolFromDSN(dsn string) (*pgxpool.Pool, error) {
 
 	return pool, nil
 }
+
+type idSet map[int]struct{}
+
+func (s idSet) add(id *int) {
+	if id != nil {
+		s[*id] = struct{}{}
+	}
+}
+
+func (s idSet) slice() []int {
+	ids := make([]int, 0, len(s))
+	for id := range s {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
@@ -0,0 +1,12 @@
+package repository
+
+import (
+	"io/ioutil"
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger(interface{}) logrus.FieldLogger {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	return logger
+}
@@ -2,6 +2,8 @@ package repository
 
 import (
 	"fmt"
+	"time"
+	"errors"
 	"context"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -16,17 +18,19 @@ type Route struct {
 	Account    *Account        `json:"account"`
 	Router     *Router         `json:"router"`
 	Settings   *RouterSettings `json:"settings"`
+	Version    *int            `json:"version"`
+	Updated    *time.Time      `json:"updated"`
 }
 
 type RouteSpecification interface {
-	ToSqlClauses() string
+	ToSqlClauses() *SqlClauses
 }
 
 type RouteRepository interface {
-	Add(ctx interface{}, route *Route) error
-	Delete(ctx interface{}, route *Route) (error, bool)
-	Update(ctx interface{}, route *Route) (error, bool)
-	Query(ctx interface{}, specification RouteSpecification) (error, int, []*Route)
+	Add(ctx context.Context, route *Route) error
+	Delete(ctx context.Context, route *Route) error
+	Update(ctx context.Context, route *Route) error
+	Query(ctx context.Context, specification RouteSpecification) (error, int, []*Route)
 }
 
 type RouteSpecificationWithLimitAndOffset struct {
@@ -34,16 +38,24 @@ type RouteSpecificationWithLimitAndOffset struct {
 	offset int
 }
 
-func (rswlao *RouteSpecificationWithLimitAndOffset) ToSqlClauses() string {
-	return fmt.Sprintf("limit %d offset %d", rswlao.limit, rswlao.offset)
+func (rswlao *RouteSpecificationWithLimitAndOffset) ToSqlClauses() *SqlClauses {
+	return NewSqlLimitAndOffsetClauses(rswlao.limit, rswlao.offset)
 }
 
 type RouteSpecificationByID struct {
 	id int
 }
 
-func (rsbyid *RouteSpecificationByID) ToSqlClauses() string {
-	return fmt.Sprintf("where id=%d", rsbyid.id)
+func (rsbyid *RouteSpecificationByID) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=?", rsbyid.id)
+}
+
+type RouteSpecificationByIDs struct {
+	ids []int
+}
+
+func (rsbyids *RouteSpecificationByIDs) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=any(?)", rsbyids.ids)
 }
 
 type RouteSpecificationByProfileAndInstrument struct {
@@ -51,14 +63,18 @@ type RouteSpecificationByProfileAndInstrument struct {
 	instrument *Instrument
 }
 
-func (rsbypai *RouteSpecificationByProfileAndInstrument) ToSqlClauses() string {
-	return fmt.Sprintf("where profile_id=%d and instrument_id=%d", *rsbypai.profile.Id, *rsbypai.instrument.Id)
+func (rsbypai *RouteSpecificationByProfileAndInstrument) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("profile_id=? and instrument_id=?", *rsbypai.profile.Id, *rsbypai.instrument.Id)
 }
 
 func NewRouteSpecificationByID(id int) RouteSpecification {
 	return &RouteSpecificationByID{id: id}
 }
 
+func NewRouteSpecificationByIDs(ids []int) RouteSpecification {
+	return &RouteSpecificationByIDs{ids: ids}
+}
+
 func NewRouteSpecificationWithLimitAndOffset(limit int, offset int) RouteSpecification {
 	return &RouteSpecificationWithLimitAndOffset{
 		limit:  limit,
@@ -73,6 +89,51 @@ func NewRouteSpecificationByProfileAndInstrument(profile *Profile, instrument *I
 	}
 }
 
+func NewRouteSpecificationAnd(specs ...RouteSpecification) RouteSpecification {
+	l := make([]SqlSpecification, 0, len(specs))
+	for _, spec := range specs {
+		l = append(l, spec)
+	}
+	return &SqlSpecificationAnd{specs: l}
+}
+
+func NewRouteSpecificationOr(specs ...RouteSpecification) RouteSpecification {
+	l := make([]SqlSpecification, 0, len(specs))
+	for _, spec := range specs {
+		l = append(l, spec)
+	}
+	return &SqlSpecificationOr{specs: l}
+}
+
+func NewRouteSpecificationNot(spec RouteSpecification) RouteSpecification {
+	return &SqlSpecificationNot{spec: spec}
+}
+
+var routeOrderColumns = []string{"id", "profile_id", "instrument_id", "account_id", "router_id", "version", "updated"}
+
+func NewRouteSpecificationOrderBy(spec RouteSpecification, column string, desc bool) RouteSpecification {
+	return &SqlSpecificationOrderBy{
+		spec:   spec,
+		column: column,
+		desc:   desc,
+	}
+}
+
+func NewRouteSpecificationPaged(spec RouteSpecification, limit int, offset int) RouteSpecification {
+	return &SqlSpecificationPaged{
+		spec:   spec,
+		limit:  limit,
+		offset: offset,
+	}
+}
+
+func NewRouteSpecificationWithLoad(spec RouteSpecification, load *LoadOptions) RouteSpecification {
+	return &SqlSpecificationWithLoad{
+		spec: spec,
+		load: load,
+	}
+}
+
 type PGPoolRouteStore struct {
 	pool            *pgxpool.Pool
 	profileStore    ProfileRepository
@@ -82,7 +143,7 @@ type PGPoolRouteStore struct {
 	logger          LoggerFunc
 }
 
-func (rs *PGPoolRouteStore) Add(ctx interface{}, route *Route) error {
+func (rs *PGPoolRouteStore) Add(ctx context.Context, route *Route) error {
 	var profileId    *int
 	var instrumentId *int
 	var accountId    *int
@@ -104,159 +165,122 @@ func (rs *PGPoolRouteStore) Add(ctx interface{}, route *Route) error {
 		routerId = route.Router.Id
 	}
 
-	return rs.pool.QueryRow(
-		context.Background(),
+	return mapPgError(pgQuerierFromContext(ctx, rs.pool).QueryRow(
+		ctx,
 		`insert into routes (
 			profile_id,
 			instrument_id,
 			account_id,
 			router_id,
 			settings
-		) values ($1, $2, $3, $4, $5) returning id`,
+		) values ($1, $2, $3, $4, $5) returning id, version, updated`,
 		profileId,
 		instrumentId,
 		accountId,
 		routerId,
 		route.Settings,
-	).Scan(&route.Id)
+	).Scan(&route.Id, &route.Version, &route.Updated))
 }
 
-func (rs *PGPoolRouteStore) refreshRouteProfile(ctx interface{}, route *Route) error {
-	if !(route.Profile != nil && route.Profile.Id != nil) {
-		return nil
-	}
-
-	err, _, profiles := rs.profileStore.Query(ctx, NewProfileSpecificationByID(
-		*route.Profile.Id,
-	))
-
-	if err != nil {
-		return fmt.Errorf("Can not update route profile: %v", err)
-	}
-
-	for _, profile := range profiles {
-		route.Profile = profile
-	}
-
-	return nil
-}
+func (rs *PGPoolRouteStore) refreshRouteForeigns(ctx context.Context, load *LoadOptions, routes ...*Route) error {
+	profileIds := make(idSet)
+	instrumentIds := make(idSet)
+	accountIds := make(idSet)
+	routerIds := make(idSet)
 
-func (rs *PGPoolRouteStore) refreshRouteInstrument(ctx interface{}, route *Route) error {
-	if !(route.Instrument != nil && route.Instrument.Id != nil) {
-		return nil
+	for _, route := range routes {
+		if route.Profile != nil && load.Hydrates("profile") {
+			profileIds.add(route.Profile.Id)
+		}
+		if route.Instrument != nil && load.Hydrates("instrument") {
+			instrumentIds.add(route.Instrument.Id)
+		}
+		if route.Account != nil && load.Hydrates("account") {
+			accountIds.add(route.Account.Id)
+		}
+		if route.Router != nil && load.Hydrates("router") {
+			routerIds.add(route.Router.Id)
+		}
 	}
 
-	err, _, instruments := rs.instrumentStore.Query(ctx, NewInstrumentSpecificationByID(
-		*route.Instrument.Id,
-	))
-
+	err, profiles := profilesByIds(ctx, rs.profileStore, profileIds, load.Nested())
 	if err != nil {
-		return fmt.Errorf("Can not update route instrument: %v", err)
+		return fmt.Errorf("Can not update route profile: %w", err)
 	}
 
-	for _, instrument := range instruments {
-		route.Instrument = instrument
-	}
-
-	return nil
-}
-
-func (rs *PGPoolRouteStore) refreshRouteAccount(ctx interface{}, route *Route) error {
-	if !(route.Account != nil && route.Account.Id != nil) {
-		return nil
-	}
-
-	err, _, accounts := rs.accountStore.Query(ctx, NewAccountSpecificationByID(
-		*route.Account.Id,
-	))
-
+	err, instruments := instrumentsByIds(ctx, rs.instrumentStore, instrumentIds)
 	if err != nil {
-		return fmt.Errorf("Can not update route account: %v", err)
-	}
-
-	for _, account := range accounts {
-		route.Account = account
+		return fmt.Errorf("Can not update route instrument: %w", err)
 	}
 
-	return nil
-}
-
-func (rs *PGPoolRouteStore) refreshRouteRouter(ctx interface{}, route *Route) error {
-	if !(route.Router != nil && route.Router.Id != nil) {
-		return nil
-	}
-
-	err, _, routers := rs.routerStore.Query(ctx, NewRouterSpecificationByID(
-		*route.Router.Id,
-	))
-
+	err, accounts := accountsByIds(ctx, rs.accountStore, accountIds, load.Nested())
 	if err != nil {
-		return fmt.Errorf("Can not update route router: %v", err)
-	}
-
-	for _, router := range routers {
-		route.Router = router
-	}
-
-	return nil
-}
-
-func (rs *PGPoolRouteStore) refreshRouteForeigns(ctx interface{}, route *Route) error {
-	if err := rs.refreshRouteProfile(ctx, route); err != nil {
-		return err
-	}
-
-	if err := rs.refreshRouteInstrument(ctx, route); err != nil {
-		return err
+		return fmt.Errorf("Can not update route account: %w", err)
 	}
 
-	if err := rs.refreshRouteAccount(ctx, route); err != nil {
-		return err
+	err, routers := routersByIds(ctx, rs.routerStore, routerIds)
+	if err != nil {
+		return fmt.Errorf("Can not update route router: %w", err)
 	}
 
-	if err := rs.refreshRouteRouter(ctx, route); err != nil {
-		return err
+	for _, route := range routes {
+		if route.Profile != nil && route.Profile.Id != nil {
+			if profile, ok := profiles[*route.Profile.Id]; ok {
+				route.Profile = profile
+			}
+		}
+		if route.Instrument != nil && route.Instrument.Id != nil {
+			if instrument, ok := instruments[*route.Instrument.Id]; ok {
+				route.Instrument = instrument
+			}
+		}
+		if route.Account != nil && route.Account.Id != nil {
+			if account, ok := accounts[*route.Account.Id]; ok {
+				route.Account = account
+			}
+		}
+		if route.Router != nil && route.Router.Id != nil {
+			if router, ok := routers[*route.Router.Id]; ok {
+				route.Router = router
+			}
+		}
 	}
 
 	return nil
 }
 
-func (rs *PGPoolRouteStore) Query(ctx interface{}, specification RouteSpecification) (error, int, []*Route) {
+func (rs *PGPoolRouteStore) Query(ctx context.Context, specification RouteSpecification) (error, int, []*Route) {
 	var l []*Route
 	var c int = 0
 
-	conn, err := rs.pool.Acquire(context.Background())
-
-	if err != nil {
-		return fmt.Errorf("failed to acquire connection from the pool: %v", err), c, l
+	conn := pgQuerierFromContext(ctx, rs.pool)
+	sqlClauses := specification.ToSqlClauses()
+	if err := sqlClauses.checkOrderBy(routeOrderColumns...); err != nil {
+		return err, c, l
 	}
-	defer conn.Release()
 
-	err = conn.QueryRow(
-		context.Background(),
-		"select count(*) from routes",
-	).Scan(&c)
-
-	if err != nil {
-		return fmt.Errorf("failed to get routes cnt: %v", err), c, l
-	}
+	clauses, args := sqlClauses.Build()
 
 	rows, err := conn.Query(
-		context.Background(), fmt.Sprintf(
+		ctx, fmt.Sprintf(
 			`select
+				count(*) over(),
 				id,
 				profile_id,
 				instrument_id,
 				account_id,
 				router_id,
-				settings
+				settings,
+				version,
+				updated
 			from routes %s`,
-			specification.ToSqlClauses(),
+			clauses,
 		),
+		args...,
 	)
 
 	if err != nil {
-		return fmt.Errorf("failed to query routes rows: %v", err), c, l
+		return fmt.Errorf("failed to query routes rows: %w", mapPgError(err)), c, l
 	}
 	defer rows.Close()
 
@@ -268,14 +292,17 @@ func (rs *PGPoolRouteStore) Query(ctx interface{}, specification RouteSpecificat
 		var routerId *int
 
 		if err = rows.Scan(
+			&c,
 			&route.Id,
 			&profileId,
 			&instrumentId,
 			&accountId,
 			&routerId,
 			&route.Settings,
+			&route.Version,
+			&route.Updated,
 		); err != nil {
-			return fmt.Errorf("failed to get route row: %v", err), c, l
+			return fmt.Errorf("failed to get route row: %w", mapPgError(err)), c, l
 		}
 		if profileId != nil {
 			route.Profile = &Profile{
@@ -297,27 +324,42 @@ func (rs *PGPoolRouteStore) Query(ctx interface{}, specification RouteSpecificat
 				Id: routerId,
 			}
 		}
-		if err := rs.refreshRouteForeigns(ctx, &route); err != nil {
-			return fmt.Errorf("Can not update route foreigns: %v", err), c, l
-		}
 		l = append(l, &route)
 	}
 
 	if err = rows.Err(); err != nil {
-		return fmt.Errorf("failed to iterating over rows of routes: %v", err), c, l
+		return fmt.Errorf("failed to iterating over rows of routes: %w", mapPgError(err)), c, l
+	}
+
+	if len(l) == 0 && sqlClauses.Offset != nil && *sqlClauses.Offset > 0 {
+		filter, filterArgs := sqlClauses.Filter().Build()
+
+		err = conn.QueryRow(
+			ctx,
+			fmt.Sprintf("select count(*) from routes %s", filter),
+			filterArgs...,
+		).Scan(&c)
+
+		if err != nil {
+			return fmt.Errorf("failed to get routes cnt: %w", mapPgError(err)), c, l
+		}
+	}
+
+	if err := rs.refreshRouteForeigns(ctx, sqlClauses.Load, l...); err != nil {
+		return fmt.Errorf("Can not update route foreigns: %w", err), c, l
 	}
 
 	return nil, c, l
 }
 
-func (rs *PGPoolRouteStore) Delete(ctx interface{}, route *Route) (error, bool) {
+func (rs *PGPoolRouteStore) Delete(ctx context.Context, route *Route) error {
 	var profileId *int
 	var instrumentId *int
 	var accountId *int
 	var routerId *int
 
-	err := rs.pool.QueryRow(
-		context.Background(),
+	err := pgQuerierFromContext(ctx, rs.pool).QueryRow(
+		ctx,
 		`delete from
 			routes
 		where
@@ -337,6 +379,10 @@ func (rs *PGPoolRouteStore) Delete(ctx interface{}, route *Route) (error, bool)
 		&route.Settings,
 	)
 
+	if err != nil {
+		return mapPgError(err)
+	}
+
 	if profileId != nil {
 		route.Profile = &Profile{
 			Id: profileId,
@@ -358,14 +404,18 @@ func (rs *PGPoolRouteStore) Delete(ctx interface{}, route *Route) (error, bool)
 		}
 	}
 
-	if e := rs.refreshRouteForeigns(ctx, route); e != nil {
-		return fmt.Errorf("Can not update route foreigns: %v", e), err == pgx.ErrNoRows
+	if err := rs.refreshRouteForeigns(ctx, nil, route); err != nil {
+		return fmt.Errorf("Can not update route foreigns: %w", err)
 	}
 
-	return err, err == pgx.ErrNoRows
+	return nil
 }
 
-func (rs *PGPoolRouteStore) Update(ctx interface{}, route *Route) (error, bool) {
+func (rs *PGPoolRouteStore) Update(ctx context.Context, route *Route) error {
+	if err := requireVersion("routes", route.Id, route.Version); err != nil {
+		return err
+	}
+
 	var profileId *int
 	var instrumentId *int
 	var accountId *int
@@ -387,36 +437,52 @@ func (rs *PGPoolRouteStore) Update(ctx interface{}, route *Route) (error, bool)
 		routerId = route.Router.Id
 	}
 
-	err := rs.pool.QueryRow(
-		context.Background(),
+	err := pgQuerierFromContext(ctx, rs.pool).QueryRow(
+		ctx,
 		`update routes set
 			profile_id=COALESCE($2, profile_id),
 			instrument_id=COALESCE($3, instrument_id),
 			account_id=COALESCE($4, account_id),
 			router_id=COALESCE($5, router_id),
-			settings=COALESCE($6, settings)
+			settings=COALESCE($6, settings),
+			version=version+1,
+			updated=now()
 		where
-			id=$1
+			id=$1 and
+			version=$7
 		returning
 			profile_id,
 			instrument_id,
 			account_id,
 			router_id,
-			settings`,
+			settings,
+			version,
+			updated`,
 		route.Id,
 		profileId,
 		instrumentId,
 		accountId,
 		routerId,
 		route.Settings,
+		route.Version,
 	).Scan(
 		&profileId,
 		&instrumentId,
 		&accountId,
 		&routerId,
 		&route.Settings,
+		&route.Version,
+		&route.Updated,
 	)
 
+	if errors.Is(err, pgx.ErrNoRows) {
+		return versionConflict(ctx, pgQuerierFromContext(ctx, rs.pool), "routes", route.Id, route.Version)
+	}
+
+	if err != nil {
+		return mapPgError(err)
+	}
+
 	if profileId != nil {
 		route.Profile = &Profile{
 			Id: profileId,
@@ -438,11 +504,11 @@ func (rs *PGPoolRouteStore) Update(ctx interface{}, route *Route) (error, bool)
 		}
 	}
 
-	if e := rs.refreshRouteForeigns(ctx, route); e != nil {
-		return fmt.Errorf("Can not update route foreigns: %v", e), err == pgx.ErrNoRows
+	if err := rs.refreshRouteForeigns(ctx, nil, route); err != nil {
+		return fmt.Errorf("Can not update route foreigns: %w", err)
 	}
 
-	return err, err == pgx.ErrNoRows
+	return nil
 }
 
 func NewPGPoolRouteStore(
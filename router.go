@@ -3,7 +3,6 @@ package repository
 import (
 	"fmt"
 	"context"
-	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
@@ -13,20 +12,20 @@ type Router struct {
 }
 
 type RouterSpecification interface {
-	ToSqlClauses() string
+	ToSqlClauses() *SqlClauses
 }
 
 type RouterRepository interface {
-	Add(ctx interface{}, router *Router) error
-	Delete(ctx interface{}, router *Router) (error, bool)
-	Update(ctx interface{}, router *Router) (error, bool)
-	Query(ctx interface{}, specification RouterSpecification) (error, int, []*Router)
+	Add(ctx context.Context, router *Router) error
+	Delete(ctx context.Context, router *Router) error
+	Update(ctx context.Context, router *Router) error
+	Query(ctx context.Context, specification RouterSpecification) (error, int, []*Router)
 }
 
 type RouterWithoutSpecification struct {}
 
-func (rws *RouterWithoutSpecification) ToSqlClauses() string {
-	return ""
+func (rws *RouterWithoutSpecification) ToSqlClauses() *SqlClauses {
+	return &SqlClauses{}
 }
 
 type RouterSpecificationWithLimitAndOffset struct {
@@ -34,30 +33,42 @@ type RouterSpecificationWithLimitAndOffset struct {
 	offset int
 }
 
-func (rswlao *RouterSpecificationWithLimitAndOffset) ToSqlClauses() string {
-	return fmt.Sprintf("limit %d offset %d", rswlao.limit, rswlao.offset)
+func (rswlao *RouterSpecificationWithLimitAndOffset) ToSqlClauses() *SqlClauses {
+	return NewSqlLimitAndOffsetClauses(rswlao.limit, rswlao.offset)
 }
 
 type RouterSpecificationByID struct {
 	id int
 }
 
-func (rsbyid *RouterSpecificationByID) ToSqlClauses() string {
-	return fmt.Sprintf("where id=%d", rsbyid.id)
+func (rsbyid *RouterSpecificationByID) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=?", rsbyid.id)
+}
+
+type RouterSpecificationByIDs struct {
+	ids []int
+}
+
+func (rsbyids *RouterSpecificationByIDs) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=any(?)", rsbyids.ids)
 }
 
 type RouterSpecificationByKey struct {
 	key string
 }
 
-func (rsbyk *RouterSpecificationByKey) ToSqlClauses() string {
-	return fmt.Sprintf("where key='%s'", rsbyk.key)
+func (rsbyk *RouterSpecificationByKey) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("key=?", rsbyk.key)
 }
 
 func NewRouterSpecificationByID(id int) RouterSpecification {
 	return &RouterSpecificationByID{id: id}
 }
 
+func NewRouterSpecificationByIDs(ids []int) RouterSpecification {
+	return &RouterSpecificationByIDs{ids: ids}
+}
+
 func NewRouterSpecificationByKey(key string) RouterSpecification {
 	return &RouterSpecificationByKey{
 		key: key,
@@ -75,63 +86,112 @@ func NewRouterWithoutSpecification() RouterSpecification {
 	return &RouterWithoutSpecification{}
 }
 
+func NewRouterSpecificationAnd(specs ...RouterSpecification) RouterSpecification {
+	l := make([]SqlSpecification, 0, len(specs))
+	for _, spec := range specs {
+		l = append(l, spec)
+	}
+	return &SqlSpecificationAnd{specs: l}
+}
+
+func NewRouterSpecificationOr(specs ...RouterSpecification) RouterSpecification {
+	l := make([]SqlSpecification, 0, len(specs))
+	for _, spec := range specs {
+		l = append(l, spec)
+	}
+	return &SqlSpecificationOr{specs: l}
+}
+
+func NewRouterSpecificationNot(spec RouterSpecification) RouterSpecification {
+	return &SqlSpecificationNot{spec: spec}
+}
+
+var routerOrderColumns = []string{"id", "key"}
+
+func NewRouterSpecificationOrderBy(spec RouterSpecification, column string, desc bool) RouterSpecification {
+	return &SqlSpecificationOrderBy{
+		spec:   spec,
+		column: column,
+		desc:   desc,
+	}
+}
+
+func NewRouterSpecificationPaged(spec RouterSpecification, limit int, offset int) RouterSpecification {
+	return &SqlSpecificationPaged{
+		spec:   spec,
+		limit:  limit,
+		offset: offset,
+	}
+}
+
+func routersByIds(ctx context.Context, store RouterRepository, ids idSet) (error, map[int]*Router) {
+	m := make(map[int]*Router)
+	if len(ids) == 0 {
+		return nil, m
+	}
+
+	err, _, routers := store.Query(ctx, NewRouterSpecificationByIDs(ids.slice()))
+	if err != nil {
+		return err, m
+	}
+
+	for _, router := range routers {
+		m[*router.Id] = router
+	}
+
+	return nil, m
+}
+
 type PGPoolRouterStore struct {
 	pool   *pgxpool.Pool
 	logger LoggerFunc
 }
 
-func (rs *PGPoolRouterStore) Add(ctx interface{}, router *Router) error {
-	_, err := rs.pool.Exec(
-		context.Background(),
+func (rs *PGPoolRouterStore) Add(ctx context.Context, router *Router) error {
+	_, err := pgQuerierFromContext(ctx, rs.pool).Exec(
+		ctx,
 		"insert into routers (id, key) values ($1, $2)",
 		router.Id,
 		router.Key,
 	)
 
-	return err
+	return mapPgError(err)
 }
 
-func (rs *PGPoolRouterStore) Delete(ctx interface{}, router *Router) (error, bool) {
-	err := rs.pool.QueryRow(
-		context.Background(),
+func (rs *PGPoolRouterStore) Delete(ctx context.Context, router *Router) error {
+	err := pgQuerierFromContext(ctx, rs.pool).QueryRow(
+		ctx,
 		"delete from routers where id=$1 returning key",
 		router.Id,
 	).Scan(
 		&router.Key,
 	)
 
-	return err, err == pgx.ErrNoRows
+	return mapPgError(err)
 }
 
-func (rs *PGPoolRouterStore) Query(ctx interface{}, specification RouterSpecification) (error, int, []*Router) {
+func (rs *PGPoolRouterStore) Query(ctx context.Context, specification RouterSpecification) (error, int, []*Router) {
 	var l []*Router
 	var c int = 0
 
-	conn, err := rs.pool.Acquire(context.Background())
-
-	if err != nil {
-		return fmt.Errorf("failed to acquire connection from the pool: %v", err), c, l
+	conn := pgQuerierFromContext(ctx, rs.pool)
+	sqlClauses := specification.ToSqlClauses()
+	if err := sqlClauses.checkOrderBy(routerOrderColumns...); err != nil {
+		return err, c, l
 	}
-	defer conn.Release()
-
-	err = conn.QueryRow(
-		context.Background(),
-		"select count(*) from routers",
-	).Scan(&c)
 
-	if err != nil {
-		return fmt.Errorf("failed to get routers cnt: %v", err), c, l
-	}
+	clauses, args := sqlClauses.Build()
 
 	rows, err := conn.Query(
-		context.Background(), fmt.Sprintf(
-			"select id, key from routers %s",
-			specification.ToSqlClauses(),
+		ctx, fmt.Sprintf(
+			"select count(*) over(), id, key from routers %s",
+			clauses,
 		),
+		args...,
 	)
 
 	if err != nil {
-		return fmt.Errorf("failed to query routers rows: %v", err), c, l
+		return fmt.Errorf("failed to query routers rows: %w", mapPgError(err)), c, l
 	}
 	defer rows.Close()
 
@@ -139,24 +199,39 @@ func (rs *PGPoolRouterStore) Query(ctx interface{}, specification RouterSpecific
 		var router Router
 
 		if err = rows.Scan(
+			&c,
 			&router.Id,
 			&router.Key,
 		); err != nil {
-			return fmt.Errorf("failed to get router row: %v", err), c, l
+			return fmt.Errorf("failed to get router row: %w", mapPgError(err)), c, l
 		}
 		l = append(l, &router)
 	}
 
 	if err = rows.Err(); err != nil {
-		return fmt.Errorf("failed to iterating over rows of routers: %v", err), c, l
+		return fmt.Errorf("failed to iterating over rows of routers: %w", mapPgError(err)), c, l
+	}
+
+	if len(l) == 0 && sqlClauses.Offset != nil && *sqlClauses.Offset > 0 {
+		filter, filterArgs := sqlClauses.Filter().Build()
+
+		err = conn.QueryRow(
+			ctx,
+			fmt.Sprintf("select count(*) from routers %s", filter),
+			filterArgs...,
+		).Scan(&c)
+
+		if err != nil {
+			return fmt.Errorf("failed to get routers cnt: %w", mapPgError(err)), c, l
+		}
 	}
 
 	return nil, c, l
 }
 
-func (rs *PGPoolRouterStore) Update(ctx interface{}, router *Router) (error, bool) {
-	err := rs.pool.QueryRow(
-		context.Background(),
+func (rs *PGPoolRouterStore) Update(ctx context.Context, router *Router) error {
+	err := pgQuerierFromContext(ctx, rs.pool).QueryRow(
+		ctx,
 		`update routers set
 			key=COALESCE($2, key)
 		where id=$1 returning key`,
@@ -166,7 +241,7 @@ func (rs *PGPoolRouterStore) Update(ctx interface{}, router *Router) (error, boo
 		&router.Key,
 	)
 
-	return err, err == pgx.ErrNoRows
+	return mapPgError(err)
 }
 
 func NewPGPoolRouterStore(pool *pgxpool.Pool, logger LoggerFunc) RouterRepository {
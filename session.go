@@ -2,6 +2,7 @@ package repository
 
 import (
 	"fmt"
+	"context"
 	"sync"
 	"time"
 	"bytes"
@@ -38,10 +39,10 @@ type SessionSpecification interface {
 }
 
 type SessionRepository interface {
-	Add(ctx interface{}, session *Session) error
-	//Delete(ctx interface{}, session *Session) (error, bool)
-	//Update(ctx interface{}, session *Session) (error, bool)
-	Query(ctx interface{}, specification SessionSpecification) (error, int, []*Session)
+	Add(ctx context.Context, session *Session) error
+	//Delete(ctx context.Context, session *Session) error
+	//Update(ctx context.Context, session *Session) error
+	Query(ctx context.Context, specification SessionSpecification) (error, int, []*Session)
 }
 /*
 type SessionSpecificationWithLimitAndOffset struct {
@@ -81,7 +82,7 @@ type OrderedMapSessionStore struct {
 	logger   LoggerFunc
 }
 
-func (ss *OrderedMapSessionStore) Add(ctx interface{}, session *Session) error {
+func (ss *OrderedMapSessionStore) Add(ctx context.Context, session *Session) error {
 	ss.Lock()
 	defer ss.Unlock()
 
@@ -95,13 +96,13 @@ func (ss *OrderedMapSessionStore) Add(ctx interface{}, session *Session) error {
 	return nil
 }
 /*
-func (ss *OrderedMapSessionStore) Delete(ctx interface{}, session *Session) (error, bool) {
+func (ss *OrderedMapSessionStore) Delete(ctx context.Context, session *Session) error {
 	ss.Lock()
 	defer ss.Unlock()
 
 	value, present := ss.sessions.Delete(*session.Id)
 	if !present {
-		return fmt.Errorf("session with id=%v not found", *session.Id), true
+		return fmt.Errorf("session with id=%v: %w", *session.Id, ErrNotFound)
 	}
 
 	deleted := value.(Session)
@@ -109,16 +110,16 @@ func (ss *OrderedMapSessionStore) Delete(ctx interface{}, session *Session) (err
 	session.Data = deleted.Data
 	session.ExpireAt = deleted.ExpireAt
 
-	return nil, false
+	return nil
 }
 
-func (ss *OrderedMapSessionStore) Update(ctx interface{}, session *Session) (error, bool) {
+func (ss *OrderedMapSessionStore) Update(ctx context.Context, session *Session) error {
 	ss.Lock()
 	defer ss.Unlock()
 
 	value, present := ss.sessions.Get(*session.Id)
 	if !present {
-		return fmt.Errorf("session with id=%v not found", *session.Id), true
+		return fmt.Errorf("session with id=%v: %w", *session.Id, ErrNotFound)
 	}
 
 	old := value.(Session)
@@ -143,10 +144,10 @@ func (ss *OrderedMapSessionStore) Update(ctx interface{}, session *Session) (err
 
 	ss.sessions.Set(*old.Id, old)
 
-	return nil, false
+	return nil
 }
 */
-func (ss *OrderedMapSessionStore) Query(ctx interface{}, specification SessionSpecification) (error, int, []*Session) {
+func (ss *OrderedMapSessionStore) Query(ctx context.Context, specification SessionSpecification) (error, int, []*Session) {
 	ss.Lock()
 	defer ss.Unlock()
 
@@ -208,14 +209,14 @@ type HttpClientSessionStore struct {
 }
 
 func (ss *HttpClientSessionStore) makeRequest(
-	ctx interface{},
+	ctx context.Context,
 	method string,
 	uri string,
 	contentType string,
 	data string,
 ) (error, *map[string]interface{}, *int) {
 	url := fmt.Sprintf("%s/%s", ss.url, uri)
-	r, err := http.NewRequest(method, url, strings.NewReader(data))
+	r, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(data))
 	if err != nil {
 		return fmt.Errorf("can not make new request: %v", err), nil, nil
 	}
@@ -225,7 +226,7 @@ func (ss *HttpClientSessionStore) makeRequest(
 
 	res, err := ss.client.Do(r)
 	if err != nil {
-		return fmt.Errorf("can not do request: %v", err), nil, nil
+		return fmt.Errorf("can not do request: %w", NewRepositoryError(ErrUnavailable, err)), nil, nil
 	}
 	defer res.Body.Close()
 
@@ -234,6 +235,10 @@ func (ss *HttpClientSessionStore) makeRequest(
 		return fmt.Errorf("can not read body: %v", err), nil, nil
 	}
 
+	if err := httpStatusError(res.StatusCode); err != nil {
+		return fmt.Errorf("request failed: %w", err), nil, &res.StatusCode
+	}
+
 	var jsonResp map[string]interface{}
 	if err := json.Unmarshal(body, &jsonResp); err != nil {
 		return fmt.Errorf("can not unmarshal body: %v", err), nil, nil
@@ -256,7 +261,7 @@ func (ss *HttpClientSessionStore) unmarshalSessionData(jsonResp *map[string]inte
 	return nil
 }
 
-func (ss *HttpClientSessionStore) Add(ctx interface{}, session *Session) error {
+func (ss *HttpClientSessionStore) Add(ctx context.Context, session *Session) error {
 	body, err := json.Marshal(session.Data)
 	if err != nil {
 		return fmt.Errorf("can not marshal session data: %v", err)
@@ -274,7 +279,7 @@ func (ss *HttpClientSessionStore) Add(ctx interface{}, session *Session) error {
 
 	err, jsonResp, _ := ss.makeRequest(ctx, "POST", "v1/sessions", "application/json; charset=utf-8", string(jsonbody))
 	if err != nil {
-		return fmt.Errorf("can not make add session request: %v", err)
+		return fmt.Errorf("can not make add session request: %w", err)
 	}
 
 	if err := ss.unmarshalSessionData(jsonResp); err != nil {
@@ -314,7 +319,7 @@ func (ss *HttpClientSessionStore) appendToList (l *[]*Session, data *map[string]
 	return nil
 }
 
-func (ss *HttpClientSessionStore) Query(ctx interface{}, specification SessionSpecification) (error, int, []*Session) {
+func (ss *HttpClientSessionStore) Query(ctx context.Context, specification SessionSpecification) (error, int, []*Session) {
 	var l []*Session
 	var c int = 0
 
@@ -322,12 +327,20 @@ func (ss *HttpClientSessionStore) Query(ctx interface{}, specification SessionSp
 		"v1/sessions%s",
 		specification.ToQwrStr()),
 	"application/x-www-form-urlencoded", "")
+	if errors.Is(err, ErrNotFound) {
+		return nil, c, l
+	}
+
 	if err != nil {
-		return fmt.Errorf("can not make query session request: %v", err), c, l
+		return fmt.Errorf("can not make query session request: %w", err), c, l
 	}
 
 	if data, ok := (*jsonResp)["data"]; ok {
 		if rows, ok := data.([]interface{}); ok {
+			c = len(rows)
+			if total, ok := (*jsonResp)["total"].(float64); ok {
+				c = int(total)
+			}
 			for _, row := range rows {
 				if r, ok := row.(map[string]interface{}); ok {
 					if err := ss.appendToList(&l, &r); err != nil {
@@ -344,6 +357,7 @@ func (ss *HttpClientSessionStore) Query(ctx interface{}, specification SessionSp
 		if err := ss.appendToList(&l, jsonResp); err != nil {
 			return fmt.Errorf("can not append to list: %v", err), c, l
 		}
+		c = 1
 	}
 
 	return nil, c, l
@@ -0,0 +1,376 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+	"strings"
+	"github.com/jackc/pgx/v4"
+)
+
+type LoadDepth int
+
+const (
+	LoadFullGraph LoadDepth = iota
+	LoadOneLevel
+	LoadIDsOnly
+)
+
+// LoadOptions choose which related entities a query hydrates. Relations
+// restricts hydration to the named ones, the rest keep their ids only.
+type LoadOptions struct {
+	Depth     LoadDepth
+	Relations []string
+}
+
+func NewLoadOptions(depth LoadDepth, relations ...string) *LoadOptions {
+	return &LoadOptions{
+		Depth:     depth,
+		Relations: relations,
+	}
+}
+
+func (lo *LoadOptions) Hydrates(relation string) bool {
+	if lo == nil {
+		return true
+	}
+
+	if lo.Depth == LoadIDsOnly {
+		return false
+	}
+
+	if len(lo.Relations) == 0 {
+		return true
+	}
+
+	for _, r := range lo.Relations {
+		if r == relation {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Nested returns the options related entities are queried with.
+func (lo *LoadOptions) Nested() *LoadOptions {
+	if lo == nil || lo.Depth == LoadFullGraph {
+		return nil
+	}
+
+	return NewLoadOptions(LoadIDsOnly)
+}
+
+type SqlOrder struct {
+	Column string
+	Desc   bool
+}
+
+// SqlClauses is what a specification contributes to a select statement.
+// Where conditions use "?" placeholders, they are numbered by Build.
+// Order columns are quoted identifiers, stores check them with
+// checkOrderBy.
+type SqlClauses struct {
+	Where   string
+	Args    []interface{}
+	OrderBy []SqlOrder
+	Limit   *int
+	Offset  *int
+	Load    *LoadOptions
+}
+
+func NewSqlWhereClauses(where string, args ...interface{}) *SqlClauses {
+	return &SqlClauses{
+		Where: where,
+		Args:  args,
+	}
+}
+
+func NewSqlLimitAndOffsetClauses(limit int, offset int) *SqlClauses {
+	return &SqlClauses{
+		Limit:  &limit,
+		Offset: &offset,
+	}
+}
+
+func (sc *SqlClauses) Filter() *SqlClauses {
+	return &SqlClauses{
+		Where: sc.Where,
+		Args:  sc.Args,
+	}
+}
+
+func (sc *SqlClauses) Build() (string, []interface{}) {
+	var parts []string
+	args := append([]interface{}{}, sc.Args...)
+
+	if sc.Where != "" {
+		parts = append(parts, fmt.Sprintf("where %s", bindPlaceholders(sc.Where)))
+	}
+
+	if len(sc.OrderBy) > 0 {
+		var columns []string
+		for _, order := range sc.OrderBy {
+			column := pgx.Identifier{order.Column}.Sanitize()
+			if order.Desc {
+				column = fmt.Sprintf("%s desc", column)
+			}
+			columns = append(columns, column)
+		}
+		parts = append(parts, fmt.Sprintf("order by %s", strings.Join(columns, ", ")))
+	}
+
+	if sc.Limit != nil {
+		args = append(args, *sc.Limit)
+		parts = append(parts, fmt.Sprintf("limit $%d", len(args)))
+	}
+
+	if sc.Offset != nil {
+		args = append(args, *sc.Offset)
+		parts = append(parts, fmt.Sprintf("offset $%d", len(args)))
+	}
+
+	return strings.Join(parts, " "), args
+}
+
+// checkOrderBy rejects an order column missing in columns. Order columns
+// are quoted into the statement, not passed as args, so only known ones
+// are let through.
+func (sc *SqlClauses) checkOrderBy(columns ...string) error {
+	for _, order := range sc.OrderBy {
+		known := false
+		for _, column := range columns {
+			known = known || column == order.Column
+		}
+
+		if !known {
+			return fmt.Errorf("can not order by %q: %w", order.Column, ErrValidation)
+		}
+	}
+
+	return nil
+}
+
+func bindPlaceholders(query string) string {
+	var b strings.Builder
+	n := 0
+
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+func andSqlClauses(clauses ...*SqlClauses) *SqlClauses {
+	result := &SqlClauses{}
+	var conditions []string
+
+	for _, c := range clauses {
+		if c.Where != "" {
+			conditions = append(conditions, fmt.Sprintf("(%s)", c.Where))
+			result.Args = append(result.Args, c.Args...)
+		}
+		result.OrderBy = append(result.OrderBy, c.OrderBy...)
+		if c.Limit != nil {
+			result.Limit = c.Limit
+		}
+		if c.Offset != nil {
+			result.Offset = c.Offset
+		}
+		if c.Load != nil {
+			result.Load = c.Load
+		}
+	}
+	result.Where = strings.Join(conditions, " and ")
+
+	return result
+}
+
+func orSqlClauses(clauses ...*SqlClauses) *SqlClauses {
+	result := &SqlClauses{}
+	var conditions []string
+
+	for _, c := range clauses {
+		if c.Where == "" {
+			return &SqlClauses{}
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s)", c.Where))
+		result.Args = append(result.Args, c.Args...)
+	}
+
+	if len(conditions) == 0 {
+		result.Where = "false"
+	} else {
+		result.Where = strings.Join(conditions, " or ")
+	}
+
+	return result
+}
+
+func notSqlClauses(clauses *SqlClauses) *SqlClauses {
+	if clauses.Where == "" {
+		return NewSqlWhereClauses("false")
+	}
+
+	return NewSqlWhereClauses(fmt.Sprintf("not (%s)", clauses.Where), clauses.Args...)
+}
+
+func orderBySqlClauses(clauses *SqlClauses, column string, desc bool) *SqlClauses {
+	result := *clauses
+	result.OrderBy = append(append([]SqlOrder{}, clauses.OrderBy...), SqlOrder{
+		Column: column,
+		Desc:   desc,
+	})
+
+	return &result
+}
+
+func pagedSqlClauses(clauses *SqlClauses, limit int, offset int) *SqlClauses {
+	result := *clauses
+	result.Limit = &limit
+	result.Offset = &offset
+
+	return &result
+}
+
+func loadSqlClauses(clauses *SqlClauses, load *LoadOptions) *SqlClauses {
+	result := *clauses
+	result.Load = load
+
+	return &result
+}
+
+type SqlSpecification interface {
+	ToSqlClauses() *SqlClauses
+}
+
+type SqlSpecificationAnd struct {
+	specs []SqlSpecification
+}
+
+func (ssand *SqlSpecificationAnd) ToSqlClauses() *SqlClauses {
+	var clauses []*SqlClauses
+	for _, spec := range ssand.specs {
+		clauses = append(clauses, spec.ToSqlClauses())
+	}
+	return andSqlClauses(clauses...)
+}
+
+type SqlSpecificationOr struct {
+	specs []SqlSpecification
+}
+
+func (ssor *SqlSpecificationOr) ToSqlClauses() *SqlClauses {
+	var clauses []*SqlClauses
+	for _, spec := range ssor.specs {
+		clauses = append(clauses, spec.ToSqlClauses())
+	}
+	return orSqlClauses(clauses...)
+}
+
+type SqlSpecificationNot struct {
+	spec SqlSpecification
+}
+
+func (ssnot *SqlSpecificationNot) ToSqlClauses() *SqlClauses {
+	return notSqlClauses(ssnot.spec.ToSqlClauses())
+}
+
+type SqlSpecificationOrderBy struct {
+	spec   SqlSpecification
+	column string
+	desc   bool
+}
+
+func (ssob *SqlSpecificationOrderBy) ToSqlClauses() *SqlClauses {
+	return orderBySqlClauses(ssob.spec.ToSqlClauses(), ssob.column, ssob.desc)
+}
+
+type SqlSpecificationPaged struct {
+	spec   SqlSpecification
+	limit  int
+	offset int
+}
+
+func (ssp *SqlSpecificationPaged) ToSqlClauses() *SqlClauses {
+	return pagedSqlClauses(ssp.spec.ToSqlClauses(), ssp.limit, ssp.offset)
+}
+
+type SqlSpecificationWithLoad struct {
+	spec SqlSpecification
+	load *LoadOptions
+}
+
+func (sswl *SqlSpecificationWithLoad) ToSqlClauses() *SqlClauses {
+	return loadSqlClauses(sswl.spec.ToSqlClauses(), sswl.load)
+}
+
+func compareIntPtr(a *int, b *int) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	case *a < *b:
+		return -1
+	case *a > *b:
+		return 1
+	}
+	return 0
+}
+
+func compareStringPtr(a *string, b *string) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	return strings.Compare(*a, *b)
+}
+
+func compareTimePtr(a *time.Time, b *time.Time) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	case a.Before(*b):
+		return -1
+	case a.After(*b):
+		return 1
+	}
+	return 0
+}
+
+func pageBounds(clauses *SqlClauses, length int) (int, int) {
+	start, end := 0, length
+
+	if clauses.Offset != nil && *clauses.Offset > 0 {
+		start = *clauses.Offset
+	}
+	if start > length {
+		start = length
+	}
+
+	if clauses.Limit != nil && start + *clauses.Limit < end {
+		end = start + *clauses.Limit
+	}
+	// a negative limit selects nothing
+	if end < start {
+		end = start
+	}
+
+	return start, end
+}
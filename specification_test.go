@@ -0,0 +1,226 @@
+package repository
+
+import (
+	"errors"
+	"regexp"
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"github.com/wk8/go-ordered-map"
+)
+
+func TestPageBounds(t *testing.T) {
+	limit := func(n int) *int { return &n }
+
+	cases := []struct {
+		name   string
+		limit  *int
+		offset *int
+		start  int
+		end    int
+	}{
+		{"unbounded", nil, nil, 0, 5},
+		{"limit", limit(2), nil, 0, 2},
+		{"offset", nil, limit(3), 3, 5},
+		{"offset past end", limit(2), limit(7), 5, 5},
+		{"negative limit", limit(-1), nil, 0, 0},
+		{"negative limit with offset", limit(-3), limit(2), 2, 2},
+		{"negative offset", limit(2), limit(-1), 0, 2},
+	}
+
+	for _, c := range cases {
+		start, end := pageBounds(&SqlClauses{Limit: c.limit, Offset: c.offset}, 5)
+		if start != c.start || end != c.end {
+			t.Errorf("%s: got [%d:%d], want [%d:%d]", c.name, start, end, c.start, c.end)
+		}
+	}
+}
+
+func TestOrderedMapQueryWithNegativeLimit(t *testing.T) {
+	ctx := context.Background()
+	store := NewOrderedMapCurrencyStore(orderedmap.New(), testLogger)
+
+	for _, code := range []string{"USD", "EUR"} {
+		code := code
+		if err := store.Add(ctx, &Currency{CharCode: &code}); err != nil {
+			t.Fatalf("can not add currency: %v", err)
+		}
+	}
+
+	err, _, l := store.Query(ctx, NewCurrencySpecificationWithLimitAndOffset(-1, 0))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+
+	if len(l) != 0 {
+		t.Errorf("got %d currencies, want none", len(l))
+	}
+}
+
+var hostileKeys = []string{
+	"key' or '1'='1",
+	"'; drop table profiles; --",
+	"$1",
+	"$1' or key='$2",
+	"?",
+	"? or true --",
+	`\'`,
+	"key\x00",
+}
+
+var placeholderRegexp = regexp.MustCompile(`\$(\d+)`)
+
+// checkBuild builds the clauses and checks that every value went to args
+// and that the placeholders are numbered 1..len(args) in order.
+func checkBuild(t *testing.T, name string, spec SqlSpecification, wantSql string, wantArgs ...interface{}) {
+	t.Helper()
+
+	sql, args := spec.ToSqlClauses().Build()
+
+	if sql != wantSql {
+		t.Errorf("%s: got sql %q, want %q", name, sql, wantSql)
+	}
+
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("%s: got args %#v, want %#v", name, args, wantArgs)
+	}
+
+	for _, arg := range wantArgs {
+		if s, ok := arg.(string); ok && len(s) > 2 && strings.Contains(sql, s) {
+			t.Errorf("%s: value %q leaked into sql %q", name, s, sql)
+		}
+	}
+
+	if strings.Contains(sql, "?") {
+		t.Errorf("%s: unbound placeholder in sql %q", name, sql)
+	}
+
+	for i, m := range placeholderRegexp.FindAllStringSubmatch(sql, -1) {
+		if n, _ := strconv.Atoi(m[1]); n != i+1 {
+			t.Errorf("%s: placeholder #%d is $%d in sql %q", name, i+1, n, sql)
+		}
+	}
+}
+
+func TestHostileKeysStayInArgs(t *testing.T) {
+	for _, key := range hostileKeys {
+		checkBuild(t, "profile by key", NewProfileSpecificationByKey(key), "where key=$1", key)
+		checkBuild(t, "channel by key", NewChannelSpecificationByKey(key), "where key=$1", key)
+		checkBuild(
+			t,
+			"transaction by reference and status",
+			NewTransactionSpecificationByReferenceIdAndStatus(7, key),
+			"where reference_id=$1 and status=$2",
+			7,
+			key,
+		)
+	}
+}
+
+func TestNestedPlaceholdersAreNumbered(t *testing.T) {
+	for _, key := range hostileKeys {
+		checkBuild(
+			t,
+			"profile and/or/not paged",
+			NewProfileSpecificationPaged(
+				NewProfileSpecificationAnd(
+					NewProfileSpecificationByKey(key),
+					NewProfileSpecificationOr(
+						NewProfileSpecificationByKey("$2"),
+						NewProfileSpecificationNot(NewProfileSpecificationByID(3)),
+					),
+				),
+				10,
+				20,
+			),
+			"where (key=$1) and ((key=$2) or (not (id=$3))) limit $4 offset $5",
+			key, "$2", 3, 10, 20,
+		)
+
+		checkBuild(
+			t,
+			"channel or/not/and paged",
+			NewChannelSpecificationPaged(
+				NewChannelSpecificationOr(
+					NewChannelSpecificationNot(NewChannelSpecificationByKey(key)),
+					NewChannelSpecificationAnd(
+						NewChannelSpecificationByID(1),
+						NewChannelSpecificationByKey("?"),
+					),
+				),
+				5,
+				0,
+			),
+			"where (not (key=$1)) or ((id=$2) and (key=$3)) limit $4 offset $5",
+			key, 1, "?", 5, 0,
+		)
+
+		checkBuild(
+			t,
+			"transaction and/not with paged operand",
+			NewTransactionSpecificationAnd(
+				NewTransactionSpecificationNot(NewTransactionSpecificationByReferenceIdAndStatus(7, key)),
+				NewTransactionSpecificationPaged(NewTransactionSpecificationByReferenceIdAndStatus(8, "$1"), 1, 2),
+			),
+			"where (not (reference_id=$1 and status=$2)) and (reference_id=$3 and status=$4) limit $5 offset $6",
+			7, key, 8, "$1", 1, 2,
+		)
+	}
+}
+
+func TestOrderColumnPlaceholderIsNotNumbered(t *testing.T) {
+	spec := NewCurrencySpecificationPaged(
+		NewCurrencySpecificationOrderBy(NewCurrencySpecificationByCharCode("USD"), "char?code", true),
+		10,
+		20,
+	)
+
+	sql, args := spec.ToSqlClauses().Build()
+
+	want := `where char_code=$1 order by "char?code" desc limit $2 offset $3`
+	if sql != want {
+		t.Errorf("got sql %q, want %q", sql, want)
+	}
+
+	if !reflect.DeepEqual(args, []interface{}{"USD", 10, 20}) {
+		t.Errorf("got args %#v", args)
+	}
+}
+
+func TestUnknownOrderColumnIsRejected(t *testing.T) {
+	ctx := context.Background()
+	currencyStore := NewOrderedMapCurrencyStore(orderedmap.New(), testLogger)
+	profileStore := NewOrderedMapProfileStore(orderedmap.New(), currencyStore, testLogger)
+	rateStore := NewOrderedMapRateStore(orderedmap.New(), currencyStore, testLogger)
+	pgCurrencyStore := NewPGPoolCurrencyStore(nil, testLogger)
+
+	all := NewCurrencySpecificationWithLimitAndOffset(10, 0)
+
+	err, _, _ := currencyStore.Query(ctx, NewCurrencySpecificationOrderBy(all, "char?code", false))
+	if !errors.Is(err, ErrValidation) {
+		t.Errorf("in memory currencies: got %v, want validation error", err)
+	}
+
+	err, _, _ = pgCurrencyStore.Query(ctx, NewCurrencySpecificationOrderBy(all, "char?code", false))
+	if !errors.Is(err, ErrValidation) {
+		t.Errorf("pg currencies: got %v, want validation error", err)
+	}
+
+	err, _, _ = profileStore.Query(ctx, NewProfileSpecificationOrderBy(NewProfileSpecificationWithLimitAndOffset(10, 0), "currency", false))
+	if !errors.Is(err, ErrValidation) {
+		t.Errorf("in memory profiles: got %v, want validation error", err)
+	}
+
+	err, _, _ = rateStore.Query(ctx, NewRateSpecificationOrderBy(NewRateSpecificationWithLimitAndOffset(10, 0), "value", false))
+	if !errors.Is(err, ErrValidation) {
+		t.Errorf("in memory rates: got %v, want validation error", err)
+	}
+
+	for _, column := range currencyOrderColumns {
+		if err, _, _ := currencyStore.Query(ctx, NewCurrencySpecificationOrderBy(all, column, true)); err != nil {
+			t.Errorf("order by %s: %v", column, err)
+		}
+	}
+}
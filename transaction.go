@@ -3,6 +3,7 @@ package repository
 import (
 	"fmt"
 	"time"
+	"errors"
 	"context"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -66,6 +67,12 @@ type Transaction struct {
 	AdditionalData    *AdditionalData   `json:"additional_data"`
 	Customer          *string           `json:"customer"`
 	BrowserInfo       *BrowserInfo      `json:"browser_info"`
+	ConversionRateId  *int              `json:"conversion_rate_id"`
+	ConversionRate    *string           `json:"conversion_rate"`
+	IdempotencyKey    *string           `json:"idempotency_key"`
+	RequestHash       *string           `json:"request_hash"`
+	Version           *int              `json:"version"`
+	Updated           *time.Time        `json:"updated"`
 }
 
 func (tx *Transaction) New() {
@@ -73,33 +80,32 @@ func (tx *Transaction) New() {
 	tx.Status = &txStatus
 }
 
-func (tx *Transaction) Success() {
-	txStatus := SUCCESS
-	tx.Status = &txStatus
+func (tx *Transaction) Success() error {
+	return tx.transit(SUCCESS)
 }
 
 func (tx *Transaction) IsSuccess() bool {
 	return *tx.Status == SUCCESS
 }
 
-func (tx *Transaction) Declined(errorMsg *string) {
-	txStatus := DECLINED
-	tx.Status = &txStatus
+func (tx *Transaction) Declined(errorMsg *string) error {
+	if err := tx.transit(DECLINED); err != nil {
+		return err
+	}
 	tx.ErrorMessage = errorMsg
+	return nil
 }
 
-func (tx *Transaction) Wait3DS() {
-	txStatus := WAIT3DS
-	tx.Status = &txStatus
+func (tx *Transaction) Wait3DS() error {
+	return tx.transit(WAIT3DS)
 }
 
 func (tx *Transaction) Is3DSWaiting() bool {
 	return *tx.Status == WAIT3DS
 }
 
-func (tx *Transaction) WaitMethodUrl() {
-	txStatus := WAITMETHODURL
-	tx.Status = &txStatus
+func (tx *Transaction) WaitMethodUrl() error {
+	return tx.transit(WAITMETHODURL)
 }
 
 func (tx *Transaction) IsMethodUrlWaiting() bool {
@@ -132,6 +138,47 @@ func (tx *Transaction) IsConfirm() bool {
 	return *tx.Type == CONFIRMAUTH
 }
 
+// Money returns the transaction amount in the transaction currency, an
+// empty amount is returned as zero.
+func (tx *Transaction) Money() Money {
+	m := NewMoney(0, tx.Currency)
+	if tx.Amount != nil {
+		m.Amount = *tx.Amount
+	}
+	return m
+}
+
+func (tx *Transaction) SetMoney(m Money) {
+	tx.Amount = &m.Amount
+	tx.Currency = m.Currency
+}
+
+// MoneyConverted returns the amount charged in the account currency.
+func (tx *Transaction) MoneyConverted() Money {
+	m := NewMoney(0, tx.CurrencyConverted)
+	if tx.AmountConverted != nil {
+		m.Amount = *tx.AmountConverted
+	}
+	return m
+}
+
+func (tx *Transaction) SetMoneyConverted(m Money) {
+	tx.AmountConverted = &m.Amount
+	tx.CurrencyConverted = m.Currency
+}
+
+// needsConversion reports whether the account charges in a currency other
+// than the transaction currency and is allowed to convert.
+func (tx *Transaction) needsConversion() bool {
+	return tx.Account != nil &&
+		tx.Account.CurrencyConversionEnabled != nil &&
+		*tx.Account.CurrencyConversionEnabled &&
+		!sameCurrency(tx.Currency, tx.Account.Currency)
+}
+
+// NewTransaction leaves AmountConverted empty when the amount has to be
+// converted to the account currency, CurrencyConverter.ConvertTransaction
+// fills it in. Such a transaction can not be added until it is converted.
 func NewTransaction(
 	txType string,
 	orderId *string,
@@ -152,7 +199,6 @@ func NewTransaction(
 		InstrumentId: instrumentId,
 		Currency: profile.Currency,
 		Amount: amount,
-		AmountConverted: amount, // @todo: convert amount to account currency from profile currency
 		CurrencyConverted: account.Currency,
 		OrderId: orderId,
 		Reference: reference,
@@ -160,25 +206,35 @@ func NewTransaction(
 		BrowserInfo: browserInfo,
 	}
 
+	if !transaction.needsConversion() {
+		transaction.AmountConverted = amount
+	}
+
 	transaction.New()
 
 	return transaction
 }
 
+// TurnOverResult holds the number of transactions and their sums, one per
+// currency so amounts in different currencies are never added up.
 type TurnOverResult struct {
 	Cnt uint
-	Sum uint
+	Sum []Money
 }
 
 type TransactionSpecification interface {
-	ToSqlClauses() string
+	ToSqlClauses() *SqlClauses
 }
 
 type TransactionRepository interface {
-	Add(ctx interface{}, transaction *Transaction) error
-	Update(ctx interface{}, transaction *Transaction) (error, bool)
-	Query(ctx interface{}, specification TransactionSpecification) (error, int, []*Transaction)
-	TypeTurnOver(ctx interface{}, specification TransactionSpecification) (error, *map[string]TurnOverResult)
+	Add(ctx context.Context, transaction *Transaction) error
+	Update(ctx context.Context, transaction *Transaction) error
+	Query(ctx context.Context, specification TransactionSpecification) (error, int, []*Transaction)
+	TypeTurnOver(ctx context.Context, specification TransactionSpecification) (error, *map[string]TurnOverResult)
+	TurnOver(ctx context.Context, specification TransactionSpecification, dimensions ...TurnOverDimension) (error, []*TurnOverRow)
+	Balance(ctx context.Context, parent *Transaction) (error, *TransactionBalance)
+	AddReferenced(ctx context.Context, transaction *Transaction) error
+	AddIdempotent(ctx context.Context, transaction *Transaction) (error, bool)
 }
 
 type TransactionSpecificationWithLimitAndOffset struct {
@@ -186,16 +242,24 @@ type TransactionSpecificationWithLimitAndOffset struct {
 	offset int
 }
 
-func (tswlao *TransactionSpecificationWithLimitAndOffset) ToSqlClauses() string {
-	return fmt.Sprintf("limit %d offset %d", tswlao.limit, tswlao.offset)
+func (tswlao *TransactionSpecificationWithLimitAndOffset) ToSqlClauses() *SqlClauses {
+	return NewSqlLimitAndOffsetClauses(tswlao.limit, tswlao.offset)
 }
 
 type TransactionSpecificationByID struct {
 	id int
 }
 
-func (tsbyid *TransactionSpecificationByID) ToSqlClauses() string {
-	return fmt.Sprintf("where id=%d", tsbyid.id)
+func (tsbyid *TransactionSpecificationByID) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=?", tsbyid.id)
+}
+
+type TransactionSpecificationByIDs struct {
+	ids []int
+}
+
+func (tsbyids *TransactionSpecificationByIDs) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("id=any(?)", tsbyids.ids)
 }
 
 type TransactionSpecificationByReferenceIdAndStatus struct {
@@ -203,14 +267,138 @@ type TransactionSpecificationByReferenceIdAndStatus struct {
 	status string
 }
 
-func (spec *TransactionSpecificationByReferenceIdAndStatus) ToSqlClauses() string {
-	return fmt.Sprintf("where reference_id=%d and status='%s'", spec.id, spec.status)
+func (spec *TransactionSpecificationByReferenceIdAndStatus) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("reference_id=? and status=?", spec.id, spec.status)
+}
+
+type TransactionSpecificationByOrderId struct {
+	orderId string
+}
+
+func (tsbyorderid *TransactionSpecificationByOrderId) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("order_id=?", tsbyorderid.orderId)
+}
+
+type TransactionSpecificationByRemoteId struct {
+	remoteId string
+}
+
+func (tsbyremoteid *TransactionSpecificationByRemoteId) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("remote_id=?", tsbyremoteid.remoteId)
+}
+
+type TransactionSpecificationByRRN struct {
+	rrn string
+}
+
+func (tsbyrrn *TransactionSpecificationByRRN) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("rrn=?", tsbyrrn.rrn)
+}
+
+type TransactionSpecificationByAuthCode struct {
+	authCode string
+}
+
+func (tsbyauthcode *TransactionSpecificationByAuthCode) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("authcode=?", tsbyauthcode.authCode)
+}
+
+type TransactionSpecificationByCustomer struct {
+	customer string
+}
+
+func (tsbycustomer *TransactionSpecificationByCustomer) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("customer=?", tsbycustomer.customer)
+}
+
+type TransactionSpecificationByProfileId struct {
+	profileId int
+}
+
+func (tsbyprofileid *TransactionSpecificationByProfileId) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("profile_id=?", tsbyprofileid.profileId)
+}
+
+type TransactionSpecificationByAccountId struct {
+	accountId int
+}
+
+func (tsbyaccountid *TransactionSpecificationByAccountId) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("account_id=?", tsbyaccountid.accountId)
+}
+
+// TransactionSpecificationByCard matches transactions paid with the same
+// card, which is identified by the instrument and the id of the card stored
+// with that instrument.
+type TransactionSpecificationByCard struct {
+	instrumentId int
+	cardId       int
+}
+
+func (tsbycard *TransactionSpecificationByCard) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("instrument_id=? and instrument=?", tsbycard.instrumentId, tsbycard.cardId)
+}
+
+type TransactionSpecificationByStatuses struct {
+	statuses []string
+}
+
+func (tsbystatuses *TransactionSpecificationByStatuses) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("status=any(?)", tsbystatuses.statuses)
+}
+
+type TransactionSpecificationByTypes struct {
+	types []string
+}
+
+func (tsbytypes *TransactionSpecificationByTypes) ToSqlClauses() *SqlClauses {
+	return NewSqlWhereClauses("type=any(?)", tsbytypes.types)
+}
+
+// TransactionSpecificationCreatedBetween matches transactions created in
+// [from, to), an empty bound is left open.
+type TransactionSpecificationCreatedBetween struct {
+	from *time.Time
+	to   *time.Time
+}
+
+func (tscb *TransactionSpecificationCreatedBetween) ToSqlClauses() *SqlClauses {
+	clauses := []*SqlClauses{}
+	if tscb.from != nil {
+		clauses = append(clauses, NewSqlWhereClauses("created>=?", *tscb.from))
+	}
+	if tscb.to != nil {
+		clauses = append(clauses, NewSqlWhereClauses("created<?", *tscb.to))
+	}
+	return andSqlClauses(clauses...)
+}
+
+// TransactionSpecificationAmountBetween matches transactions with amount
+// in [min, max], an empty bound is left open.
+type TransactionSpecificationAmountBetween struct {
+	min *uint
+	max *uint
+}
+
+func (tsab *TransactionSpecificationAmountBetween) ToSqlClauses() *SqlClauses {
+	clauses := []*SqlClauses{}
+	if tsab.min != nil {
+		clauses = append(clauses, NewSqlWhereClauses("amount>=?", *tsab.min))
+	}
+	if tsab.max != nil {
+		clauses = append(clauses, NewSqlWhereClauses("amount<=?", *tsab.max))
+	}
+	return andSqlClauses(clauses...)
 }
 
 func NewTransactionSpecificationByID(id int) TransactionSpecification {
 	return &TransactionSpecificationByID{id: id}
 }
 
+func NewTransactionSpecificationByIDs(ids []int) TransactionSpecification {
+	return &TransactionSpecificationByIDs{ids: ids}
+}
+
 func NewTransactionSpecificationWithLimitAndOffset(limit int, offset int) TransactionSpecification {
 	return &TransactionSpecificationWithLimitAndOffset{
 		limit:  limit,
@@ -225,6 +413,108 @@ func NewTransactionSpecificationByReferenceIdAndStatus(id int, status string) Tr
 	}
 }
 
+func NewTransactionSpecificationByOrderId(orderId string) TransactionSpecification {
+	return &TransactionSpecificationByOrderId{orderId: orderId}
+}
+
+func NewTransactionSpecificationByRemoteId(remoteId string) TransactionSpecification {
+	return &TransactionSpecificationByRemoteId{remoteId: remoteId}
+}
+
+func NewTransactionSpecificationByRRN(rrn string) TransactionSpecification {
+	return &TransactionSpecificationByRRN{rrn: rrn}
+}
+
+func NewTransactionSpecificationByAuthCode(authCode string) TransactionSpecification {
+	return &TransactionSpecificationByAuthCode{authCode: authCode}
+}
+
+func NewTransactionSpecificationByCustomer(customer string) TransactionSpecification {
+	return &TransactionSpecificationByCustomer{customer: customer}
+}
+
+func NewTransactionSpecificationByProfileId(profileId int) TransactionSpecification {
+	return &TransactionSpecificationByProfileId{profileId: profileId}
+}
+
+func NewTransactionSpecificationByAccountId(accountId int) TransactionSpecification {
+	return &TransactionSpecificationByAccountId{accountId: accountId}
+}
+
+func NewTransactionSpecificationByCard(instrumentId int, cardId int) TransactionSpecification {
+	return &TransactionSpecificationByCard{
+		instrumentId: instrumentId,
+		cardId:       cardId,
+	}
+}
+
+func NewTransactionSpecificationByStatuses(statuses ...string) TransactionSpecification {
+	return &TransactionSpecificationByStatuses{statuses: statuses}
+}
+
+func NewTransactionSpecificationByTypes(types ...string) TransactionSpecification {
+	return &TransactionSpecificationByTypes{types: types}
+}
+
+func NewTransactionSpecificationCreatedBetween(from *time.Time, to *time.Time) TransactionSpecification {
+	return &TransactionSpecificationCreatedBetween{
+		from: from,
+		to:   to,
+	}
+}
+
+func NewTransactionSpecificationAmountBetween(min *uint, max *uint) TransactionSpecification {
+	return &TransactionSpecificationAmountBetween{
+		min: min,
+		max: max,
+	}
+}
+
+func NewTransactionSpecificationAnd(specs ...TransactionSpecification) TransactionSpecification {
+	l := make([]SqlSpecification, 0, len(specs))
+	for _, spec := range specs {
+		l = append(l, spec)
+	}
+	return &SqlSpecificationAnd{specs: l}
+}
+
+func NewTransactionSpecificationOr(specs ...TransactionSpecification) TransactionSpecification {
+	l := make([]SqlSpecification, 0, len(specs))
+	for _, spec := range specs {
+		l = append(l, spec)
+	}
+	return &SqlSpecificationOr{specs: l}
+}
+
+func NewTransactionSpecificationNot(spec TransactionSpecification) TransactionSpecification {
+	return &SqlSpecificationNot{spec: spec}
+}
+
+var transactionOrderColumns = []string{"id", "created", "type", "status", "profile_id", "account_id", "amount", "currency_id", "order_id", "customer", "version", "updated"}
+
+func NewTransactionSpecificationOrderBy(spec TransactionSpecification, column string, desc bool) TransactionSpecification {
+	return &SqlSpecificationOrderBy{
+		spec:   spec,
+		column: column,
+		desc:   desc,
+	}
+}
+
+func NewTransactionSpecificationPaged(spec TransactionSpecification, limit int, offset int) TransactionSpecification {
+	return &SqlSpecificationPaged{
+		spec:   spec,
+		limit:  limit,
+		offset: offset,
+	}
+}
+
+func NewTransactionSpecificationWithLoad(spec TransactionSpecification, load *LoadOptions) TransactionSpecification {
+	return &SqlSpecificationWithLoad{
+		spec: spec,
+		load: load,
+	}
+}
+
 type PGPoolTransactionStore struct {
 	pool            *pgxpool.Pool
 	profileStore    ProfileRepository
@@ -234,7 +524,40 @@ type PGPoolTransactionStore struct {
 	logger          LoggerFunc
 }
 
-func (ts *PGPoolTransactionStore) Add(ctx interface{}, transaction *Transaction) error {
+func (ts *PGPoolTransactionStore) Add(ctx context.Context, transaction *Transaction) error {
+	err, inserted := ts.insert(ctx, transaction)
+	if err != nil {
+		return err
+	}
+
+	if !inserted {
+		return fmt.Errorf("idempotency key %s: %w", *transaction.IdempotencyKey, ErrIdempotencyKeyReused)
+	}
+
+	return nil
+}
+
+// insert stores the transaction and its created event in one database
+// transaction. It returns false when the idempotency key is taken.
+func (ts *PGPoolTransactionStore) insert(ctx context.Context, transaction *Transaction) (error, bool) {
+	var inserted bool
+
+	uow := NewPGPoolUnitOfWork(ts.pool, ts.logger)
+
+	err := uow.Do(ctx, func(ctx context.Context) error {
+		var err error
+
+		if err, inserted = ts.insertRow(ctx, transaction); err != nil || !inserted {
+			return err
+		}
+
+		return ts.enqueueEvent(ctx, transaction, TRANSACTION_CREATED, nil)
+	})
+
+	return err, inserted
+}
+
+func (ts *PGPoolTransactionStore) insertRow(ctx context.Context, transaction *Transaction) (error, bool) {
 	var profileId           *int
 	var accountId           *int
 	var instrumentId        *int
@@ -242,6 +565,10 @@ func (ts *PGPoolTransactionStore) Add(ctx interface{}, transaction *Transaction)
 	var currencyConvertedId *int
 	var referenceId         *int
 
+	if transaction.needsConversion() && transaction.AmountConverted == nil {
+		return fmt.Errorf("transaction needs conversion, amount converted is not set: %w", ErrValidation), false
+	}
+
 	if transaction.Profile != nil {
 		profileId = transaction.Profile.Id
 	}
@@ -266,8 +593,8 @@ func (ts *PGPoolTransactionStore) Add(ctx interface{}, transaction *Transaction)
 		referenceId = transaction.Reference.Id
 	}
 
-	return ts.pool.QueryRow(
-		context.Background(),
+	err := pgQuerierFromContext(ctx, ts.pool).QueryRow(
+		ctx,
 		`insert into transactions (
 			type,
 			status,
@@ -291,8 +618,14 @@ func (ts *PGPoolTransactionStore) Add(ctx interface{}, transaction *Transaction)
 			error_message,
 			additional_data,
 			customer,
-			browser_info
-		) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23) returning id, created`,
+			browser_info,
+			conversion_rate_id,
+			conversion_rate,
+			idempotency_key,
+			request_hash
+		) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25::numeric, $26, $27)
+		on conflict (profile_id, idempotency_key) where idempotency_key is not null do nothing
+		returning id, created, version, updated`,
 		transaction.Type,
 		transaction.Status,
 		profileId,
@@ -316,217 +649,204 @@ func (ts *PGPoolTransactionStore) Add(ctx interface{}, transaction *Transaction)
 		transaction.AdditionalData,
 		transaction.Customer,
 		transaction.BrowserInfo,
-	).Scan(&transaction.Id, &transaction.Created)
-}
-
-func (ts *PGPoolTransactionStore) refreshTransactionProfile(ctx interface{}, transaction *Transaction) error {
-	if !(transaction.Profile != nil && transaction.Profile.Id != nil) {
-		return nil
-	}
-
-	err, _, profiles := ts.profileStore.Query(ctx, NewProfileSpecificationByID(
-		*transaction.Profile.Id,
-	))
-
-	if err != nil {
-		return fmt.Errorf("Can not update transaction profile: %v", err)
-	}
-
-	for _, profile := range profiles {
-		transaction.Profile = profile
+		transaction.ConversionRateId,
+		transaction.ConversionRate,
+		transaction.IdempotencyKey,
+		transaction.RequestHash,
+	).Scan(&transaction.Id, &transaction.Created, &transaction.Version, &transaction.Updated)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, false
 	}
 
-	return nil
+	return mapPgError(err), err == nil
 }
 
-func (ts *PGPoolTransactionStore) refreshTransactionAccount(ctx interface{}, transaction *Transaction) error {
-	if !(transaction.Account != nil && transaction.Account.Id != nil) {
-		return nil
-	}
-
-	err, _, accounts := ts.accountStore.Query(ctx, NewAccountSpecificationByID(
-		*transaction.Account.Id,
-	))
-
-	if err != nil {
-		return fmt.Errorf("Can not update transaction account: %v", err)
-	}
-
-	for _, account := range accounts {
-		transaction.Account = account
-	}
-
-	return nil
-}
+func (ts *PGPoolTransactionStore) refreshTransactionForeigns(ctx context.Context, load *LoadOptions, transactions ...*Transaction) error {
+	profileIds := make(idSet)
+	accountIds := make(idSet)
+	instrumentIds := make(idSet)
+	currencyIds := make(idSet)
+	referenceIds := make(idSet)
 
-func (ts *PGPoolTransactionStore) refreshTransactionInstrument(ctx interface{}, transaction *Transaction) error {
-	if !(transaction.Instrument != nil && transaction.Instrument.Id != nil) {
-		return nil
+	for _, transaction := range transactions {
+		if transaction.Profile != nil && load.Hydrates("profile") {
+			profileIds.add(transaction.Profile.Id)
+		}
+		if transaction.Account != nil && load.Hydrates("account") {
+			accountIds.add(transaction.Account.Id)
+		}
+		if transaction.Instrument != nil && load.Hydrates("instrument") {
+			instrumentIds.add(transaction.Instrument.Id)
+		}
+		if transaction.Currency != nil && load.Hydrates("currency") {
+			currencyIds.add(transaction.Currency.Id)
+		}
+		if transaction.CurrencyConverted != nil && load.Hydrates("currency_converted") {
+			currencyIds.add(transaction.CurrencyConverted.Id)
+		}
+		if transaction.Reference != nil && load.Hydrates("reference") {
+			referenceIds.add(transaction.Reference.Id)
+		}
 	}
 
-	err, _, instruments := ts.instrumentStore.Query(ctx, NewInstrumentSpecificationByID(
-		*transaction.Instrument.Id,
-	))
-
+	err, profiles := profilesByIds(ctx, ts.profileStore, profileIds, load.Nested())
 	if err != nil {
-		return fmt.Errorf("Can not update transaction instrument: %v", err)
-	}
-
-	for _, instrument := range instruments {
-		transaction.Instrument = instrument
+		return fmt.Errorf("Can not update transaction profile: %w", err)
 	}
 
-	return nil
-}
-
-func (ts *PGPoolTransactionStore) refreshTransactionCurrency(ctx interface{}, transaction *Transaction) error {
-	if !(transaction.Currency != nil && transaction.Currency.Id != nil) {
-		return nil
-	}
-
-	err, _, currencies := ts.currencyStore.Query(ctx, NewCurrencySpecificationByID(
-		*transaction.Currency.Id,
-	))
-
+	err, accounts := accountsByIds(ctx, ts.accountStore, accountIds, load.Nested())
 	if err != nil {
-		return fmt.Errorf("Can not update transaction currency: %v", err)
-	}
-
-	for _, currency := range currencies {
-		transaction.Currency = currency
+		return fmt.Errorf("Can not update transaction account: %w", err)
 	}
 
-	return nil
-}
-
-func (ts *PGPoolTransactionStore) refreshTransactionCurrencyConverted(ctx interface{}, transaction *Transaction) error {
-	if !(transaction.CurrencyConverted != nil && transaction.CurrencyConverted.Id != nil) {
-		return nil
-	}
-
-	err, _, currencies := ts.currencyStore.Query(ctx, NewCurrencySpecificationByID(
-		*transaction.CurrencyConverted.Id,
-	))
-
+	err, instruments := instrumentsByIds(ctx, ts.instrumentStore, instrumentIds)
 	if err != nil {
-		return fmt.Errorf("Can not update transaction currency converted: %v", err)
-	}
-
-	for _, currency := range currencies {
-		transaction.CurrencyConverted = currency
-	}
-
-	return nil
-}
-
-func (ts *PGPoolTransactionStore) refreshTransactionReference(ctx interface{}, transaction *Transaction) error {
-	if !(transaction.Reference != nil && transaction.Reference.Id != nil) {
-		return nil
+		return fmt.Errorf("Can not update transaction instrument: %w", err)
 	}
 
-	err, _, transactions := ts.Query(ctx, NewTransactionSpecificationByID(
-		*transaction.Reference.Id,
-	))
-
+	err, currencies := currenciesByIds(ctx, ts.currencyStore, currencyIds)
 	if err != nil {
-		return fmt.Errorf("Can not update transaction reference: %v", err)
-	}
-
-	for _, tx := range transactions {
-		transaction.Reference = tx
-	}
-
-	return nil
-}
-
-func (ts *PGPoolTransactionStore) refreshTransactionForeigns(ctx interface{}, transaction *Transaction) error {
-	if err := ts.refreshTransactionProfile(ctx, transaction); err != nil {
-		return err
-	}
-
-	if err := ts.refreshTransactionAccount(ctx, transaction); err != nil {
-		return err
-	}
-
-	if err := ts.refreshTransactionInstrument(ctx, transaction); err != nil {
-		return err
+		return fmt.Errorf("Can not update transaction currency: %w", err)
 	}
 
-	if err := ts.refreshTransactionCurrency(ctx, transaction); err != nil {
-		return err
-	}
+	references := make(map[int]*Transaction)
+	if len(referenceIds) > 0 {
+		specification := NewTransactionSpecificationByIDs(referenceIds.slice())
+		if nested := load.Nested(); nested != nil {
+			specification = NewTransactionSpecificationWithLoad(specification, nested)
+		}
 
-	if err := ts.refreshTransactionCurrencyConverted(ctx, transaction); err != nil {
-		return err
+		err, _, l := ts.Query(ctx, specification)
+		if err != nil {
+			return fmt.Errorf("Can not update transaction reference: %w", err)
+		}
+		for _, reference := range l {
+			references[*reference.Id] = reference
+		}
 	}
 
-	if err := ts.refreshTransactionReference(ctx, transaction); err != nil {
-		return err
+	for _, transaction := range transactions {
+		if transaction.Profile != nil && transaction.Profile.Id != nil {
+			if profile, ok := profiles[*transaction.Profile.Id]; ok {
+				transaction.Profile = profile
+			}
+		}
+		if transaction.Account != nil && transaction.Account.Id != nil {
+			if account, ok := accounts[*transaction.Account.Id]; ok {
+				transaction.Account = account
+			}
+		}
+		if transaction.Instrument != nil && transaction.Instrument.Id != nil {
+			if instrument, ok := instruments[*transaction.Instrument.Id]; ok {
+				transaction.Instrument = instrument
+			}
+		}
+		if transaction.Currency != nil && transaction.Currency.Id != nil {
+			if currency, ok := currencies[*transaction.Currency.Id]; ok {
+				transaction.Currency = currency
+			}
+		}
+		if transaction.CurrencyConverted != nil && transaction.CurrencyConverted.Id != nil {
+			if currency, ok := currencies[*transaction.CurrencyConverted.Id]; ok {
+				transaction.CurrencyConverted = currency
+			}
+		}
+		if transaction.Reference != nil && transaction.Reference.Id != nil {
+			if reference, ok := references[*transaction.Reference.Id]; ok {
+				transaction.Reference = reference
+			}
+		}
 	}
 
 	return nil
 }
 
-func (ts *PGPoolTransactionStore) TypeTurnOver(ctx interface{}, specification TransactionSpecification) (error, *map[string]TurnOverResult) {
+func (ts *PGPoolTransactionStore) TypeTurnOver(ctx context.Context, specification TransactionSpecification) (error, *map[string]TurnOverResult) {
 	result := make(map[string]TurnOverResult)
+	currencyIds := make(idSet)
+	clauses, args := specification.ToSqlClauses().Filter().Build()
 
-	rows, err := ts.pool.Query(
-		context.Background(), fmt.Sprintf(
+	rows, err := pgQuerierFromContext(ctx, ts.pool).Query(
+		ctx, fmt.Sprintf(
 			`select
 				type,
+				currency_id,
 				count(id),
-				sum(amount)
-			from transactions %s group by type`,
-			specification.ToSqlClauses(),
+				COALESCE(sum(amount), 0)
+			from transactions %s group by type, currency_id order by type, currency_id`,
+			clauses,
 		),
+		args...,
 	)
 
 	if err != nil {
-		return fmt.Errorf("failed to query type turn over rows: %v", err), &result
+		return fmt.Errorf("failed to query type turn over rows: %w", mapPgError(err)), &result
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var opType string
-		var turnOverResult TurnOverResult
+		var currencyId *int
+		var cnt uint
+		var sum Money
 
-		if err := rows.Scan(&opType, &turnOverResult.Cnt, &turnOverResult.Sum); err != nil {
-			return fmt.Errorf("failed to get type turn over row: %v", err), &result
+		if err := rows.Scan(&opType, &currencyId, &cnt, &sum.Amount); err != nil {
+			return fmt.Errorf("failed to get type turn over row: %w", mapPgError(err)), &result
 		}
 
+		if currencyId != nil {
+			sum.Currency = &Currency{
+				Id: currencyId,
+			}
+			currencyIds.add(currencyId)
+		}
+
+		turnOverResult := result[opType]
+		turnOverResult.Cnt += cnt
+		turnOverResult.Sum = append(turnOverResult.Sum, sum)
 		result[opType] = turnOverResult
 	}
 
 	if err := rows.Err(); err != nil {
-		return fmt.Errorf("failed to iterating over rows of type turn over: %v", err), &result
+		return fmt.Errorf("failed to iterating over rows of type turn over: %w", mapPgError(err)), &result
+	}
+
+	err, currencies := currenciesByIds(ctx, ts.currencyStore, currencyIds)
+	if err != nil {
+		return fmt.Errorf("Can not update type turn over currencies: %w", err), &result
+	}
+
+	for _, turnOverResult := range result {
+		for i := range turnOverResult.Sum {
+			sum := &turnOverResult.Sum[i]
+			if sum.Currency != nil {
+				if currency, ok := currencies[*sum.Currency.Id]; ok {
+					sum.Currency = currency
+				}
+			}
+		}
 	}
 
 	return nil, &result
 }
 
-func (ts *PGPoolTransactionStore) Query(ctx interface{}, specification TransactionSpecification) (error, int, []*Transaction) {
+func (ts *PGPoolTransactionStore) Query(ctx context.Context, specification TransactionSpecification) (error, int, []*Transaction) {
 	var l []*Transaction
 	var c int = 0
 
-	conn, err := ts.pool.Acquire(context.Background())
-
-	if err != nil {
-		return fmt.Errorf("failed to acquire connection from the pool: %v", err), c, l
+	conn := pgQuerierFromContext(ctx, ts.pool)
+	sqlClauses := specification.ToSqlClauses()
+	if err := sqlClauses.checkOrderBy(transactionOrderColumns...); err != nil {
+		return err, c, l
 	}
-	defer conn.Release()
-
-	err = conn.QueryRow(
-		context.Background(),
-		"select count(*) from transactions",
-	).Scan(&c)
 
-	if err != nil {
-		return fmt.Errorf("failed to get transactions cnt: %v", err), c, l
-	}
+	clauses, args := sqlClauses.Build()
 
 	rows, err := conn.Query(
-		context.Background(), fmt.Sprintf(
+		ctx, fmt.Sprintf(
 			`select
+				count(*) over(),
 				id,
 				created,
 				type,
@@ -551,14 +871,21 @@ func (ts *PGPoolTransactionStore) Query(ctx interface{}, specification Transacti
 				error_message,
 				additional_data,
 				customer,
-				browser_info
+				browser_info,
+				conversion_rate_id,
+				conversion_rate::text,
+				idempotency_key,
+				request_hash,
+				version,
+				updated
 			from transactions %s`,
-			specification.ToSqlClauses(),
+			clauses,
 		),
+		args...,
 	)
 
 	if err != nil {
-		return fmt.Errorf("failed to query transactions rows: %v", err), c, l
+		return fmt.Errorf("failed to query transactions rows: %w", mapPgError(err)), c, l
 	}
 	defer rows.Close()
 
@@ -572,6 +899,7 @@ func (ts *PGPoolTransactionStore) Query(ctx interface{}, specification Transacti
 		var referenceId *int
 
 		if err = rows.Scan(
+			&c,
 			&transaction.Id,
 			&transaction.Created,
 			&transaction.Type,
@@ -597,8 +925,14 @@ func (ts *PGPoolTransactionStore) Query(ctx interface{}, specification Transacti
 			&transaction.AdditionalData,
 			&transaction.Customer,
 			&transaction.BrowserInfo,
+			&transaction.ConversionRateId,
+			&transaction.ConversionRate,
+			&transaction.IdempotencyKey,
+			&transaction.RequestHash,
+			&transaction.Version,
+			&transaction.Updated,
 		); err != nil {
-			return fmt.Errorf("failed to get transaction row: %v", err), c, l
+			return fmt.Errorf("failed to get transaction row: %w", mapPgError(err)), c, l
 		}
 		if profileId != nil {
 			transaction.Profile = &Profile{
@@ -630,20 +964,72 @@ func (ts *PGPoolTransactionStore) Query(ctx interface{}, specification Transacti
 				Id: referenceId,
 			}
 		}
-		if err := ts.refreshTransactionForeigns(ctx, &transaction); err != nil {
-			return fmt.Errorf("Can not update transaction foreigns: %v", err), c, l
-		}
 		l = append(l, &transaction)
 	}
 
 	if err = rows.Err(); err != nil {
-		return fmt.Errorf("failed to iterating over rows of transactions: %v", err), c, l
+		return fmt.Errorf("failed to iterating over rows of transactions: %w", mapPgError(err)), c, l
+	}
+
+	if len(l) == 0 && sqlClauses.Offset != nil && *sqlClauses.Offset > 0 {
+		filter, filterArgs := sqlClauses.Filter().Build()
+
+		err = conn.QueryRow(
+			ctx,
+			fmt.Sprintf("select count(*) from transactions %s", filter),
+			filterArgs...,
+		).Scan(&c)
+
+		if err != nil {
+			return fmt.Errorf("failed to get transactions cnt: %w", mapPgError(err)), c, l
+		}
+	}
+
+	if err := ts.refreshTransactionForeigns(ctx, sqlClauses.Load, l...); err != nil {
+		return fmt.Errorf("Can not update transaction foreigns: %w", err), c, l
 	}
 
 	return nil, c, l
 }
 
-func (ts *PGPoolTransactionStore) Update(ctx interface{}, transaction *Transaction) (error, bool) {
+// Update stores the changes and records a status changed or updated event
+// in the same database transaction. The type of a transaction can not be
+// changed, its status only along transactionTransitions. The transaction
+// has to carry the version it was read at.
+func (ts *PGPoolTransactionStore) Update(ctx context.Context, transaction *Transaction) error {
+	if err := requireVersion("transactions", transaction.Id, transaction.Version); err != nil {
+		return err
+	}
+
+	uow := NewPGPoolUnitOfWork(ts.pool, ts.logger)
+
+	return uow.Do(ctx, func(ctx context.Context) error {
+		var previousStatus string
+
+		err := pgQuerierFromContext(ctx, ts.pool).QueryRow(
+			ctx,
+			"select status from transactions where id=$1 for update",
+			transaction.Id,
+		).Scan(&previousStatus)
+
+		if err != nil {
+			return mapPgError(err)
+		}
+
+		if err := ts.update(ctx, transaction); err != nil {
+			return err
+		}
+
+		eventType := TRANSACTION_UPDATED
+		if transaction.Status != nil && *transaction.Status != previousStatus {
+			eventType = TRANSACTION_STATUS_CHANGED
+		}
+
+		return ts.enqueueEvent(ctx, transaction, eventType, &previousStatus)
+	})
+}
+
+func (ts *PGPoolTransactionStore) update(ctx context.Context, transaction *Transaction) error {
 	var profileId *int
 	var accountId *int
 	var instrumentId *int
@@ -675,10 +1061,11 @@ func (ts *PGPoolTransactionStore) Update(ctx interface{}, transaction *Transacti
 		referenceId = transaction.Reference.Id
 	}
 
-	err := ts.pool.QueryRow(
-		context.Background(),
+	transitionTypes, transitionFroms, transitionTos := transitionArrays()
+
+	err := pgQuerierFromContext(ctx, ts.pool).QueryRow(
+		ctx,
 		`update transactions set
-			type=COALESCE($2, type),
 			status=COALESCE($3, status),
 			profile_id=COALESCE($4, profile_id),
 			account_id=COALESCE($5, account_id),
@@ -700,9 +1087,28 @@ func (ts *PGPoolTransactionStore) Update(ctx interface{}, transaction *Transacti
 			error_message=COALESCE($21, error_message),
 			additional_data=COALESCE($22, additional_data),
 			customer=COALESCE($23, customer),
-			browser_info=COALESCE($24, browser_info)
+			browser_info=COALESCE($24, browser_info),
+			conversion_rate_id=COALESCE($25, conversion_rate_id),
+			conversion_rate=COALESCE($26::numeric, conversion_rate),
+			version=version+1,
+			updated=now()
 		where
-			id=$1
+			id=$1 and
+			version=$31 and
+			($2::text is null or type=$2) and
+			status<>all($30) and
+			(
+				$3::text is null or
+				status=$3 or
+				exists (
+					select 1
+					from unnest($27::text[], $28::text[], $29::text[]) as t(type, from_status, to_status)
+					where
+						t.type=transactions.type and
+						t.from_status=transactions.status and
+						t.to_status=$3
+				)
+			)
 		returning
 			type,
 			status,
@@ -726,7 +1132,11 @@ func (ts *PGPoolTransactionStore) Update(ctx interface{}, transaction *Transacti
 			error_message,
 			additional_data,
 			customer,
-			browser_info`,
+			browser_info,
+			conversion_rate_id,
+			conversion_rate::text,
+			version,
+			updated`,
 		transaction.Id,
 		transaction.Type,
 		transaction.Status,
@@ -751,6 +1161,13 @@ func (ts *PGPoolTransactionStore) Update(ctx interface{}, transaction *Transacti
 		transaction.AdditionalData,
 		transaction.Customer,
 		transaction.BrowserInfo,
+		transaction.ConversionRateId,
+		transaction.ConversionRate,
+		transitionTypes,
+		transitionFroms,
+		transitionTos,
+		finalStatuses,
+		transaction.Version,
 	).Scan(
 		&transaction.Type,
 		&transaction.Status,
@@ -775,8 +1192,20 @@ func (ts *PGPoolTransactionStore) Update(ctx interface{}, transaction *Transacti
 		&transaction.AdditionalData,
 		&transaction.Customer,
 		&transaction.BrowserInfo,
+		&transaction.ConversionRateId,
+		&transaction.ConversionRate,
+		&transaction.Version,
+		&transaction.Updated,
 	)
 
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ts.updateRejected(ctx, transaction)
+	}
+
+	if err != nil {
+		return mapPgError(err)
+	}
+
 	if profileId != nil {
 		transaction.Profile = &Profile{
 			Id: profileId,
@@ -808,11 +1237,64 @@ func (ts *PGPoolTransactionStore) Update(ctx interface{}, transaction *Transacti
 		}
 	}
 
-	if e := ts.refreshTransactionForeigns(ctx, transaction); e != nil {
-		return fmt.Errorf("Can not update transaction foreigns: %v", e), err == pgx.ErrNoRows
+	if err := ts.refreshTransactionForeigns(ctx, nil, transaction); err != nil {
+		return fmt.Errorf("Can not update transaction foreigns: %w", err)
+	}
+
+	return nil
+}
+
+// updateRejected explains why the conditional update matched no row:
+// the transaction does not exist, was changed concurrently, its type
+// would change or its status forbids the change.
+func (ts *PGPoolTransactionStore) updateRejected(ctx context.Context, transaction *Transaction) error {
+	var txType string
+	var status string
+	var version int
+
+	err := pgQuerierFromContext(ctx, ts.pool).QueryRow(
+		ctx,
+		"select type, status, version from transactions where id=$1",
+		transaction.Id,
+	).Scan(&txType, &status, &version)
+
+	if err != nil {
+		return mapPgError(err)
+	}
+
+	if transaction.Version != nil && *transaction.Version != version {
+		return fmt.Errorf(
+			"transaction with id=%v has version %d, not %d: %w",
+			*transaction.Id,
+			version,
+			*transaction.Version,
+			ErrVersionConflict,
+		)
 	}
 
-	return err, err == pgx.ErrNoRows
+	if transaction.Type != nil && *transaction.Type != txType {
+		return fmt.Errorf(
+			"%s transaction with id=%v can not become %s: %w",
+			txType,
+			*transaction.Id,
+			*transaction.Type,
+			ErrValidation,
+		)
+	}
+
+	to := status
+	if transaction.Status != nil {
+		to = *transaction.Status
+	}
+
+	return fmt.Errorf(
+		"%s transaction with id=%v can not move from %s to %s: %w",
+		txType,
+		*transaction.Id,
+		status,
+		to,
+		ErrInvalidTransition,
+	)
 }
 
 func NewPGPoolTransactionStore(
@@ -0,0 +1,242 @@
+package repository
+
+import (
+	"fmt"
+	"errors"
+	"regexp"
+	"reflect"
+	"strings"
+	"testing"
+	"context"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgconn"
+)
+
+var (
+	fakeSelectRegexp = regexp.MustCompile(`(?s)select\s+(.*?)\s+from\s+(\w+)`)
+	fakeColumnRegexp = regexp.MustCompile(`(\w+)(::\w+)?$`)
+)
+
+// countingTx stands in for the transaction of a unit of work, so every
+// PG store query lands here. It counts the queries and answers selects
+// with rows whose id and foreign key columns are set: a listing returns
+// rows 1..rows referencing parents rows+1..2*rows, a lookup by ids returns
+// a row per id.
+type countingTx struct {
+	pgx.Tx
+
+	rows    int
+	queries int
+}
+
+func (tx *countingTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	tx.queries++
+	return nil, nil
+}
+
+func (tx *countingTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return &fakeRows{err: err}
+	}
+	return rows.(*fakeRows)
+}
+
+func (tx *countingTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	tx.queries++
+
+	m := fakeSelectRegexp.FindStringSubmatch(sql)
+	if m == nil {
+		return nil, fmt.Errorf("unexpected query %q", sql)
+	}
+
+	var columns []string
+	for _, column := range strings.Split(m[1], ",") {
+		column = strings.TrimSpace(column)
+		if strings.HasPrefix(column, "count(") {
+			columns = append(columns, "count")
+			continue
+		}
+		columns = append(columns, fakeColumnRegexp.FindStringSubmatch(column)[1])
+	}
+
+	var ids []int
+	listing := true
+	if len(args) > 0 {
+		if l, ok := args[0].([]int); ok {
+			ids, listing = l, false
+		}
+	}
+	if listing {
+		for id := 1; id <= tx.rows; id++ {
+			ids = append(ids, id)
+		}
+	}
+
+	rows := &fakeRows{}
+	for _, id := range ids {
+		var values []interface{}
+		for _, column := range columns {
+			switch {
+			case column == "count":
+				values = append(values, len(ids))
+			case column == "id":
+				values = append(values, id)
+			case column == "reference_id":
+				if listing && m[2] == "transactions" {
+					values = append(values, id+tx.rows)
+				} else {
+					values = append(values, nil)
+				}
+			case column == "conversion_rate_id":
+				values = append(values, nil)
+			case strings.HasSuffix(column, "_id"):
+				values = append(values, id)
+			default:
+				values = append(values, nil)
+			}
+		}
+		rows.values = append(rows.values, values)
+	}
+
+	return rows, nil
+}
+
+type fakeRows struct {
+	pgx.Rows
+
+	values  [][]interface{}
+	current int
+	err     error
+}
+
+func (r *fakeRows) Next() bool {
+	r.current++
+	return r.current <= len(r.values)
+}
+
+func (r *fakeRows) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.current == 0 {
+		r.current = 1
+	}
+	if r.current > len(r.values) {
+		return pgx.ErrNoRows
+	}
+
+	for i, value := range r.values[r.current-1] {
+		if value == nil || i >= len(dest) {
+			continue
+		}
+
+		d := reflect.ValueOf(dest[i]).Elem()
+		if d.Kind() == reflect.Ptr {
+			p := reflect.New(d.Type().Elem())
+			p.Elem().Set(reflect.ValueOf(value).Convert(d.Type().Elem()))
+			d.Set(p)
+		} else {
+			d.Set(reflect.ValueOf(value).Convert(d.Type()))
+		}
+	}
+
+	return nil
+}
+
+func (r *fakeRows) Err() error {
+	return r.err
+}
+
+func (r *fakeRows) Close() {}
+
+func newCountingTransactionStore() TransactionRepository {
+	currencyStore := NewPGPoolCurrencyStore(nil, testLogger)
+	channelStore := NewPGPoolChannelStore(nil, testLogger)
+
+	return NewPGPoolTransactionStore(
+		nil,
+		NewPGPoolProfileStore(nil, currencyStore, testLogger),
+		NewPGPoolInstrumentStore(nil, testLogger),
+		NewPGPoolAccountStore(nil, currencyStore, channelStore, testLogger),
+		currencyStore,
+		testLogger,
+	)
+}
+
+// queryTransactions lists rows transactions with their foreigns and
+// references hydrated and returns how many queries it took.
+func queryTransactions(tb testing.TB, store TransactionRepository, rows int) int {
+	tx := &countingTx{rows: rows}
+	ctx := context.WithValue(context.Background(), pgTxKey{}, pgx.Tx(tx))
+
+	err, _, l := store.Query(ctx, NewTransactionSpecificationWithLimitAndOffset(rows, 0))
+	if err != nil {
+		tb.Fatalf("query failed: %v", err)
+	}
+
+	if len(l) != rows {
+		tb.Fatalf("got %d transactions, want %d", len(l), rows)
+	}
+
+	last := l[len(l)-1]
+	if last.Profile == nil || last.Profile.Currency == nil || last.Account == nil ||
+		last.Account.Channel == nil || last.Reference == nil || last.Reference.Account == nil {
+		tb.Fatalf("transaction foreigns are not hydrated: %+v", last)
+	}
+
+	return tx.queries
+}
+
+func TestTransactionQueryCountDoesNotGrowWithRows(t *testing.T) {
+	store := newCountingTransactionStore()
+
+	one := queryTransactions(t, store, 1)
+	hundred := queryTransactions(t, store, 100)
+
+	if one != hundred {
+		t.Errorf("listing 1 transaction took %d queries, 100 took %d", one, hundred)
+	}
+}
+
+func BenchmarkTransactionQuery(b *testing.B) {
+	store := newCountingTransactionStore()
+
+	for _, rows := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("rows=%d", rows), func(b *testing.B) {
+			queries := 0
+			for i := 0; i < b.N; i++ {
+				queries = queryTransactions(b, store, rows)
+			}
+			b.ReportMetric(float64(queries), "queries/op")
+			b.ReportMetric(float64(queries)/float64(rows), "queries/row")
+		})
+	}
+}
+
+func TestInsertRejectsUnconvertedTransaction(t *testing.T) {
+	store := newCountingTransactionStore().(*PGPoolTransactionStore)
+	tx := &countingTx{}
+	ctx := context.WithValue(context.Background(), pgTxKey{}, pgx.Tx(tx))
+
+	rub, usd := 643, 840
+	enabled := true
+	amount := uint(100)
+
+	transaction := &Transaction{
+		Amount:   &amount,
+		Currency: &Currency{Id: &rub},
+		Account:  &Account{
+			CurrencyConversionEnabled: &enabled,
+			Currency:                  &Currency{Id: &usd},
+		},
+	}
+
+	if err, _ := store.insertRow(ctx, transaction); !errors.Is(err, ErrValidation) {
+		t.Fatalf("insert without amount converted = %v, want validation error", err)
+	}
+
+	if tx.queries != 0 {
+		t.Errorf("rejected insert made %d queries", tx.queries)
+	}
+}
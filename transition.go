@@ -0,0 +1,89 @@
+package repository
+
+import (
+	"fmt"
+)
+
+var ErrInvalidTransition = fmt.Errorf("invalid status transition: %w", ErrConflict)
+
+var cardholderTransitions = map[string][]string{
+	NEW:           {WAITMETHODURL, WAIT3DS, SUCCESS, DECLINED},
+	WAITMETHODURL: {WAIT3DS, SUCCESS, DECLINED},
+	WAIT3DS:       {SUCCESS, DECLINED},
+}
+
+var merchantTransitions = map[string][]string{
+	NEW: {SUCCESS, DECLINED},
+}
+
+// transactionTransitions lists, per transaction type, the statuses a
+// transaction may move to from each non final status. Only the
+// cardholder initiated types go through 3DS.
+var transactionTransitions = map[string]map[string][]string{
+	AUTH:        cardholderTransitions,
+	PREAUTH:     cardholderTransitions,
+	CONFIRMAUTH: merchantTransitions,
+	REVERSAL:    merchantTransitions,
+	REFUND:      merchantTransitions,
+	REBILL:      merchantTransitions,
+}
+
+var finalStatuses = []string{SUCCESS, DECLINED}
+
+func CanTransit(txType string, from string, to string) bool {
+	for _, status := range transactionTransitions[txType][from] {
+		if status == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// transitionArrays flattens transactionTransitions into parallel arrays
+// so an update can check the transition against the stored row.
+func transitionArrays() ([]string, []string, []string) {
+	var types, froms, tos []string
+
+	for txType, transitions := range transactionTransitions {
+		for from, l := range transitions {
+			for _, to := range l {
+				types = append(types, txType)
+				froms = append(froms, from)
+				tos = append(tos, to)
+			}
+		}
+	}
+
+	return types, froms, tos
+}
+
+func isFinalStatus(status string) bool {
+	for _, final := range finalStatuses {
+		if status == final {
+			return true
+		}
+	}
+
+	return false
+}
+
+// transit moves the transaction to status the way the store update checks
+// it: a final status can not change, any other may stay as it is or move
+// along transactionTransitions.
+func (tx *Transaction) transit(status string) error {
+	if tx.Status != nil && tx.Type != nil && (isFinalStatus(*tx.Status) ||
+		*tx.Status != status && !CanTransit(*tx.Type, *tx.Status, status)) {
+		return fmt.Errorf(
+			"%s transaction can not move from %s to %s: %w",
+			*tx.Type,
+			*tx.Status,
+			status,
+			ErrInvalidTransition,
+		)
+	}
+
+	tx.Status = &status
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"errors"
+	"context"
+	"strings"
+	"testing"
+	"github.com/jackc/pgx/v4"
+)
+
+func TestTransit(t *testing.T) {
+	cases := []struct {
+		txType string
+		from   string
+		to     string
+		ok     bool
+	}{
+		{AUTH, NEW, WAIT3DS, true},
+		{AUTH, WAIT3DS, SUCCESS, true},
+		{AUTH, WAIT3DS, WAIT3DS, true},
+		{AUTH, WAIT3DS, WAITMETHODURL, false},
+		{REFUND, NEW, NEW, true},
+		{REFUND, NEW, WAIT3DS, false},
+		{REFUND, NEW, DECLINED, true},
+		{AUTH, SUCCESS, SUCCESS, false},
+		{AUTH, DECLINED, SUCCESS, false},
+	}
+
+	for _, c := range cases {
+		txType, from := c.txType, c.from
+		tx := &Transaction{Type: &txType, Status: &from}
+
+		err := tx.transit(c.to)
+		if c.ok && err != nil {
+			t.Errorf("%s %s -> %s: %v", c.txType, c.from, c.to, err)
+		}
+		if !c.ok && !errors.Is(err, ErrInvalidTransition) {
+			t.Errorf("%s %s -> %s: got %v, want invalid transition", c.txType, c.from, c.to, err)
+		}
+	}
+}
+
+// rejectingTx matches no row on update and reports the stored type,
+// status and version of the transaction.
+type rejectingTx struct {
+	pgx.Tx
+
+	row []interface{}
+}
+
+func (tx *rejectingTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	if strings.HasPrefix(sql, "update transactions set") {
+		return &fakeRows{err: pgx.ErrNoRows}
+	}
+	return &fakeRows{values: [][]interface{}{tx.row}}
+}
+
+func TestUpdateRejectsTypeChange(t *testing.T) {
+	store := newCountingTransactionStore().(*PGPoolTransactionStore)
+	tx := &rejectingTx{row: []interface{}{REFUND, NEW, 3}}
+	ctx := context.WithValue(context.Background(), pgTxKey{}, pgx.Tx(tx))
+
+	id, version := 1, 3
+	txType := AUTH
+	transaction := &Transaction{Id: &id, Type: &txType, Version: &version}
+
+	if err := store.update(ctx, transaction); !errors.Is(err, ErrValidation) {
+		t.Errorf("refund turned into auth: got %v, want validation error", err)
+	}
+
+	txType = REFUND
+	status := WAIT3DS
+	transaction = &Transaction{Id: &id, Type: &txType, Status: &status, Version: &version}
+
+	if err := store.update(ctx, transaction); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("refund waiting for 3ds: got %v, want invalid transition", err)
+	}
+}
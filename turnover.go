@@ -0,0 +1,230 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+	"strings"
+	"context"
+)
+
+type TurnOverDimension string
+
+const (
+	TurnOverByProfile  TurnOverDimension = "profile"
+	TurnOverByAccount  TurnOverDimension = "account"
+	TurnOverByChannel  TurnOverDimension = "channel"
+	TurnOverByCurrency TurnOverDimension = "currency"
+	TurnOverByStatus   TurnOverDimension = "status"
+	TurnOverByType     TurnOverDimension = "type"
+	TurnOverByHour     TurnOverDimension = "hour"
+	TurnOverByDay      TurnOverDimension = "day"
+	TurnOverByMonth    TurnOverDimension = "month"
+)
+
+// TurnOverKey identifies a turnover group. Only the fields of the requested
+// dimensions are set, except Currency which is always set since amounts in
+// different currencies are never summed together. Bucket is the start of
+// the hour, day or month in the database session time zone.
+type TurnOverKey struct {
+	ProfileId *int
+	AccountId *int
+	ChannelId *int
+	Currency  *Currency
+	Status    *string
+	Type      *string
+	Bucket    *time.Time
+}
+
+type TurnOverRow struct {
+	TurnOverKey
+
+	Cnt         uint
+	Approved    uint
+	Declined    uint
+	Sum         Money
+	ApprovedSum Money
+}
+
+// ApprovalRate is the share of successful transactions among the finished
+// ones, zero when none is finished.
+func (r *TurnOverRow) ApprovalRate() float64 {
+	finished := r.Approved + r.Declined
+	if finished == 0 {
+		return 0
+	}
+	return float64(r.Approved) / float64(finished)
+}
+
+// AverageTicket is the mean amount of the successful transactions.
+func (r *TurnOverRow) AverageTicket() Money {
+	if r.Approved == 0 {
+		return NewMoney(0, r.ApprovedSum.Currency)
+	}
+	return NewMoney(r.ApprovedSum.Amount/r.Approved, r.ApprovedSum.Currency)
+}
+
+type turnOverColumn struct {
+	dimension TurnOverDimension
+	expr      string
+	null      string
+}
+
+var turnOverColumns = []turnOverColumn{
+	{TurnOverByProfile, "t.profile_id", "null::integer"},
+	{TurnOverByAccount, "t.account_id", "null::integer"},
+	{TurnOverByChannel, "a.channel_id", "null::integer"},
+	{TurnOverByCurrency, "t.currency_id", "t.currency_id"},
+	{TurnOverByStatus, "t.status", "null::text"},
+	{TurnOverByType, "t.type", "null::text"},
+}
+
+var turnOverBuckets = map[TurnOverDimension]string{
+	TurnOverByHour:  "date_trunc('hour', t.created)",
+	TurnOverByDay:   "date_trunc('day', t.created)",
+	TurnOverByMonth: "date_trunc('month', t.created)",
+}
+
+// turnOverSelect returns the key columns to select and the ones to group
+// by for the requested dimensions.
+func turnOverSelect(dimensions []TurnOverDimension) (error, []string, []string) {
+	requested := make(map[TurnOverDimension]bool)
+	bucket := ""
+
+	for _, dimension := range dimensions {
+		if expr, ok := turnOverBuckets[dimension]; ok {
+			if bucket != "" && bucket != expr {
+				return fmt.Errorf("only one of hour, day or month turnover buckets is allowed: %w", ErrValidation), nil, nil
+			}
+			bucket = expr
+			continue
+		}
+		requested[dimension] = true
+	}
+
+	var columns, groupBy []string
+
+	for _, column := range turnOverColumns {
+		if requested[column.dimension] || column.dimension == TurnOverByCurrency {
+			columns = append(columns, column.expr)
+			groupBy = append(groupBy, column.expr)
+		} else {
+			columns = append(columns, column.null)
+		}
+		delete(requested, column.dimension)
+	}
+
+	for dimension := range requested {
+		return fmt.Errorf("unknown turnover dimension %s: %w", dimension, ErrValidation), nil, nil
+	}
+
+	if bucket != "" {
+		columns = append(columns, bucket)
+		groupBy = append(groupBy, bucket)
+	} else {
+		columns = append(columns, "null::timestamptz")
+	}
+
+	return nil, columns, groupBy
+}
+
+// TurnOver groups the transactions matched by specification by the given
+// dimensions and currency. Paging and ordering of the specification are
+// ignored; rows come ordered by their keys.
+func (ts *PGPoolTransactionStore) TurnOver(
+	ctx context.Context,
+	specification TransactionSpecification,
+	dimensions ...TurnOverDimension,
+) (error, []*TurnOverRow) {
+	var l []*TurnOverRow
+
+	err, columns, groupBy := turnOverSelect(dimensions)
+	if err != nil {
+		return err, l
+	}
+
+	clauses, args := specification.ToSqlClauses().Filter().Build()
+	args = append(args, SUCCESS, DECLINED)
+
+	rows, err := pgQuerierFromContext(ctx, ts.pool).Query(
+		ctx, fmt.Sprintf(
+			`select
+				%s,
+				count(*),
+				count(*) filter (where t.status=$%d),
+				count(*) filter (where t.status=$%d),
+				COALESCE(sum(t.amount), 0),
+				COALESCE(sum(t.amount) filter (where t.status=$%d), 0)
+			from (select * from transactions %s) t
+			left join accounts a on a.id=t.account_id
+			group by %s
+			order by %s`,
+			strings.Join(columns, ", "),
+			len(args)-1,
+			len(args),
+			len(args)-1,
+			clauses,
+			strings.Join(groupBy, ", "),
+			strings.Join(groupBy, ", "),
+		),
+		args...,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to query turn over rows: %w", mapPgError(err)), l
+	}
+	defer rows.Close()
+
+	currencyIds := make(idSet)
+
+	for rows.Next() {
+		var row TurnOverRow
+		var currencyId *int
+
+		if err := rows.Scan(
+			&row.ProfileId,
+			&row.AccountId,
+			&row.ChannelId,
+			&currencyId,
+			&row.Status,
+			&row.Type,
+			&row.Bucket,
+			&row.Cnt,
+			&row.Approved,
+			&row.Declined,
+			&row.Sum.Amount,
+			&row.ApprovedSum.Amount,
+		); err != nil {
+			return fmt.Errorf("failed to get turn over row: %w", mapPgError(err)), l
+		}
+
+		if currencyId != nil {
+			row.Currency = &Currency{
+				Id: currencyId,
+			}
+			currencyIds.add(currencyId)
+		}
+
+		l = append(l, &row)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterating over rows of turn over: %w", mapPgError(err)), l
+	}
+
+	err, currencies := currenciesByIds(ctx, ts.currencyStore, currencyIds)
+	if err != nil {
+		return fmt.Errorf("Can not update turn over currencies: %w", err), l
+	}
+
+	for _, row := range l {
+		if row.Currency != nil {
+			if currency, ok := currencies[*row.Currency.Id]; ok {
+				row.Currency = currency
+			}
+		}
+		row.Sum.Currency = row.Currency
+		row.ApprovedSum.Currency = row.Currency
+	}
+
+	return nil, l
+}
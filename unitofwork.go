@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"fmt"
+	"context"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// PgQuerier is implemented by both *pgxpool.Pool and pgx.Tx.
+type PgQuerier interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+type pgTxKey struct{}
+
+// pgQuerierFromContext returns the transaction started by a unit of work
+// if ctx carries one, so PG stores join it instead of using the pool.
+func pgQuerierFromContext(ctx context.Context, pool *pgxpool.Pool) PgQuerier {
+	if tx, ok := ctx.Value(pgTxKey{}).(pgx.Tx); ok {
+		return tx
+	}
+
+	return pool
+}
+
+type UnitOfWork interface {
+	Do(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+type PGPoolUnitOfWork struct {
+	pool   *pgxpool.Pool
+	logger LoggerFunc
+}
+
+// Do runs fn inside one database transaction. Repository calls made with
+// the context passed to fn share that transaction. It is committed when fn
+// returns nil and rolled back otherwise. Nested calls use savepoints.
+func (uow *PGPoolUnitOfWork) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	var tx pgx.Tx
+	var err error
+
+	if outer, ok := ctx.Value(pgTxKey{}).(pgx.Tx); ok {
+		tx, err = outer.Begin(ctx)
+	} else {
+		tx, err = uow.pool.Begin(ctx)
+	}
+
+	if err != nil {
+		return fmt.Errorf("can not begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := fn(context.WithValue(ctx, pgTxKey{}, tx)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("can not commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+func NewPGPoolUnitOfWork(pool *pgxpool.Pool, logger LoggerFunc) UnitOfWork {
+	return &PGPoolUnitOfWork{
+		pool:   pool,
+		logger: logger,
+	}
+}
@@ -0,0 +1,542 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// sealed is a card encrypted with its own data key. The data key is
+// wrapped with the master key keyId. PAN and holder are bound to the card
+// token, so ciphertexts can not be swapped between cards.
+type sealed struct {
+	keyId   string
+	dataKey []byte
+	pan     []byte
+	holder  []byte
+}
+
+func seal(key []byte, plaintext []byte, aad string) (error, []byte) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("can not make cipher: %v", err), nil
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("can not make gcm: %v", err), nil
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("can not generate nonce: %v", err), nil
+	}
+
+	return nil, gcm.Seal(nonce, nonce, plaintext, []byte(aad))
+}
+
+func open(key []byte, ciphertext []byte, aad string) (error, []byte) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("can not make cipher: %v", err), nil
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("can not make gcm: %v", err), nil
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return fmt.Errorf("ciphertext is too short"), nil
+	}
+
+	nonce := ciphertext[:gcm.NonceSize()]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext[gcm.NonceSize():], []byte(aad))
+	if err != nil {
+		return fmt.Errorf("can not decrypt: %v", err), nil
+	}
+
+	return nil, plaintext
+}
+
+type PGPoolCardVault struct {
+	pool   *pgxpool.Pool
+	keys   KeyProvider
+	logger LoggerFunc
+}
+
+// panHasher returns the keyed hash cards are looked up by PAN with.
+func (cv *PGPoolCardVault) panHasher(ctx context.Context) (error, func(pan PAN) string) {
+	err, key := cv.keys.HashKey(ctx)
+	if err != nil {
+		return fmt.Errorf("can not get hash key: %w", err), nil
+	}
+
+	return nil, func(pan PAN) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(pan))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+}
+
+func (cv *PGPoolCardVault) seal(ctx context.Context, card *Card) (error, *sealed) {
+	err, keyId, key := cv.keys.CurrentKey(ctx)
+	if err != nil {
+		return fmt.Errorf("can not get current key: %w", err), nil
+	}
+
+	dataKey := make([]byte, vaultKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return fmt.Errorf("can not generate data key: %v", err), nil
+	}
+
+	s := &sealed{keyId: keyId}
+
+	if err, s.dataKey = seal(key, dataKey, keyId); err != nil {
+		return fmt.Errorf("can not wrap data key: %w", err), nil
+	}
+
+	if err, s.pan = seal(dataKey, []byte(*card.PAN), "pan:"+*card.Token); err != nil {
+		return fmt.Errorf("can not encrypt pan: %w", err), nil
+	}
+
+	if card.Holder != nil {
+		if err, s.holder = seal(dataKey, []byte(*card.Holder), "holder:"+*card.Token); err != nil {
+			return fmt.Errorf("can not encrypt holder: %w", err), nil
+		}
+	}
+
+	return nil, s
+}
+
+func (cv *PGPoolCardVault) open(ctx context.Context, card *Card, s *sealed) error {
+	err, key := cv.keys.Key(ctx, s.keyId)
+	if err != nil {
+		return fmt.Errorf("can not get key of card with id=%v: %w", *card.Id, err)
+	}
+
+	err, dataKey := open(key, s.dataKey, s.keyId)
+	if err != nil {
+		return fmt.Errorf("can not unwrap data key of card with id=%v: %w", *card.Id, err)
+	}
+
+	err, pan := open(dataKey, s.pan, "pan:"+*card.Token)
+	if err != nil {
+		return fmt.Errorf("can not decrypt pan of card with id=%v: %w", *card.Id, err)
+	}
+
+	p := PAN(pan)
+	card.PAN = &p
+	card.Holder = nil
+
+	if s.holder != nil {
+		err, holder := open(dataKey, s.holder, "holder:"+*card.Token)
+		if err != nil {
+			return fmt.Errorf("can not decrypt holder of card with id=%v: %w", *card.Id, err)
+		}
+
+		h := string(holder)
+		card.Holder = &h
+	}
+
+	return nil
+}
+
+func expDateValue(expDate *ExpDate) *time.Time {
+	if expDate == nil {
+		return nil
+	}
+	return &expDate.Time
+}
+
+func (cv *PGPoolCardVault) Add(ctx context.Context, card *Card) error {
+	if err := ValidateCard(card, time.Now()); err != nil {
+		return err
+	}
+
+	err, token := generateToken(32)
+	if err != nil {
+		return fmt.Errorf("can not generate token: %v", err)
+	}
+	card.Token = token
+
+	err, hashPAN := cv.panHasher(ctx)
+	if err != nil {
+		return err
+	}
+
+	err, s := cv.seal(ctx, card)
+	if err != nil {
+		return err
+	}
+
+	return mapPgError(pgQuerierFromContext(ctx, cv.pool).QueryRow(
+		ctx,
+		`insert into cards (
+			token,
+			pan_hash,
+			pan,
+			holder,
+			exp_date,
+			key_id,
+			data_key
+		) values ($1, $2, $3, $4, $5, $6, $7) returning id`,
+		card.Token,
+		hashPAN(*card.PAN),
+		s.pan,
+		s.holder,
+		expDateValue(card.ExpDate),
+		s.keyId,
+		s.dataKey,
+	).Scan(&card.Id))
+}
+
+func (cv *PGPoolCardVault) Delete(ctx context.Context, card *Card) error {
+	var s sealed
+	var expDate *time.Time
+
+	err := pgQuerierFromContext(ctx, cv.pool).QueryRow(
+		ctx,
+		`delete from
+			cards
+		where
+			id=$1
+		returning
+			token,
+			pan,
+			holder,
+			exp_date,
+			key_id,
+			data_key`,
+		card.Id,
+	).Scan(
+		&card.Token,
+		&s.pan,
+		&s.holder,
+		&expDate,
+		&s.keyId,
+		&s.dataKey,
+	)
+
+	if err != nil {
+		return mapPgError(err)
+	}
+
+	card.ExpDate = nil
+	if expDate != nil {
+		card.ExpDate = &ExpDate{*expDate}
+	}
+
+	return cv.open(ctx, card, &s)
+}
+
+func (cv *PGPoolCardVault) Query(ctx context.Context, specification CardSpecification) (error, int, []*Card) {
+	var l []*Card
+	var c int = 0
+
+	err, hashPAN := cv.panHasher(ctx)
+	if err != nil {
+		return err, c, l
+	}
+
+	conn := pgQuerierFromContext(ctx, cv.pool)
+	sqlClauses := specification.ToSqlClauses(hashPAN)
+	clauses, args := sqlClauses.Build()
+
+	rows, err := conn.Query(
+		ctx, fmt.Sprintf(
+			`select
+				count(*) over(),
+				id,
+				token,
+				pan,
+				holder,
+				exp_date,
+				key_id,
+				data_key
+			from cards %s`,
+			clauses,
+		),
+		args...,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to query cards rows: %w", mapPgError(err)), c, l
+	}
+	defer rows.Close()
+
+	var sealedCards []*sealed
+
+	for rows.Next() {
+		var card Card
+		var s sealed
+		var expDate *time.Time
+
+		if err = rows.Scan(
+			&c,
+			&card.Id,
+			&card.Token,
+			&s.pan,
+			&s.holder,
+			&expDate,
+			&s.keyId,
+			&s.dataKey,
+		); err != nil {
+			return fmt.Errorf("failed to get card row: %w", mapPgError(err)), c, l
+		}
+
+		if expDate != nil {
+			card.ExpDate = &ExpDate{*expDate}
+		}
+
+		l = append(l, &card)
+		sealedCards = append(sealedCards, &s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterating over rows of cards: %w", mapPgError(err)), c, l
+	}
+
+	if len(l) == 0 && sqlClauses.Offset != nil && *sqlClauses.Offset > 0 {
+		filter, filterArgs := sqlClauses.Filter().Build()
+
+		err = conn.QueryRow(
+			ctx,
+			fmt.Sprintf("select count(*) from cards %s", filter),
+			filterArgs...,
+		).Scan(&c)
+
+		if err != nil {
+			return fmt.Errorf("failed to get cards cnt: %w", mapPgError(err)), c, l
+		}
+	}
+
+	for i, card := range l {
+		if err := cv.open(ctx, card, sealedCards[i]); err != nil {
+			return err, c, nil
+		}
+	}
+
+	return nil, c, l
+}
+
+// Update changes the expiry date and the holder, keeping the token and the
+// PAN. The card is sealed again with a new data key under the current key.
+func (cv *PGPoolCardVault) Update(ctx context.Context, card *Card) error {
+	if err := ValidateCardUpdate(card, time.Now()); err != nil {
+		return err
+	}
+
+	uow := NewPGPoolUnitOfWork(cv.pool, cv.logger)
+
+	return uow.Do(ctx, func(ctx context.Context) error {
+		conn := pgQuerierFromContext(ctx, cv.pool)
+		old := &Card{Id: card.Id}
+		var s sealed
+		var expDate *time.Time
+
+		err := conn.QueryRow(
+			ctx,
+			"select token, pan, holder, exp_date, key_id, data_key from cards where id=$1 for update",
+			card.Id,
+		).Scan(
+			&old.Token,
+			&s.pan,
+			&s.holder,
+			&expDate,
+			&s.keyId,
+			&s.dataKey,
+		)
+
+		if err != nil {
+			return mapPgError(err)
+		}
+
+		if err := cv.open(ctx, old, &s); err != nil {
+			return err
+		}
+
+		if card.PAN != nil && *card.PAN != *old.PAN {
+			return fmt.Errorf("pan of card with id=%v can not be changed: %w", *card.Id, ErrValidation)
+		}
+
+		card.Token = old.Token
+		card.PAN = old.PAN
+
+		if card.ExpDate == nil && expDate != nil {
+			card.ExpDate = &ExpDate{*expDate}
+		}
+
+		if card.Holder == nil {
+			card.Holder = old.Holder
+		}
+
+		err, sealedCard := cv.seal(ctx, card)
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.Exec(
+			ctx,
+			`update cards set
+				pan=$2,
+				holder=$3,
+				exp_date=$4,
+				key_id=$5,
+				data_key=$6,
+				updated=now()
+			where
+				id=$1`,
+			card.Id,
+			sealedCard.pan,
+			sealedCard.holder,
+			expDateValue(card.ExpDate),
+			sealedCard.keyId,
+			sealedCard.dataKey,
+		)
+
+		if err != nil {
+			return fmt.Errorf("Can not update card with id=%v: %w", *card.Id, mapPgError(err))
+		}
+
+		return nil
+	})
+}
+
+// Rotate re-encrypts the cards sealed with a key other than the current
+// one, batchSize cards per database transaction, and returns how many were
+// re-encrypted. Every card gets a new data key. Retired keys may be removed
+// from the key provider once Rotate returns without error.
+func (cv *PGPoolCardVault) Rotate(ctx context.Context, batchSize int) (error, int) {
+	var rotated int
+
+	if batchSize <= 0 {
+		return fmt.Errorf("batch size %d is not positive: %w", batchSize, ErrValidation), rotated
+	}
+
+	err, keyId, _ := cv.keys.CurrentKey(ctx)
+	if err != nil {
+		return fmt.Errorf("can not get current key: %w", err), rotated
+	}
+
+	uow := NewPGPoolUnitOfWork(cv.pool, cv.logger)
+
+	for {
+		var batch int
+
+		err := uow.Do(ctx, func(ctx context.Context) error {
+			conn := pgQuerierFromContext(ctx, cv.pool)
+
+			rows, err := conn.Query(
+				ctx,
+				`select
+					id,
+					token,
+					pan,
+					holder,
+					key_id,
+					data_key
+				from cards
+				where
+					key_id<>$1
+				order by id
+				limit $2
+				for update skip locked`,
+				keyId,
+				batchSize,
+			)
+
+			if err != nil {
+				return fmt.Errorf("failed to query cards rows: %w", mapPgError(err))
+			}
+			defer rows.Close()
+
+			var cards []*Card
+			var sealedCards []*sealed
+
+			for rows.Next() {
+				var card Card
+				var s sealed
+
+				if err := rows.Scan(
+					&card.Id,
+					&card.Token,
+					&s.pan,
+					&s.holder,
+					&s.keyId,
+					&s.dataKey,
+				); err != nil {
+					return fmt.Errorf("failed to get card row: %w", mapPgError(err))
+				}
+
+				cards = append(cards, &card)
+				sealedCards = append(sealedCards, &s)
+			}
+
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("failed to iterating over rows of cards: %w", mapPgError(err))
+			}
+			rows.Close()
+
+			for i, card := range cards {
+				if err := cv.open(ctx, card, sealedCards[i]); err != nil {
+					return err
+				}
+
+				err, s := cv.seal(ctx, card)
+				if err != nil {
+					return err
+				}
+
+				_, err = conn.Exec(
+					ctx,
+					"update cards set pan=$2, holder=$3, key_id=$4, data_key=$5, updated=now() where id=$1",
+					card.Id,
+					s.pan,
+					s.holder,
+					s.keyId,
+					s.dataKey,
+				)
+
+				if err != nil {
+					return fmt.Errorf("Can not update card with id=%v: %w", *card.Id, mapPgError(err))
+				}
+			}
+
+			batch = len(cards)
+
+			return nil
+		})
+
+		if err != nil {
+			return err, rotated
+		}
+
+		rotated += batch
+
+		cv.logger(ctx).Printf("Re-encrypted %d cards with key %s", rotated, keyId)
+
+		if batch < batchSize {
+			return nil, rotated
+		}
+	}
+}
+
+func NewPGPoolCardVault(
+	pool   *pgxpool.Pool,
+	keys   KeyProvider,
+	logger LoggerFunc,
+) *PGPoolCardVault {
+	return &PGPoolCardVault{
+		pool:   pool,
+		keys:   keys,
+		logger: logger,
+	}
+}
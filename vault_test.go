@@ -0,0 +1,289 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+	"bytes"
+	"errors"
+	"context"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"encoding/json"
+	"path/filepath"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgconn"
+)
+
+type vaultRow struct {
+	id      int
+	token   string
+	panHash string
+	pan     []byte
+	holder  []byte
+	expDate time.Time
+	keyId   string
+	dataKey []byte
+}
+
+// cardsTx keeps the cards table in memory and answers the statements of
+// PGPoolCardVault. Nested units of work run in the same transaction.
+type cardsTx struct {
+	pgx.Tx
+
+	rows []*vaultRow
+}
+
+func (tx *cardsTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	return tx, nil
+}
+
+func (tx *cardsTx) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (tx *cardsTx) Rollback(ctx context.Context) error {
+	return nil
+}
+
+func (tx *cardsTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	if !strings.HasPrefix(sql, "update cards set pan=$2") {
+		return nil, fmt.Errorf("unexpected exec %q", sql)
+	}
+
+	for _, row := range tx.rows {
+		if row.id == *args[0].(*int) {
+			row.pan = args[1].([]byte)
+			row.holder = args[2].([]byte)
+			row.keyId = args[3].(string)
+			row.dataKey = args[4].([]byte)
+		}
+	}
+
+	return nil, nil
+}
+
+func (tx *cardsTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	if !strings.HasPrefix(sql, "insert into cards") {
+		return &fakeRows{err: fmt.Errorf("unexpected query %q", sql)}
+	}
+
+	row := &vaultRow{
+		id:      len(tx.rows) + 1,
+		token:   *args[0].(*string),
+		panHash: args[1].(string),
+		pan:     args[2].([]byte),
+		holder:  args[3].([]byte),
+		expDate: *args[4].(*time.Time),
+		keyId:   args[5].(string),
+		dataKey: args[6].([]byte),
+	}
+	tx.rows = append(tx.rows, row)
+
+	return &fakeRows{values: [][]interface{}{{row.id}}}
+}
+
+func (tx *cardsTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	rows := &fakeRows{}
+
+	switch {
+	case strings.Contains(sql, "key_id<>$1"):
+		for _, row := range tx.rows {
+			if row.keyId != args[0].(string) && len(rows.values) < args[1].(int) {
+				rows.values = append(rows.values, []interface{}{row.id, row.token, row.pan, row.holder, row.keyId, row.dataKey})
+			}
+		}
+	case strings.Contains(sql, "where pan_hash=$1"), strings.Contains(sql, "where token=$1"):
+		var l []*vaultRow
+		for _, row := range tx.rows {
+			if row.panHash == args[0] || row.token == args[0] {
+				l = append(l, row)
+			}
+		}
+		for _, row := range l {
+			rows.values = append(rows.values, []interface{}{len(l), row.id, row.token, row.pan, row.holder, row.expDate, row.keyId, row.dataKey})
+		}
+	default:
+		return nil, fmt.Errorf("unexpected query %q", sql)
+	}
+
+	return rows, nil
+}
+
+func newTestVault(t *testing.T) (string, *LocalFileKeyProvider, *PGPoolCardVault) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+
+	if err := GenerateLocalKey(path, "k1"); err != nil {
+		t.Fatalf("can not generate key: %v", err)
+	}
+
+	err, kp := NewLocalFileKeyProvider(path)
+	if err != nil {
+		t.Fatalf("can not load keys: %v", err)
+	}
+
+	return path, kp, NewPGPoolCardVault(nil, kp, testLogger)
+}
+
+func newTestCard(pan PAN, holder string) *Card {
+	return &Card{
+		PAN:     &pan,
+		ExpDate: &ExpDate{time.Now().AddDate(2, 0, 0)},
+		Holder:  &holder,
+	}
+}
+
+func queryCard(t *testing.T, ctx context.Context, vault *PGPoolCardVault, specification CardSpecification) *Card {
+	err, _, l := vault.Query(ctx, specification)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+
+	if len(l) != 1 {
+		t.Fatalf("got %d cards, want 1", len(l))
+	}
+
+	return l[0]
+}
+
+func TestSealOpen(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, vaultKeySize)
+
+	err, ciphertext := seal(key, []byte("4111111111111111"), "pan:token")
+	if err != nil {
+		t.Fatalf("seal failed: %v", err)
+	}
+
+	if bytes.Contains(ciphertext, []byte("4111111111111111")) {
+		t.Fatalf("ciphertext contains the plaintext")
+	}
+
+	err, plaintext := open(key, ciphertext, "pan:token")
+	if err != nil || string(plaintext) != "4111111111111111" {
+		t.Fatalf("open = %q, %v", plaintext, err)
+	}
+
+	if err, _ := open(key, ciphertext, "pan:other"); err == nil {
+		t.Errorf("opened with the aad of another card")
+	}
+
+	if err, _ := open(bytes.Repeat([]byte{2}, vaultKeySize), ciphertext, "pan:token"); err == nil {
+		t.Errorf("opened with another key")
+	}
+}
+
+func TestVaultLookupByPANHash(t *testing.T) {
+	_, _, vault := newTestVault(t)
+	tx := &cardsTx{}
+	ctx := context.WithValue(context.Background(), pgTxKey{}, pgx.Tx(tx))
+
+	visa := newTestCard("4111111111111111", "john doe")
+	master := newTestCard("5555555555554444", "jane doe")
+
+	for _, card := range []*Card{visa, master} {
+		if err := vault.Add(ctx, card); err != nil {
+			t.Fatalf("add failed: %v", err)
+		}
+	}
+
+	for _, row := range tx.rows {
+		if strings.Contains(row.panHash, "4111") || bytes.Contains(row.pan, []byte("4111")) {
+			t.Fatalf("card with id=%d stores the pan in clear", row.id)
+		}
+	}
+
+	err, hashPAN := vault.panHasher(ctx)
+	if err != nil {
+		t.Fatalf("can not get pan hasher: %v", err)
+	}
+
+	clauses, args := NewCardSpecificationByPAN("5555555555554444").ToSqlClauses(hashPAN).Build()
+	if clauses != "where pan_hash=$1" || len(args) != 1 || args[0] != hashPAN("5555555555554444") {
+		t.Fatalf("pan clauses = %q %v", clauses, args)
+	}
+
+	card := queryCard(t, ctx, vault, NewCardSpecificationByPAN("5555555555554444"))
+	if *card.Id != *master.Id || *card.PAN != "5555555555554444" || *card.Holder != "JANE DOE" {
+		t.Errorf("found %v, want card with id=%d", card, *master.Id)
+	}
+
+	card = queryCard(t, ctx, vault, NewCardSpecificationByToken(*visa.Token))
+	if *card.Id != *visa.Id || *card.PAN != "4111111111111111" {
+		t.Errorf("found %v, want card with id=%d", card, *visa.Id)
+	}
+}
+
+func TestVaultRotate(t *testing.T) {
+	path, kp, vault := newTestVault(t)
+	tx := &cardsTx{}
+	ctx := context.WithValue(context.Background(), pgTxKey{}, pgx.Tx(tx))
+
+	pans := []PAN{"4111111111111111", "5555555555554444", "4012888888881881"}
+	for _, pan := range pans {
+		if err := vault.Add(ctx, newTestCard(pan, "john doe")); err != nil {
+			t.Fatalf("add failed: %v", err)
+		}
+	}
+
+	var hashes []string
+	for _, row := range tx.rows {
+		hashes = append(hashes, row.panHash)
+	}
+
+	if err := GenerateLocalKey(path, "k2"); err != nil {
+		t.Fatalf("can not generate key: %v", err)
+	}
+
+	if err := kp.Reload(); err != nil {
+		t.Fatalf("can not reload keys: %v", err)
+	}
+
+	if err, _ := vault.Rotate(ctx, 0); !errors.Is(err, ErrValidation) {
+		t.Fatalf("rotate with batch size 0 = %v, want validation error", err)
+	}
+
+	err, rotated := vault.Rotate(ctx, 2)
+	if err != nil || rotated != len(pans) {
+		t.Fatalf("rotate = %d, %v, want %d", rotated, err, len(pans))
+	}
+
+	for i, row := range tx.rows {
+		if row.keyId != "k2" {
+			t.Errorf("card with id=%d is sealed with %s after rotation", row.id, row.keyId)
+		}
+		if row.panHash != hashes[i] {
+			t.Errorf("pan hash of card with id=%d changed by rotation", row.id)
+		}
+	}
+
+	if err, rotated := vault.Rotate(ctx, 2); err != nil || rotated != 0 {
+		t.Errorf("second rotate = %d, %v, want 0", rotated, err)
+	}
+
+	// the retired key is not needed anymore
+	err, file := readLocalKeyFile(path)
+	if err != nil {
+		t.Fatalf("can not read key file: %v", err)
+	}
+	delete(file.Keys, "k1")
+
+	body, err := json.Marshal(file)
+	if err != nil {
+		t.Fatalf("can not marshal key file: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, body, 0600); err != nil {
+		t.Fatalf("can not write key file: %v", err)
+	}
+
+	if err := kp.Reload(); err != nil {
+		t.Fatalf("can not reload keys: %v", err)
+	}
+
+	for _, pan := range pans {
+		card := queryCard(t, ctx, vault, NewCardSpecificationByPAN(pan))
+		if *card.PAN != pan || *card.Holder != "JOHN DOE" {
+			t.Errorf("found %v, want %s", card, pan)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package repository
+
+import (
+	"fmt"
+	"context"
+	"github.com/jackc/pgx/v4"
+)
+
+var ErrVersionConflict = fmt.Errorf("stale version: %w", ErrConflict)
+
+// requireVersion rejects an update that does not name the version it was
+// read at. Without it the update could not tell a newer change from the
+// one it read and would overwrite it.
+func requireVersion(table string, id *int, version *int) error {
+	if version == nil {
+		return fmt.Errorf("%s with id=%v is updated without a version: %w", table, *id, ErrValidation)
+	}
+
+	return nil
+}
+
+// versionConflict explains why an update guarded by the row version matched
+// no row: either the row is gone or it was changed since version was read.
+func versionConflict(ctx context.Context, conn PgQuerier, table string, id *int, version *int) error {
+	var current int
+
+	err := conn.QueryRow(
+		ctx,
+		fmt.Sprintf("select version from %s where id=$1", pgx.Identifier{table}.Sanitize()),
+		id,
+	).Scan(&current)
+
+	if err != nil {
+		return mapPgError(err)
+	}
+
+	if version != nil && *version != current {
+		return fmt.Errorf("%s with id=%v has version %d, not %d: %w", table, *id, current, *version, ErrVersionConflict)
+	}
+
+	return mapPgError(pgx.ErrNoRows)
+}
@@ -0,0 +1,28 @@
+package repository
+
+import (
+	"errors"
+	"context"
+	"testing"
+)
+
+func TestUpdateWithoutVersionIsRejected(t *testing.T) {
+	ctx := context.Background()
+	id := 1
+	status := SUCCESS
+
+	accountStore := NewPGPoolAccountStore(nil, nil, nil, testLogger)
+	if err := accountStore.Update(ctx, &Account{Id: &id}); !errors.Is(err, ErrValidation) {
+		t.Errorf("account: got %v, want validation error", err)
+	}
+
+	routeStore := NewPGPoolRouteStore(nil, nil, nil, accountStore, nil, testLogger)
+	if err := routeStore.Update(ctx, &Route{Id: &id}); !errors.Is(err, ErrValidation) {
+		t.Errorf("route: got %v, want validation error", err)
+	}
+
+	transactionStore := newCountingTransactionStore()
+	if err := transactionStore.Update(ctx, &Transaction{Id: &id, Status: &status}); !errors.Is(err, ErrValidation) {
+		t.Errorf("transaction: got %v, want validation error", err)
+	}
+}